@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/accesstoken"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/config"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordpolicy"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/validation"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func createAdminCmd(args []string) int {
+	fs := newFlagSet("create-admin")
+	username := fs.String("username", "", "username of the admin (required)")
+	info := fs.String("info", "", "info of the admin")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from the first line of stdin, a random password is generated and printed otherwise")
+	c, code, ok := loadConfig(fs, config.NewLoader(fs), args)
+	if !ok {
+		return code
+	}
+	if *username == "" {
+		log.Printf("--username is required")
+		return 2
+	}
+	usernamePolicy, err := newUsernamePolicy(c.Username)
+	if err != nil {
+		log.Printf("Error loading username policy: %v", err)
+		return 1
+	}
+	if *username, err = usernamePolicy.Normalize(*username); err != nil {
+		log.Printf("--username: %v", err)
+		return 2
+	}
+
+	password, generated, err := readOrGeneratePassword(*passwordStdin)
+	if err != nil {
+		log.Printf("Error getting password: %v", err)
+		return 1
+	}
+	if !generated {
+		if code, ok := checkPassword(c.Password, password, *username); !ok {
+			return code
+		}
+	}
+
+	return withUserDB(c, func(ctx context.Context, db database.UserDatabase) error {
+		hashedPassword, err := newHasher(c.Password.Hashing).Hash(password)
+		if err != nil {
+			return fmt.Errorf("error hashing password: %w", err)
+		}
+		_, err = db.InsertUser(ctx, database.User{
+			Username: *username,
+			Password: hashedPassword,
+			Role:     validation.RoleAdmin,
+			Info:     *info,
+		})
+		if err != nil {
+			if errors.Is(err, database.ErrConfusableUsername) {
+				return fmt.Errorf("username looks like an existing one: %s", *username)
+			}
+			if mongo.IsDuplicateKeyError(err) {
+				return fmt.Errorf("user already exists: %s", *username)
+			}
+			return err
+		}
+		log.Printf("Created admin: %s", *username)
+		if generated {
+			fmt.Println(password)
+		}
+		return nil
+	})
+}
+
+func setPasswordCmd(args []string) int {
+	fs := newFlagSet("set-password")
+	username := fs.String("username", "", "username of the user (required)")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from the first line of stdin, a random password is generated and printed otherwise")
+	mustChange := fs.Bool("must-change", false, "make the user change the password on the next login")
+	c, code, ok := loadConfig(fs, config.NewLoader(fs), args)
+	if !ok {
+		return code
+	}
+	if *username == "" {
+		log.Printf("--username is required")
+		return 2
+	}
+
+	password, generated, err := readOrGeneratePassword(*passwordStdin)
+	if err != nil {
+		log.Printf("Error getting password: %v", err)
+		return 1
+	}
+	if !generated {
+		if code, ok := checkPassword(c.Password, password, *username); !ok {
+			return code
+		}
+	}
+
+	return withUserDB(c, func(ctx context.Context, db database.UserDatabase) error {
+		if !generated {
+			hashes, err := db.FindPasswordHashes(ctx, *username)
+			if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+				return err
+			}
+			policy := passwordpolicy.Policy{HistorySize: c.Password.HistorySize}
+			if err := policy.CheckReuse(password, hashes); err != nil {
+				return err
+			}
+		}
+		hashedPassword, err := newHasher(c.Password.Hashing).Hash(password)
+		if err != nil {
+			return fmt.Errorf("error hashing password: %w", err)
+		}
+		if err := db.UpdateUserPassword(ctx, *username, hashedPassword, *mustChange); err != nil {
+			if errors.Is(err, database.ErrNoDocumentsModified) {
+				return fmt.Errorf("user not found: %s", *username)
+			}
+			return err
+		}
+		log.Printf("Password set for user: %s", *username)
+		if generated {
+			fmt.Println(password)
+		}
+		return nil
+	})
+}
+
+func listUsersCmd(args []string) int {
+	fs := newFlagSet("list-users")
+	asJSON := fs.Bool("json", false, "print users as JSON")
+	c, code, ok := loadConfig(fs, config.NewLoader(fs), args)
+	if !ok {
+		return code
+	}
+
+	return withUserDB(c, func(ctx context.Context, db database.UserDatabase) error {
+		us, err := db.FindAllUsers(ctx)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(us)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tUSERNAME\tROLE\tINFO")
+		for _, u := range us {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", u.ID.Hex(), u.Username, u.Role, u.Info)
+		}
+		return tw.Flush()
+	})
+}
+
+// usernameCollisionsCmd reports the usernames which collide, and creates the case-insensitive
+// index on usernames which the migration skips once there are none left.
+func usernameCollisionsCmd(args []string) int {
+	fs := newFlagSet("admin usernames collisions")
+	c, code, ok := loadConfig(fs, config.NewLoader(fs), args)
+	if !ok {
+		return code
+	}
+
+	return withUserDB(c, func(ctx context.Context, db database.UserDatabase) error {
+		report, err := db.FindUsernameCollisions(ctx)
+		if err != nil {
+			return err
+		}
+		for _, col := range report.Collisions {
+			fmt.Printf("collision: %s\n", col)
+		}
+		for _, col := range report.Confusables {
+			fmt.Printf("look-alike: %s\n", col)
+		}
+		for _, username := range report.Invalid {
+			fmt.Printf("invalid: %s\n", username)
+		}
+		if len(report.Collisions) > 0 {
+			return fmt.Errorf("%d username collision(s), rename all but one user of each with admin usernames rename and run this again", len(report.Collisions))
+		}
+		log.Printf("No username collisions")
+		if err := db.CreateUsernameCollationIndex(ctx); err != nil {
+			return err
+		}
+		log.Printf("Case-insensitive index on usernames created")
+		return nil
+	})
+}
+
+// renameUserCmd renames a user found by its username exactly as stored, as the usernames which collide
+// are kept as they are, and the API only finds users by the canonical form of their usernames.
+func renameUserCmd(args []string) int {
+	fs := newFlagSet("admin usernames rename")
+	username := fs.String("username", "", "username of the user exactly as stored, as listed by list-users (required)")
+	newUsername := fs.String("new-username", "", "new username of the user (required)")
+	c, code, ok := loadConfig(fs, config.NewLoader(fs), args)
+	if !ok {
+		return code
+	}
+	if *username == "" || *newUsername == "" {
+		log.Printf("--username and --new-username are required")
+		return 2
+	}
+	usernamePolicy, err := newUsernamePolicy(c.Username)
+	if err != nil {
+		log.Printf("Error loading username policy: %v", err)
+		return 1
+	}
+	if *newUsername, err = usernamePolicy.Normalize(*newUsername); err != nil {
+		log.Printf("--new-username: %v", err)
+		return 2
+	}
+
+	return withUserDB(c, func(ctx context.Context, db database.UserDatabase) error {
+		if err := db.RenameUser(ctx, *username, *newUsername); err != nil {
+			if errors.Is(err, database.ErrNoDocumentsModified) {
+				return fmt.Errorf("user not found: %s", *username)
+			}
+			if errors.Is(err, database.ErrConfusableUsername) {
+				return fmt.Errorf("username looks like an existing one: %s", *newUsername)
+			}
+			if mongo.IsDuplicateKeyError(err) {
+				return fmt.Errorf("user already exists: %s", *newUsername)
+			}
+			return err
+		}
+		log.Printf("Renamed user: %s to: %s", *username, *newUsername)
+		return nil
+	})
+}
+
+func migrateCmd(args []string) int {
+	fs := newFlagSet("migrate")
+	c, code, ok := loadConfig(fs, config.NewLoader(fs), args)
+	if !ok {
+		return code
+	}
+
+	return withUserDB(c, func(ctx context.Context, db database.UserDatabase) error {
+		applied, err := db.Migrate(ctx)
+		for _, m := range applied {
+			log.Printf("Applied migration %s", m)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			log.Printf("No pending migrations")
+		}
+		return nil
+	})
+}
+
+func mintTokenCmd(args []string) int {
+	fs := newFlagSet("mint-token")
+	sub := fs.String("sub", "", "subject, the user ID (required)")
+	role := fs.String("role", "", "role, user or admin (required)")
+	ttl := fs.Duration("ttl", time.Hour, "time to live")
+	c, code, ok := loadConfig(fs, config.NewLoader(fs), args)
+	if !ok {
+		return code
+	}
+	if *sub == "" {
+		log.Printf("--sub is required")
+		return 2
+	}
+	if err := validation.Role(*role); err != nil {
+		log.Printf("--%v", err)
+		return 2
+	}
+	if *ttl <= 0 {
+		log.Printf("--ttl must be positive")
+		return 2
+	}
+
+	key, err := jwk.FromRaw([]byte(c.Auth.AccessTokenSecret))
+	if err != nil {
+		log.Printf("Failed to create access token secret key")
+		return 1
+	}
+	at, err := accesstoken.New(key, *sub, *role, *ttl)
+	if err != nil {
+		log.Printf("Error minting token: %v", err)
+		return 1
+	}
+	fmt.Println(string(at))
+	return 0
+}
+
+func withUserDB(c config.Config, fn func(ctx context.Context, db database.UserDatabase) error) int {
+	ctx := context.Background()
+	conn, db, err := connectUserDB(ctx, c)
+	if err != nil {
+		log.Printf("Error connecting to UserDB, err: %v", err)
+		return 1
+	}
+	defer disconnectUserDB(conn)
+
+	if err := fn(ctx, db); err != nil {
+		log.Printf("Error: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// readOrGeneratePassword reads the first line of stdin or generates a random password,
+// generated is true when the password should be shown to the operator.
+// checkPassword checks a password given on the command line against the configured policy.
+func checkPassword(c config.Password, password string, username string) (code int, ok bool) {
+	policy, err := newPasswordPolicy(c)
+	if err != nil {
+		log.Printf("Error loading password policy: %v", err)
+		return 1, false
+	}
+	if err := policy.Check(password, username); err != nil {
+		var pe *passwordpolicy.Error
+		if errors.As(err, &pe) {
+			for _, v := range pe.Violations {
+				log.Printf("%s: %s", v.Rule, v.Message)
+			}
+			return 2, false
+		}
+		log.Printf("Error checking password policy: %v", err)
+		return 1, false
+	}
+	return 0, true
+}
+
+func readOrGeneratePassword(fromStdin bool) (password string, generated bool, err error) {
+	if fromStdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", false, fmt.Errorf("error reading password from stdin: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+		if password == "" {
+			return "", false, errors.New("password must not be empty")
+		}
+		return password, false, nil
+	}
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", false, fmt.Errorf("error generating password: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), true, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/bulk"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/config"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func importCmd(args []string) int {
+	fs := newFlagSet("import")
+	file := fs.String("file", "", "CSV or JSON file to import (required)")
+	formatName := fs.String("format", "", "csv or json (default from the file extension)")
+	dryRun := fs.Bool("dry-run", false, "only validate and report, nothing is inserted")
+	c, code, ok := loadConfig(fs, config.NewLoader(fs), args)
+	if !ok {
+		return code
+	}
+	if *file == "" {
+		log.Printf("--file is required")
+		return 2
+	}
+	format, err := fileFormat(*formatName, *file)
+	if err != nil {
+		log.Printf("%v", err)
+		return 2
+	}
+
+	usernamePolicy, err := newUsernamePolicy(c.Username)
+	if err != nil {
+		log.Printf("Error loading username policy: %v", err)
+		return 1
+	}
+	profileAttributesSchema, err := newProfileAttributesSchema(c.Profile)
+	if err != nil {
+		log.Printf("Error loading profile attributes schema: %v", err)
+		return 1
+	}
+	policy, err := newPasswordPolicy(c.Password)
+	if err != nil {
+		log.Printf("Error loading password policy: %v", err)
+		return 1
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Printf("Error opening file: %v", err)
+		return 1
+	}
+	defer f.Close()
+	rows, err := bulk.Decode(f, format)
+	if err != nil {
+		log.Printf("Error decoding %s: %v", *file, err)
+		return 1
+	}
+
+	return withUserDB(c, func(ctx context.Context, db database.UserDatabase) error {
+		report, err := bulk.Import(ctx, db, rows, usernamePolicy, profileAttributesSchema, policy, newHashPool(c.Password.Hashing), *dryRun)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+		if n := report.Counts[bulk.StatusInvalid] + report.Counts[bulk.StatusFailed]; n > 0 {
+			return fmt.Errorf("%d row(s) invalid or failed", n)
+		}
+		return nil
+	})
+}
+
+func exportCmd(args []string) int {
+	fs := newFlagSet("export")
+	file := fs.String("file", "", "file to write, stdout if empty")
+	formatName := fs.String("format", "", "csv or json (default from the file extension)")
+	includePasswordHashes := fs.Bool("include-password-hashes", false, "include password hashes so the export can be imported elsewhere")
+	c, code, ok := loadConfig(fs, config.NewLoader(fs), args)
+	if !ok {
+		return code
+	}
+	format, err := fileFormat(*formatName, *file)
+	if err != nil {
+		log.Printf("%v", err)
+		return 2
+	}
+
+	return withUserDB(c, func(ctx context.Context, db database.UserDatabase) error {
+		us, err := db.FindAllUsers(ctx)
+		if err != nil {
+			return err
+		}
+		var w io.Writer = os.Stdout
+		if *file != "" {
+			f, err := os.OpenFile(*file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := bulk.Encode(w, format, bulk.ExportRows(us, *includePasswordHashes)); err != nil {
+			return err
+		}
+		log.Printf("Exported %d user(s)", len(us))
+		return nil
+	})
+}
+
+func fileFormat(format string, file string) (bulk.Format, error) {
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(file), ".")
+	}
+	if format == "" {
+		return bulk.FormatJSON, nil
+	}
+	return bulk.ParseFormat(format)
+}
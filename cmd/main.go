@@ -4,120 +4,214 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/config"
 	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
-	"github.com/dnflash/demo-p1-go-user-management-service/internal/server"
-	"github.com/lestrrat-go/jwx/v2/jwk"
-	"github.com/spf13/viper"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/jsonschema"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/logging"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordhash"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordpolicy"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/usernames"
+	"github.com/spf13/pflag"
+	"go.mongodb.org/mongo-driver/mongo"
 	"log"
-	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
+	"regexp"
+	"runtime"
+	"strings"
 	"time"
+	// Time zones are needed to validate profiles, the runtime image has no tzdata
+	_ "time/tzdata"
 )
 
-type config struct {
-	userDBURI            string
-	serverAddress        string
-	rawAccessTokenSecret string
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+	// subcommands are run by their name following name, a command with subcommands has no run
+	subcommands []command
+}
+
+var commands = []command{
+	{name: "serve", usage: "serve the API (default)", run: serveCmd},
+	{name: "create-admin", usage: "create an admin user", run: createAdminCmd},
+	{name: "set-password", usage: "set the password of a user", run: setPasswordCmd},
+	{name: "list-users", usage: "list all users", run: listUsersCmd},
+	{name: "migrate", usage: "apply pending UserDB migrations", run: migrateCmd},
+	{name: "admin", subcommands: []command{
+		{name: "usernames", subcommands: []command{
+			{name: "collisions", usage: "report usernames which collide once normalized, creates the case-insensitive index once none do", run: usernameCollisionsCmd},
+			{name: "rename", usage: "rename a user by its username as stored, such as a colliding one", run: renameUserCmd},
+		}},
+	}},
+	{name: "import", usage: "import users from CSV or JSON", run: importCmd},
+	{name: "export", usage: "export users to CSV or JSON", run: exportCmd},
+	{name: "reconcile", usage: "reconcile UserDB against a users seed file", run: reconcileCmd},
+	{name: "mint-token", usage: "mint an access token signed with the configured key", run: mintTokenCmd},
 }
 
 func main() {
 	log.Printf("Go Demo - User Management Service")
-	appContext := context.Background()
+	os.Exit(run(os.Args[1:]))
+}
 
-	c, err := getConfig()
-	if err != nil {
-		log.Printf("Get config error: %v", err)
-		return
+func run(args []string) int {
+	// Flags without a command serve, as the binary did before it had commands
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help" {
+		return serveCmd(args)
 	}
+	return runCommand(commands, args, "")
+}
 
-	accessTokenSecret, err := jwk.FromRaw([]byte(c.rawAccessTokenSecret))
-	if err != nil {
-		log.Printf("Failed to create access token secret key")
-		return
+// runCommand runs the command of cs named by args[0], prefix is the names of the commands they are subcommands of.
+func runCommand(cs []command, args []string, prefix string) int {
+	if len(args) > 0 {
+		for _, c := range cs {
+			if c.name != args[0] {
+				continue
+			}
+			if c.subcommands != nil {
+				return runCommand(c.subcommands, args[1:], prefix+c.name+" ")
+			}
+			return c.run(args[1:])
+		}
+	}
+	usage(cs, prefix)
+	if len(args) > 0 && (args[0] == "-h" || args[0] == "--help" || args[0] == "help") {
+		return 0
 	}
+	return 2
+}
 
-	userDBConn, err := database.ConnectUserDB(appContext, c.userDBURI)
-	if err != nil {
-		log.Printf("Error connecting to UserDB at %s", c.userDBURI)
-		return
+func usage(cs []command, prefix string) {
+	fmt.Fprintf(os.Stderr, "Usage: %s %s<command> [flags]\n\nCommands:\n", os.Args[0], prefix)
+	printCommands(cs, "")
+	fmt.Fprintf(os.Stderr, "\nRun %s %s<command> --help for the flags of a command.\n", os.Args[0], prefix)
+}
+
+// printCommands lists the commands of cs by their names following prefix, with their subcommands in place of them.
+func printCommands(cs []command, prefix string) {
+	for _, c := range cs {
+		if c.subcommands != nil {
+			printCommands(c.subcommands, prefix+c.name+" ")
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "  %-28s %s\n", prefix+c.name, c.usage)
 	}
-	defer func() {
-		if err := userDBConn.Disconnect(appContext); err != nil {
-			log.Printf("Error disconnecting from UserDB: %v", err)
+}
+
+func newFlagSet(name string) *pflag.FlagSet {
+	return pflag.NewFlagSet(name, pflag.ContinueOnError)
+}
+
+// loadConfig parses args and loads the config, ok is false when the command should exit with code.
+func loadConfig(fs *pflag.FlagSet, loader *config.Loader, args []string) (c config.Config, code int, ok bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return c, 0, false
 		}
-	}()
+		return c, 2, false
+	}
+	if fs.NArg() > 0 {
+		log.Printf("Unexpected arguments: %v", fs.Args())
+		return c, 2, false
+	}
 
-	srv := server.Server{
-		UserDB:            database.UserDatabase{Database: userDBConn.Database(database.UserDB)},
-		AccessTokenSecret: accessTokenSecret,
+	c, err := loader.Load()
+	if err != nil {
+		log.Printf("Get config error: %v", err)
+		return c, 1, false
+	}
+	logLevel, _ := logging.ParseLevel(c.Log.Level)
+	logging.SetLevel(logLevel)
+	if c.Dev {
+		log.Printf("Running in dev mode")
 	}
+	return c, 0, true
+}
 
-	httpSrv := &http.Server{
-		Addr:           c.serverAddress,
-		Handler:        srv.Router(),
-		WriteTimeout:   15 * time.Second,
-		ReadTimeout:    15 * time.Second,
-		IdleTimeout:    60 * time.Second,
-		MaxHeaderBytes: 1024,
+func connectUserDB(ctx context.Context, c config.Config) (*mongo.Client, database.UserDatabase, error) {
+	connectCtx, cancel := context.WithTimeout(ctx, c.Database.ConnectTimeout)
+	defer cancel()
+	conn, err := database.ConnectUserDB(connectCtx, c.Database.URI)
+	if err != nil {
+		return nil, database.UserDatabase{}, err
 	}
+	return conn, database.UserDatabase{
+		Database:            conn.Database(c.Database.Name),
+		PasswordHistorySize: c.Password.HistorySize,
+	}, nil
+}
 
-	errChan := make(chan error, 1)
-	go func() {
-		log.Printf("Serving on %s", httpSrv.Addr)
-		if err := httpSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-			log.Printf("Listen and serve error: %v", err)
-			errChan <- err
-		}
-	}()
+func newUsernamePolicy(c config.Username) (usernames.Policy, error) {
+	allowed, err := regexp.Compile(c.AllowedPattern)
+	if err != nil {
+		return usernames.Policy{}, err
+	}
+	return usernames.Policy{MinLength: c.MinLength, MaxLength: c.MaxLength, Allowed: allowed}, nil
+}
 
-	// Handle graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, os.Interrupt)
+// newProfileAttributesSchema loads the schema of profile attributes, nil when none is configured.
+func newProfileAttributesSchema(c config.Profile) (*jsonschema.Schema, error) {
+	if c.AttributesSchemaFile == "" {
+		return nil, nil
+	}
+	return jsonschema.Load(c.AttributesSchemaFile)
+}
 
-	select {
-	case <-sigChan:
-		if err := httpSrv.Shutdown(appContext); err != nil {
-			log.Printf("Server shutdown error: %v", err)
-		}
-		log.Printf("Server shutdown")
-	case <-errChan:
-	}
-}
-
-func getConfig() (config, error) {
-	c := config{}
-	viper.AddConfigPath(".")
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
-	if err := viper.ReadInConfig(); err != nil {
-		if errors.As(err, &viper.ConfigFileNotFoundError{}) {
-			log.Printf("config.yaml file not found")
-			log.Printf("Reading config from environment variables, prefix: APP_")
-			viper.SetEnvPrefix("APP")
-			viper.AutomaticEnv()
-		} else {
-			return c, fmt.Errorf("failed to read config file: %w", err)
+func newPasswordPolicy(c config.Password) (*passwordpolicy.Policy, error) {
+	p := &passwordpolicy.Policy{
+		MinLength:        c.MinLength,
+		MaxBytes:         c.MaxBytes,
+		MinCharClasses:   c.MinCharClasses,
+		DisallowUsername: c.DisallowUsername,
+		HistorySize:      c.HistorySize,
+	}
+	if c.DictionaryFile != "" {
+		words, err := passwordpolicy.LoadDictionary(c.DictionaryFile)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		log.Printf("Reading config from config.yaml")
+		p.Dictionary = words
 	}
-	var missingConfig []string
-	c.userDBURI = viper.GetString("userDb")
-	if c.userDBURI == "" {
-		missingConfig = append(missingConfig, "userDb")
+	if c.BreachedFile != "" {
+		b, err := passwordpolicy.OpenBreached(c.BreachedFile)
+		if err != nil {
+			return nil, err
+		}
+		p.Breached = b
 	}
-	c.serverAddress = viper.GetString("serverAddress")
-	if c.serverAddress == "" {
-		missingConfig = append(missingConfig, "serverAddress")
+	return p, nil
+}
+
+func newHasher(c config.Hashing) passwordhash.Hasher {
+	return passwordhash.Hasher{
+		Algorithm:  c.Algorithm,
+		BcryptCost: c.BcryptCost,
+		Argon2: passwordhash.Argon2Params{
+			Memory:      c.Argon2Memory,
+			Iterations:  c.Argon2Iterations,
+			Parallelism: c.Argon2Parallelism,
+			SaltLength:  16,
+			KeyLength:   32,
+		},
 	}
-	c.rawAccessTokenSecret = viper.GetString("accessTokenSecret")
-	if c.rawAccessTokenSecret == "" {
-		missingConfig = append(missingConfig, "accessTokenSecret")
+}
+
+func newHashPool(c config.Hashing) *passwordhash.Pool {
+	workers := c.Workers
+	if workers == 0 {
+		workers = runtime.NumCPU() / 2
+		if workers < 1 {
+			workers = 1
+		}
 	}
-	if len(missingConfig) > 0 {
-		return c, fmt.Errorf("missing config: %v", missingConfig)
+	return passwordhash.NewPool(newHasher(c), workers, c.QueueSize, c.QueueTimeout)
+}
+
+func disconnectUserDB(conn *mongo.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := conn.Disconnect(ctx); err != nil {
+		log.Printf("Error disconnecting from UserDB: %v", err)
 	}
-	return c, nil
 }
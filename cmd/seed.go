@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/config"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordhash"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/seed"
+	"log"
+)
+
+func reconcileCmd(args []string) int {
+	fs := newFlagSet("reconcile")
+	file := fs.String("file", "", "users seed file, YAML or JSON (default seed.file)")
+	dryRun := fs.Bool("dry-run", false, "only print the changes")
+	c, code, ok := loadConfig(fs, config.NewLoader(fs), args)
+	if !ok {
+		return code
+	}
+	if *file == "" {
+		*file = c.Seed.File
+	}
+	if *file == "" {
+		log.Printf("--file or seed.file is required")
+		return 2
+	}
+
+	return withUserDB(c, func(ctx context.Context, db database.UserDatabase) error {
+		return reconcile(ctx, db, *file, newHasher(c.Password.Hashing), *dryRun)
+	})
+}
+
+// reconcile plans and applies the seed file holding database.LockSeed, as every replica reconciles
+// when it starts, the replicas which wait for it find UserDB reconciled.
+func reconcile(ctx context.Context, db database.UserDatabase, file string, hasher passwordhash.Hasher, dryRun bool) error {
+	f, err := seed.Load(file)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return applySeed(ctx, db, f, file, hasher, true)
+	}
+	return db.WithLock(ctx, database.LockSeed, func() error {
+		return applySeed(ctx, db, f, file, hasher, false)
+	})
+}
+
+func applySeed(ctx context.Context, db database.UserDatabase, f seed.File, file string, hasher passwordhash.Hasher, dryRun bool) error {
+	actions, err := seed.Plan(ctx, db, f, hasher)
+	if err != nil {
+		return err
+	}
+	if len(actions) == 0 {
+		log.Printf("Reconcile: UserDB matches %s", file)
+		return nil
+	}
+	for _, a := range actions {
+		fmt.Println(a)
+	}
+	if dryRun {
+		log.Printf("Reconcile: dry run, %d change(s) not applied", len(actions))
+		return nil
+	}
+	if err := seed.Apply(ctx, db, actions); err != nil {
+		return err
+	}
+	log.Printf("Reconcile: applied %d change(s) from %s", len(actions), file)
+	return nil
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/config"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/filewatch"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/logging"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/mail"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/notify"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordhash"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/ratelimit"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/server"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/tlsconfig"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/webauthn"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/worker"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func serveCmd(args []string) int {
+	appContext := context.Background()
+
+	fs := newFlagSet("serve")
+	loader := config.NewLoader(fs)
+	c, code, ok := loadConfig(fs, loader, args)
+	if !ok {
+		return code
+	}
+
+	settings, err := newSettings(c)
+	if err != nil {
+		log.Printf("Error creating server settings: %v", err)
+		return 1
+	}
+
+	var tlsConfig *tls.Config
+	var certReloader *tlsconfig.CertReloader
+	if c.Server.TLS.Enabled() {
+		tlsConfig, certReloader, err = tlsconfig.New(c.Server.TLS.Options())
+		if err != nil {
+			log.Printf("Error creating TLS config: %v", err)
+			return 1
+		}
+	}
+
+	profileAttributesSchema, err := newProfileAttributesSchema(c.Profile)
+	if err != nil {
+		log.Printf("Error loading profile attributes schema: %v", err)
+		return 1
+	}
+	usernamePolicy, err := newUsernamePolicy(c.Username)
+	if err != nil {
+		log.Printf("Error loading username policy: %v", err)
+		return 1
+	}
+	passwordPolicy, err := newPasswordPolicy(c.Password)
+	if err != nil {
+		log.Printf("Error loading password policy: %v", err)
+		return 1
+	}
+	passwords := newHashPool(c.Password.Hashing)
+	if err := benchmarkHasher(passwords.Hasher); err != nil {
+		log.Printf("Error benchmarking password hashing: %v", err)
+		return 1
+	}
+
+	userDBConn, userDB, err := connectUserDB(appContext, c)
+	if err != nil {
+		log.Printf("Error connecting to UserDB, err: %v", err)
+		return 1
+	}
+	if applied, err := userDB.Migrate(appContext); err != nil {
+		log.Printf("Error migrating UserDB, err: %v", err)
+		disconnectUserDB(userDBConn)
+		return 1
+	} else if len(applied) > 0 {
+		log.Printf("Applied UserDB migrations: %v", applied)
+	}
+	if c.Seed.File != "" {
+		if err := reconcile(appContext, userDB, c.Seed.File, passwords.Hasher, false); err != nil {
+			log.Printf("Error reconciling UserDB with seed file, err: %v", err)
+			disconnectUserDB(userDBConn)
+			return 1
+		}
+	}
+
+	trustedProxies, err := parseTrustedProxies(c.Server.TrustedProxies)
+	if err != nil {
+		log.Printf("Error parsing trusted proxies: %v", err)
+		disconnectUserDB(userDBConn)
+		return 1
+	}
+	rateLimitStore := ratelimit.NewMemoryStore()
+
+	mailer := newMailer(c.Mail)
+	// Password resets are issued in the background, Shutdown waits for the queued ones
+	background := worker.NewQueue(4, 100, 30*time.Second)
+	srv := server.Server{
+		UserDB:                  userDB,
+		Settings:                server.NewLiveSettings(settings),
+		Health:                  server.NewHealth(),
+		ClientCertIdentities:    c.Server.TLS.ClientCertIdentities,
+		ProfileAttributesSchema: profileAttributesSchema,
+		Mailer:                  mailer,
+		Auth: server.AuthOptions{
+			AccessTokenTTL:    c.Auth.AccessTokenTTL,
+			LoginWithEmail:    c.Auth.LoginWithEmail,
+			PasswordMaxAge:    c.Password.MaxAge,
+			ImpersonationTTL:  c.Auth.ImpersonationTTL,
+			AllowSelfDeletion: c.Auth.AllowSelfDeletion,
+			AllowSelfDemotion: c.Auth.AllowSelfDemotion,
+			Lockout: server.LockoutOptions{
+				Username:  server.LockoutLimits(c.Auth.Lockout.Username),
+				IP:        server.LockoutLimits(c.Auth.Lockout.IP),
+				BaseDelay: c.Auth.Lockout.BaseDelay,
+				MaxDelay:  c.Auth.Lockout.MaxDelay,
+				Duration:  c.Auth.Lockout.Duration,
+				Window:    c.Auth.Lockout.Window,
+			},
+		},
+		MFA: server.MFAOptions{
+			Issuer:           c.MFA.Issuer,
+			RequireForAdmins: c.MFA.RequireForAdmins,
+			ChallengeTTL:     c.MFA.ChallengeTTL,
+			RecoveryCodes:    c.MFA.RecoveryCodes,
+		},
+		WebAuthn: server.WebAuthnOptions{
+			RelyingParty:   newRelyingParty(c.WebAuthn),
+			MaxCredentials: c.WebAuthn.MaxCredentials,
+		},
+		Email: server.EmailOptions{
+			VerificationTTL: c.Email.VerificationTTL,
+			VerificationURL: c.Email.VerificationURL,
+			ResendCooldown:  c.Email.ResendCooldown,
+		},
+		Notifier: newNotifier(c.PasswordReset, mailer),
+		PasswordReset: server.PasswordResetOptions{
+			TokenTTL: c.PasswordReset.TokenTTL,
+			URL:      c.PasswordReset.URL,
+			Cooldown: c.PasswordReset.Cooldown,
+		},
+		Background:     background,
+		UsernamePolicy: usernamePolicy,
+		PasswordPolicy: passwordPolicy,
+		Passwords:      passwords,
+		TrustedProxies: trustedProxies,
+		RateLimitStore: rateLimitStore,
+	}
+
+	httpSrv := &http.Server{
+		Addr:           c.Server.Address,
+		Handler:        srv.Handler(),
+		WriteTimeout:   c.Server.WriteTimeout,
+		ReadTimeout:    c.Server.ReadTimeout,
+		IdleTimeout:    c.Server.IdleTimeout,
+		MaxHeaderBytes: c.Server.MaxHeaderBytes,
+		TLSConfig:      tlsConfig,
+	}
+
+	workers := &worker.Group{}
+	workers.Go(appContext, "Background tasks", background.Run)
+	workers.Go(appContext, "UserDB health check", func(ctx context.Context) {
+		srv.WatchUserDB(ctx, 10*time.Second)
+	})
+	workers.Go(appContext, "Rate limit sweeper", func(ctx context.Context) {
+		rateLimitStore.SweepEvery(ctx, time.Minute)
+	})
+	reloader := config.NewReloader(loader, c, func(c config.Config) error {
+		settings, err := newSettings(c)
+		if err != nil {
+			return err
+		}
+		logLevel, _ := logging.ParseLevel(c.Log.Level)
+		srv.Settings.Store(settings)
+		logging.SetLevel(logLevel)
+		return nil
+	})
+	workers.Go(appContext, "SIGHUP config reloader", func(ctx context.Context) {
+		reloadOnSIGHUP(ctx, reloader)
+	})
+	if f := loader.ConfigFileUsed(); f != "" {
+		workers.Go(appContext, "Config file watcher", func(ctx context.Context) {
+			err := filewatch.Watch(ctx, []string{f}, time.Second, func() {
+				log.Printf("Config file changed, reloading config")
+				if err := reloader.Reload(); err != nil {
+					log.Printf("%v", err)
+				}
+			})
+			if err != nil {
+				log.Printf("Config file watcher error, reload with SIGHUP instead: %v", err)
+			}
+		})
+	}
+	if certReloader != nil {
+		workers.Go(appContext, "Certificate reloader", func(ctx context.Context) {
+			if err := certReloader.Watch(ctx); err != nil {
+				log.Printf("Certificate reloader error, certificate will not be reloaded: %v", err)
+			}
+		})
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		var err error
+		if c.Server.TLS.Enabled() {
+			log.Printf("Serving TLS on %s, client auth: %s", httpSrv.Addr, c.Server.TLS.ClientAuth)
+			err = httpSrv.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Serving on %s", httpSrv.Addr)
+			err = httpSrv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Listen and serve error: %v", err)
+			errChan <- err
+		}
+	}()
+	srv.Health.SetReady(true)
+
+	// Handle graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, os.Interrupt)
+
+	exitCode := 0
+	select {
+	case sig := <-sigChan:
+		log.Printf("Received signal: %v, shutting down", sig)
+	case <-errChan:
+		exitCode = 1
+	}
+	signal.Stop(sigChan)
+
+	if err := shutdown(c.Server, srv, httpSrv, workers, userDBConn); err != nil {
+		log.Printf("Shutdown error: %v", err)
+		exitCode = 1
+	}
+	log.Printf("Server shutdown")
+	return exitCode
+}
+
+func newSettings(c config.Config) (server.Settings, error) {
+	st := server.Settings{
+		CORSAllowedOrigins: c.Server.CORS.AllowedOrigins,
+		RateLimits: server.RateLimits{
+			Public:   ratelimit.Limit(c.RateLimit.Public),
+			API:      ratelimit.Limit(c.RateLimit.API),
+			AdminAPI: ratelimit.Limit(c.RateLimit.AdminAPI),
+			APIPerIP: ratelimit.Limit(c.RateLimit.APIPerIP),
+		},
+	}
+	for _, secret := range append([]string{c.Auth.AccessTokenSecret}, c.Auth.PreviousAccessTokenSecrets...) {
+		k, err := jwk.FromRaw([]byte(secret))
+		if err != nil {
+			return st, fmt.Errorf("failed to create access token key: %w", err)
+		}
+		st.AccessTokenKeys = append(st.AccessTokenKeys, k)
+	}
+	return st, nil
+}
+
+func newMailer(c config.Mail) mail.Mailer {
+	switch c.Driver {
+	case config.MailDriverSMTP:
+		return mail.SMTPMailer{
+			Host:        c.SMTP.Host,
+			Port:        c.SMTP.Port,
+			Username:    c.SMTP.Username,
+			Password:    c.SMTP.Password,
+			From:        c.From,
+			ImplicitTLS: c.SMTP.ImplicitTLS,
+		}
+	case config.MailDriverFile:
+		return mail.OutboxMailer{Dir: c.OutboxDir, From: c.From}
+	default:
+		return mail.LogMailer{}
+	}
+}
+
+// benchmarkHasher logs how long hashing a password takes, so that costs can be tuned
+// for the hardware, with a warning when it is far from the usual 50ms to 1s.
+func benchmarkHasher(h passwordhash.Hasher) error {
+	d, err := h.Benchmark()
+	if err != nil {
+		return err
+	}
+	switch {
+	case d < 50*time.Millisecond:
+		logging.Warnf("Password hashing with %s takes %v, consider raising its cost", h.Algorithm, d)
+	case d > time.Second:
+		logging.Warnf("Password hashing with %s takes %v, logins will be slow, consider lowering its cost", h.Algorithm, d)
+	default:
+		log.Printf("Password hashing with %s takes %v", h.Algorithm, d)
+	}
+	return nil
+}
+
+func newRelyingParty(c config.WebAuthn) *webauthn.RelyingParty {
+	if c.RPID == "" {
+		return nil
+	}
+	return &webauthn.RelyingParty{
+		ID:               c.RPID,
+		Name:             c.RPName,
+		Origins:          c.Origins,
+		UserVerification: c.UserVerification,
+		Timeout:          c.ChallengeTTL,
+	}
+}
+
+// parseTrustedProxies parses IPs and CIDRs, an IP is a network of only itself.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if ip := net.ParseIP(p); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s: %w", p, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func newNotifier(c config.PasswordReset, mailer mail.Mailer) notify.Notifier {
+	if c.Notifier == config.NotifierWebhook {
+		return notify.WebhookNotifier{URL: c.WebhookURL, Client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	return notify.MailNotifier{Mailer: mailer}
+}
+
+// reloadOnSIGHUP reloads the config on SIGHUP until ctx is done.
+func reloadOnSIGHUP(ctx context.Context, reloader *config.Reloader) {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hupChan:
+			log.Printf("Received SIGHUP, reloading config")
+			if err := reloader.Reload(); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+}
+
+// shutdown flips readiness off and waits ShutdownDelay so load balancers stop routing new requests,
+// then drains in-flight requests within ShutdownTimeout before stopping workers and disconnecting UserDB.
+func shutdown(c config.Server, srv server.Server, httpSrv *http.Server, workers *worker.Group, userDBConn *mongo.Client) error {
+	var errs []error
+
+	srv.Health.SetReady(false)
+	if c.ShutdownDelay > 0 {
+		log.Printf("Readiness set to not ready, waiting %v before draining", c.ShutdownDelay)
+		time.Sleep(c.ShutdownDelay)
+	}
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+	log.Printf("Draining %d in-flight request(s), timeout: %v", srv.Health.InFlight(), c.ShutdownTimeout)
+	if err := httpSrv.Shutdown(drainCtx); err != nil {
+		log.Printf("Drain did not finish, %d request(s) still in flight, err: %v", srv.Health.InFlight(), err)
+		if err := httpSrv.Close(); err != nil {
+			log.Printf("Server close error: %v", err)
+		}
+		errs = append(errs, fmt.Errorf("failed to drain requests: %w", err))
+	}
+
+	workersCtx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+	if err := workers.Stop(workersCtx); err != nil {
+		errs = append(errs, err)
+	}
+
+	disconnectCtx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+	if err := userDBConn.Disconnect(disconnectCtx); err != nil {
+		errs = append(errs, fmt.Errorf("error disconnecting from UserDB: %w", err))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d shutdown step(s) failed: %v", len(errs), errs)
+	}
+	return nil
+}
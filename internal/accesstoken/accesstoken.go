@@ -0,0 +1,105 @@
+package accesstoken
+
+import (
+	"fmt"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"time"
+)
+
+const Type = "access-token"
+
+// TypeMFAChallenge is the type of the tokens exchanged for an access token with a second factor,
+// authMw doesn't accept them.
+const TypeMFAChallenge = "mfa-challenge"
+
+const (
+	// ScopePasswordChange restricts a token to changing the password of its subject.
+	ScopePasswordChange = "password-change"
+	// ScopeMFAEnrollment restricts a token to enrolling the second factor of its subject.
+	ScopeMFAEnrollment = "mfa-enrollment"
+)
+
+// Authentication methods of the amr claim, as registered by RFC 8176.
+const (
+	AMRPassword = "pwd"
+	AMROTP      = "otp"
+	// AMRHardwareKey is a passkey, with AMRMultiFactor when the authenticator also verified the user
+	AMRHardwareKey = "hwk"
+	AMRMultiFactor = "mfa"
+)
+
+// Claims are the claims of an access token besides iat and exp.
+type Claims struct {
+	Subject string
+	Role    string
+	// Scope restricts the token to the routes of the scope, empty is not restricted
+	Scope string
+	// AMR lists how the subject authenticated, tokens not issued by logging in have none
+	AMR []string
+	// SessionID is the sid of the server-side session, tokens not issued by logging in have none
+	SessionID string
+	// Actor is the subject acting as Subject, set in the act claim of RFC 8693 for impersonation
+	Actor string
+}
+
+// MultiFactor reports if amr has more than one factor, a password with a code or a verified passkey.
+func MultiFactor(amr []string) bool {
+	for _, m := range amr {
+		if m == AMROTP || m == AMRMultiFactor {
+			return true
+		}
+	}
+	return false
+}
+
+// New creates an access token in the form expected by the server's authMw.
+func New(key jwk.Key, sub string, role string, ttl time.Duration) ([]byte, error) {
+	return NewWithClaims(key, Claims{Subject: sub, Role: role}, ttl)
+}
+
+// NewWithClaims is like New with the optional claims of c.
+func NewWithClaims(key jwk.Key, c Claims, ttl time.Duration) ([]byte, error) {
+	b := builder(Type, c.Subject, ttl).Claim("role", c.Role)
+	if c.Scope != "" {
+		b = b.Claim("scope", c.Scope)
+	}
+	if len(c.AMR) > 0 {
+		b = b.Claim("amr", c.AMR)
+	}
+	if c.SessionID != "" {
+		b = b.Claim("sid", c.SessionID)
+	}
+	if c.Actor != "" {
+		b = b.Claim("act", map[string]string{"sub": c.Actor})
+	}
+	return sign(key, b)
+}
+
+// NewMFAChallenge creates the token proving that sub has logged in with a password,
+// which the second factor is then verified with.
+func NewMFAChallenge(key jwk.Key, sub string, ttl time.Duration) ([]byte, error) {
+	return sign(key, builder(TypeMFAChallenge, sub, ttl).Claim("amr", []string{AMRPassword}))
+}
+
+func builder(tokenType string, sub string, ttl time.Duration) *jwt.Builder {
+	now := time.Now()
+	return jwt.NewBuilder().
+		Subject(sub).
+		IssuedAt(now).
+		Expiration(now.Add(ttl)).
+		Claim("type", tokenType)
+}
+
+func sign(key jwk.Key, b *jwt.Builder) ([]byte, error) {
+	t, err := b.Build()
+	if err != nil {
+		return nil, fmt.Errorf("error building access token: %w", err)
+	}
+	signed, err := jwt.Sign(t, jwt.WithKey(jwa.HS256, key))
+	if err != nil {
+		return nil, fmt.Errorf("error signing access token: %w", err)
+	}
+	return signed, nil
+}
@@ -0,0 +1,161 @@
+package bulk
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"io"
+	"strings"
+)
+
+type Format string
+
+const (
+	FormatCSV  Format = "csv"
+	FormatJSON Format = "json"
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case FormatCSV, FormatJSON:
+		return Format(s), nil
+	default:
+		return "", fmt.Errorf("invalid format: %s, should be %s or %s", s, FormatCSV, FormatJSON)
+	}
+}
+
+func (f Format) ContentType() string {
+	if f == FormatCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/json; charset=utf-8"
+}
+
+// Row is a User as imported and exported, only one of Password or PasswordHash should be set.
+// PasswordHash may be in one of the legacy formats of passwordhash, for users from other systems.
+// In CSV the Profile is a column of its JSON object.
+type Row struct {
+	Username     string            `json:"username"`
+	Password     string            `json:"password,omitempty"`
+	PasswordHash string            `json:"passwordHash,omitempty"`
+	Role         string            `json:"role"`
+	Info         string            `json:"info"`
+	Profile      *database.Profile `json:"profile,omitempty"`
+}
+
+var csvHeader = []string{"username", "password", "passwordHash", "role", "info", "profile"}
+
+// ExportRows converts us to rows, password hashes are only included when asked for
+// since they are needed for a round trip but are sensitive.
+func ExportRows(us []database.User, includePasswordHashes bool) []Row {
+	rows := make([]Row, len(us))
+	for i, u := range us {
+		rows[i] = Row{Username: u.Username, Role: u.Role, Info: u.Info}
+		if !u.Profile.IsZero() {
+			p := u.Profile
+			rows[i].Profile = &p
+		}
+		if includePasswordHashes {
+			rows[i].PasswordHash = string(u.Password)
+		}
+	}
+	return rows
+}
+
+func Encode(w io.Writer, f Format, rows []Row) error {
+	if f == FormatJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		var profile []byte
+		if r.Profile != nil {
+			var err error
+			if profile, err = json.Marshal(r.Profile); err != nil {
+				return err
+			}
+		}
+		if err := cw.Write([]string{r.Username, r.Password, r.PasswordHash, r.Role, r.Info, string(profile)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Decode reads rows, CSV input must start with a header row, its columns may be in any order.
+func Decode(r io.Reader, f Format) ([]Row, error) {
+	if f == FormatJSON {
+		var rows []Row
+		dec := json.NewDecoder(r)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&rows); err != nil {
+			return nil, fmt.Errorf("error decoding JSON: %w", err)
+		}
+		return rows, nil
+	}
+
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("missing CSV header")
+		}
+		return nil, fmt.Errorf("error reading CSV header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, h := range header {
+		known := false
+		for _, k := range csvHeader {
+			known = known || h == k
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown CSV column: %s, columns should be from %v", h, csvHeader)
+		}
+		columns[h] = i
+	}
+	if _, ok := columns["username"]; !ok {
+		return nil, errors.New("missing CSV column: username")
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok {
+			return record[i]
+		}
+		return ""
+	}
+
+	var rows []Row
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV: %w", err)
+		}
+		row := Row{
+			Username:     field(record, "username"),
+			Password:     field(record, "password"),
+			PasswordHash: field(record, "passwordHash"),
+			Role:         field(record, "role"),
+			Info:         field(record, "info"),
+		}
+		if profile := field(record, "profile"); profile != "" {
+			row.Profile = &database.Profile{}
+			dec := json.NewDecoder(strings.NewReader(profile))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(row.Profile); err != nil {
+				line, _ := cr.FieldPos(0)
+				return nil, fmt.Errorf("error decoding profile on line %d: %w", line, err)
+			}
+		}
+		rows = append(rows, row)
+	}
+}
@@ -0,0 +1,74 @@
+package bulk
+
+import (
+	"bytes"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"reflect"
+	"testing"
+)
+
+func TestExportRoundTrip(t *testing.T) {
+	us := []database.User{
+		{Username: "alice", Password: []byte("$2a$04$hash"), Role: "admin", Info: "a, \"quoted\" info"},
+		{Username: "bob", Role: "user", Profile: database.Profile{
+			DisplayName: "Bob", Email: "bob@example.com", Attributes: map[string]any{"team": "blue"},
+		}},
+	}
+	for _, f := range []Format{FormatCSV, FormatJSON} {
+		t.Run(string(f), func(t *testing.T) {
+			rows := ExportRows(us, true)
+			var b bytes.Buffer
+			if err := Encode(&b, f, rows); err != nil {
+				t.Fatalf("Encode() error: %v", err)
+			}
+			got, err := Decode(&b, f)
+			if err != nil {
+				t.Fatalf("Decode() error: %v", err)
+			}
+			if !reflect.DeepEqual(got, rows) {
+				t.Errorf("Decode() = %+v, want %+v", got, rows)
+			}
+			if got[0].Profile != nil || got[1].Profile == nil || got[1].Profile.Email != "bob@example.com" {
+				t.Errorf("profiles = %+v, %+v, want only the one of bob", got[0].Profile, got[1].Profile)
+			}
+		})
+	}
+}
+
+func TestExportRowsWithoutPasswordHashes(t *testing.T) {
+	rows := ExportRows([]database.User{{Username: "alice", Password: []byte("$2a$04$hash")}}, false)
+	if rows[0].PasswordHash != "" {
+		t.Errorf("PasswordHash = %q, want none", rows[0].PasswordHash)
+	}
+}
+
+func TestDecodeCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		want    []Row
+		wantErr bool
+	}{
+		{
+			name: "columns in any order",
+			csv:  "role,username,password\nuser,alice,secret\n",
+			want: []Row{{Username: "alice", Password: "secret", Role: "user"}},
+		},
+		{name: "missing header", csv: "", wantErr: true},
+		{name: "unknown column", csv: "username,email\nalice,a@example.com\n", wantErr: true},
+		{name: "missing username", csv: "role\nuser\n", wantErr: true},
+		{name: "invalid profile", csv: "username,profile\nalice,{\"email\":1}\n", wantErr: true},
+		{name: "unknown profile field", csv: "username,profile\nalice,\"{\"\"nickname\"\":\"\"al\"\"}\"\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(bytes.NewBufferString(tt.csv), FormatCSV)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decode() error = %v, want error: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decode() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
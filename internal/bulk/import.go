@@ -0,0 +1,208 @@
+package bulk
+
+import (
+	"context"
+	"errors"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/jsonschema"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordhash"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordpolicy"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/usernames"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/validation"
+	"golang.org/x/sync/errgroup"
+)
+
+const BatchSize = 500
+
+type Status string
+
+const (
+	StatusCreated     Status = "created"
+	StatusWouldCreate Status = "would-create"
+	StatusDuplicate   Status = "duplicate"
+	StatusInvalid     Status = "invalid"
+	StatusFailed      Status = "failed"
+)
+
+type Result struct {
+	// Row is 1-based, not counting the CSV header
+	Row      int    `json:"row"`
+	Username string `json:"username"`
+	Status   Status `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+type Report struct {
+	DryRun  bool           `json:"dryRun"`
+	Counts  map[Status]int `json:"counts"`
+	Results []Result       `json:"results"`
+}
+
+// Import validates every row with the same rules as creating a single User and inserts
+// the valid ones in batches, with dryRun nothing is inserted. Usernames and profiles are normalized
+// in place, usernames are checked against usernamePolicy and profile attributes against profileSchema. Plain passwords are checked against policy and hashed with
+// passwords concurrently, password hashes can't be checked. When passwords is full or ctx is done the import
+// stops with the error, rows before it may have been inserted.
+func Import(ctx context.Context, db database.UserDatabase, rows []Row, usernamePolicy usernames.Policy, profileSchema *jsonschema.Schema, policy *passwordpolicy.Policy, passwords *passwordhash.Pool, dryRun bool) (Report, error) {
+	report := Report{DryRun: dryRun, Counts: make(map[Status]int), Results: make([]Result, len(rows))}
+
+	var pending []int
+	seen := make(map[string]bool)
+	for i, r := range rows {
+		report.Results[i] = Result{Row: i + 1, Username: r.Username}
+		err := validateRow(r)
+		if err == nil && r.Profile != nil {
+			*r.Profile = validation.NormalizeProfile(*r.Profile)
+			err = validation.Profile(*r.Profile, profileSchema)
+		}
+		if err == nil {
+			r.Username, err = usernamePolicy.Normalize(r.Username)
+			rows[i].Username = r.Username
+		}
+		if err == nil && r.Password != "" {
+			err = policy.Check(r.Password, r.Username)
+			var pe *passwordpolicy.Error
+			if err != nil && !errors.As(err, &pe) {
+				return report, err
+			}
+		}
+		if err != nil {
+			report.Results[i].Status, report.Results[i].Error = StatusInvalid, err.Error()
+			continue
+		}
+		if seen[r.Username] {
+			report.Results[i].Status, report.Results[i].Error = StatusDuplicate, "username is repeated in the input"
+			continue
+		}
+		seen[r.Username] = true
+		pending = append(pending, i)
+	}
+
+	for start := 0; start < len(pending); start += BatchSize {
+		end := start + BatchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		if err := importBatch(ctx, db, rows, pending[start:end], report.Results, passwords, dryRun); err != nil {
+			return report, err
+		}
+	}
+
+	for _, r := range report.Results {
+		report.Counts[r.Status]++
+	}
+	return report, nil
+}
+
+func importBatch(ctx context.Context, db database.UserDatabase, rows []Row, batch []int, results []Result, passwords *passwordhash.Pool, dryRun bool) error {
+	usernames := make([]string, len(batch))
+	for i, ri := range batch {
+		usernames[i] = rows[ri].Username
+	}
+	existing, err := db.FindExistingUsernames(ctx, usernames)
+	if err != nil {
+		return err
+	}
+
+	var creating []int
+	for _, ri := range batch {
+		if existing[rows[ri].Username] {
+			results[ri].Status, results[ri].Error = StatusDuplicate, "username already exists"
+			continue
+		}
+		if dryRun {
+			results[ri].Status = StatusWouldCreate
+			continue
+		}
+		creating = append(creating, ri)
+	}
+	hashes, err := hashPasswords(ctx, rows, creating, passwords)
+	if err != nil {
+		return err
+	}
+
+	var us []database.User
+	var insertRows []int
+	for i, ri := range creating {
+		r := rows[ri]
+		if hashes[i] == nil {
+			results[ri].Status, results[ri].Error = StatusFailed, "error hashing password"
+			continue
+		}
+		u := database.User{Username: r.Username, Password: hashes[i], Role: r.Role, Info: r.Info}
+		if r.Profile != nil {
+			u.Profile = *r.Profile
+		}
+		us = append(us, u)
+		insertRows = append(insertRows, ri)
+	}
+	if len(us) == 0 {
+		return nil
+	}
+
+	errs, err := db.InsertUsers(ctx, us)
+	if err != nil {
+		return err
+	}
+	for i, ri := range insertRows {
+		switch {
+		case errs[i] == nil:
+			results[ri].Status = StatusCreated
+		case errors.Is(errs[i], database.ErrDuplicateUsername):
+			results[ri].Status, results[ri].Error = StatusDuplicate, "username already exists"
+		case errors.Is(errs[i], database.ErrConfusableUsername):
+			results[ri].Status, results[ri].Error = StatusDuplicate, database.ErrConfusableUsername.Error()
+		case errors.Is(errs[i], database.ErrDuplicateEmail):
+			results[ri].Status, results[ri].Error = StatusDuplicate, database.ErrDuplicateEmail.Error()
+		default:
+			results[ri].Status, results[ri].Error = StatusFailed, "error inserting user"
+		}
+	}
+	return nil
+}
+
+// hashPasswords returns the hashes to store for the rows at indexes, the plain passwords are hashed
+// concurrently with as many at a time as passwords has workers, so that a batch takes about as long
+// as hashing BatchSize passwords divided by the workers. A hash which failed is nil, only a full
+// pool or the end of ctx fail them all.
+func hashPasswords(ctx context.Context, rows []Row, indexes []int, passwords *passwordhash.Pool) ([][]byte, error) {
+	hashes := make([][]byte, len(indexes))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(passwords.Stats().Workers)
+	for i, ri := range indexes {
+		if rows[ri].Password == "" {
+			hashes[i] = []byte(rows[ri].PasswordHash)
+			continue
+		}
+		i, password := i, rows[ri].Password
+		g.Go(func() error {
+			hash, err := passwords.Hash(gctx, password)
+			if err != nil {
+				if errors.Is(err, passwordhash.ErrPoolFull) || gctx.Err() != nil {
+					return err
+				}
+				return nil
+			}
+			hashes[i] = hash
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+func validateRow(r Row) error {
+	password := r.Password
+	if r.PasswordHash != "" {
+		if r.Password != "" {
+			return errors.New("only one of password or passwordHash should be set")
+		}
+		if err := validation.PasswordHash(r.PasswordHash); err != nil {
+			return err
+		}
+		password = r.PasswordHash
+	}
+	return validation.NewUser(r.Username, password, r.Role)
+}
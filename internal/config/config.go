@@ -0,0 +1,446 @@
+package config
+
+import (
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/logging"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordhash"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordpolicy"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/tlsconfig"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/webauthn"
+	"golang.org/x/crypto/bcrypt"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Dev           bool          `mapstructure:"dev"`
+	Server        Server        `mapstructure:"server"`
+	Database      Database      `mapstructure:"database"`
+	Auth          Auth          `mapstructure:"auth"`
+	Log           Log           `mapstructure:"log"`
+	Seed          Seed          `mapstructure:"seed"`
+	Profile       Profile       `mapstructure:"profile"`
+	Mail          Mail          `mapstructure:"mail"`
+	Email         Email         `mapstructure:"email"`
+	PasswordReset PasswordReset `mapstructure:"passwordReset"`
+	Username      Username      `mapstructure:"username"`
+	Password      Password      `mapstructure:"password"`
+	MFA           MFA           `mapstructure:"mfa"`
+	WebAuthn      WebAuthn      `mapstructure:"webauthn"`
+	RateLimit     RateLimit     `mapstructure:"rateLimit"`
+}
+
+type Server struct {
+	Address         string        `mapstructure:"address"`
+	ReadTimeout     time.Duration `mapstructure:"readTimeout"`
+	WriteTimeout    time.Duration `mapstructure:"writeTimeout"`
+	IdleTimeout     time.Duration `mapstructure:"idleTimeout"`
+	MaxHeaderBytes  int           `mapstructure:"maxHeaderBytes"`
+	ShutdownDelay   time.Duration `mapstructure:"shutdownDelay"`
+	ShutdownTimeout time.Duration `mapstructure:"shutdownTimeout"`
+	TLS             TLS           `mapstructure:"tls"`
+	CORS            CORS          `mapstructure:"cors"`
+	// TrustedProxies are the IPs or CIDRs of the proxies whose X-Forwarded-For is used for the client IP
+	TrustedProxies []string `mapstructure:"trustedProxies"`
+}
+
+type TLS struct {
+	CertFile             string   `mapstructure:"certFile"`
+	KeyFile              string   `mapstructure:"keyFile"`
+	MinVersion           string   `mapstructure:"minVersion"`
+	CipherSuites         []string `mapstructure:"cipherSuites"`
+	ClientAuth           string   `mapstructure:"clientAuth"`
+	ClientCAFile         string   `mapstructure:"clientCAFile"`
+	ClientCertIdentities []string `mapstructure:"clientCertIdentities"`
+}
+
+type CORS struct {
+	AllowedOrigins []string `mapstructure:"allowedOrigins"`
+}
+
+type Database struct {
+	URI            string        `mapstructure:"uri"`
+	Name           string        `mapstructure:"name"`
+	ConnectTimeout time.Duration `mapstructure:"connectTimeout"`
+}
+
+type Auth struct {
+	AccessTokenSecret string        `mapstructure:"accessTokenSecret"`
+	AccessTokenTTL    time.Duration `mapstructure:"accessTokenTTL"`
+	// LoginWithEmail allows logging in with a verified email in place of the username
+	LoginWithEmail bool `mapstructure:"loginWithEmail"`
+	// Secrets still accepted for verifying access tokens while rotating accessTokenSecret
+	PreviousAccessTokenSecrets []string `mapstructure:"previousAccessTokenSecrets"`
+	Lockout                    Lockout  `mapstructure:"lockout"`
+	// ImpersonationTTL is the time to live of the tokens admins act as another user with
+	ImpersonationTTL time.Duration `mapstructure:"impersonationTTL"`
+	// AllowSelfDeletion and AllowSelfDemotion let admins delete or demote themselves,
+	// the last admin can't either way
+	AllowSelfDeletion bool `mapstructure:"allowSelfDeletion"`
+	AllowSelfDemotion bool `mapstructure:"allowSelfDemotion"`
+}
+
+// Lockout throttles failed password logins, for a username and for a client IP apart.
+// After the free attempts every failure doubles the delay before the next attempt,
+// from BaseDelay up to MaxDelay, and reaching the threshold locks for Duration.
+type Lockout struct {
+	Username  LockoutLimits `mapstructure:"username"`
+	IP        LockoutLimits `mapstructure:"ip"`
+	BaseDelay time.Duration `mapstructure:"baseDelay"`
+	MaxDelay  time.Duration `mapstructure:"maxDelay"`
+	Duration  time.Duration `mapstructure:"duration"`
+	// Window is how long failures are counted after the last one
+	Window time.Duration `mapstructure:"window"`
+}
+
+type LockoutLimits struct {
+	FreeAttempts int `mapstructure:"freeAttempts"`
+	// Threshold is how many failures lock, 0 only delays
+	Threshold int `mapstructure:"threshold"`
+}
+
+type Log struct {
+	Level string `mapstructure:"level"`
+}
+
+type Seed struct {
+	// File is reconciled against UserDB on startup when set
+	File string `mapstructure:"file"`
+}
+
+type Profile struct {
+	// AttributesSchemaFile is a JSON Schema for profile attributes, any attributes are accepted when empty
+	AttributesSchemaFile string `mapstructure:"attributesSchemaFile"`
+}
+
+type Mail struct {
+	Driver    string `mapstructure:"driver"`
+	From      string `mapstructure:"from"`
+	OutboxDir string `mapstructure:"outboxDir"`
+	SMTP      SMTP   `mapstructure:"smtp"`
+}
+
+const (
+	MailDriverLog  = "log"
+	MailDriverFile = "file"
+	MailDriverSMTP = "smtp"
+)
+
+type SMTP struct {
+	Host        string `mapstructure:"host"`
+	Port        int    `mapstructure:"port"`
+	Username    string `mapstructure:"username"`
+	Password    string `mapstructure:"password"`
+	ImplicitTLS bool   `mapstructure:"implicitTLS"`
+}
+
+type Email struct {
+	VerificationTTL time.Duration `mapstructure:"verificationTTL"`
+	// VerificationURL is the link sent for verifying an email, {token} is replaced with the token
+	VerificationURL string        `mapstructure:"verificationURL"`
+	ResendCooldown  time.Duration `mapstructure:"resendCooldown"`
+}
+
+type PasswordReset struct {
+	TokenTTL time.Duration `mapstructure:"tokenTTL"`
+	// URL is the link sent for resetting a password, {token} is replaced with the token
+	URL      string        `mapstructure:"url"`
+	Cooldown time.Duration `mapstructure:"cooldown"`
+	// Notifier delivers reset tokens, mail sends them to the verified email of the user
+	Notifier   string `mapstructure:"notifier"`
+	WebhookURL string `mapstructure:"webhookURL"`
+}
+
+type MFA struct {
+	// Issuer names the service in authenticator apps
+	Issuer string `mapstructure:"issuer"`
+	// RequireForAdmins makes admins enroll on login and use the second factor for sensitive routes
+	RequireForAdmins bool          `mapstructure:"requireForAdmins"`
+	ChallengeTTL     time.Duration `mapstructure:"challengeTTL"`
+	RecoveryCodes    int           `mapstructure:"recoveryCodes"`
+}
+
+// WebAuthn configures passkeys, which are disabled when RPID is empty.
+type WebAuthn struct {
+	// RPID is the domain passkeys are scoped to, it must be the host of the origins or a parent of it
+	RPID             string        `mapstructure:"rpID"`
+	RPName           string        `mapstructure:"rpName"`
+	Origins          []string      `mapstructure:"origins"`
+	UserVerification string        `mapstructure:"userVerification"`
+	ChallengeTTL     time.Duration `mapstructure:"challengeTTL"`
+	MaxCredentials   int           `mapstructure:"maxCredentials"`
+}
+
+// RateLimit limits the requests of every user, or client IP before logging in, for each route group.
+// Routes of adminAPI only count against the adminAPI limit. APIPerIP limits the requests to the routes
+// of api and adminAPI of every client IP before the access token is checked, so that requests with
+// invalid tokens are limited too, it has to allow for the users behind one NAT.
+type RateLimit struct {
+	Public   RateLimitGroup `mapstructure:"public"`
+	API      RateLimitGroup `mapstructure:"api"`
+	AdminAPI RateLimitGroup `mapstructure:"adminAPI"`
+	APIPerIP RateLimitGroup `mapstructure:"apiPerIP"`
+}
+
+type RateLimitGroup struct {
+	// Requests is how many requests are allowed per Period, 0 disables the limit
+	Requests int           `mapstructure:"requests"`
+	Period   time.Duration `mapstructure:"period"`
+}
+
+// Username restricts the usernames of new users, in their normalized form.
+type Username struct {
+	MinLength int `mapstructure:"minLength"`
+	MaxLength int `mapstructure:"maxLength"`
+	// AllowedPattern is a regular expression the normalized usernames have to match
+	AllowedPattern string `mapstructure:"allowedPattern"`
+}
+
+type Password struct {
+	MinLength        int  `mapstructure:"minLength"`
+	MaxBytes         int  `mapstructure:"maxBytes"`
+	MinCharClasses   int  `mapstructure:"minCharClasses"`
+	DisallowUsername bool `mapstructure:"disallowUsername"`
+	// DictionaryFile lists words, one per line, which may not be used as passwords
+	DictionaryFile string `mapstructure:"dictionaryFile"`
+	// BreachedFile is the Pwned Passwords SHA-1 file ordered by hash, or a directory of its range files
+	BreachedFile string `mapstructure:"breachedFile"`
+	// HistorySize is how many previous passwords may not be reused, 0 disables the check
+	HistorySize int `mapstructure:"historySize"`
+	// MaxAge makes users change passwords older than it on login, 0 disables it
+	MaxAge  time.Duration `mapstructure:"maxAge"`
+	Hashing Hashing       `mapstructure:"hashing"`
+}
+
+// Hashing configures how new password hashes are created, stored hashes with
+// another algorithm or lower costs are rehashed on login.
+type Hashing struct {
+	Algorithm  string `mapstructure:"algorithm"`
+	BcryptCost int    `mapstructure:"bcryptCost"`
+	// Argon2Memory is in KiB
+	Argon2Memory      uint32 `mapstructure:"argon2Memory"`
+	Argon2Iterations  uint32 `mapstructure:"argon2Iterations"`
+	Argon2Parallelism uint8  `mapstructure:"argon2Parallelism"`
+	// Workers is how many hashes are computed at a time, 0 is half the CPUs
+	Workers      int           `mapstructure:"workers"`
+	QueueSize    int           `mapstructure:"queueSize"`
+	QueueTimeout time.Duration `mapstructure:"queueTimeout"`
+}
+
+const (
+	NotifierMail    = "mail"
+	NotifierWebhook = "webhook"
+)
+
+func (t TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+func (t TLS) Options() tlsconfig.Options {
+	return tlsconfig.Options{
+		CertFile:     t.CertFile,
+		KeyFile:      t.KeyFile,
+		MinVersion:   t.MinVersion,
+		CipherSuites: t.CipherSuites,
+		ClientCAFile: t.ClientCAFile,
+		ClientAuth:   t.ClientAuth,
+	}
+}
+
+const (
+	minAccessTokenSecretLength = 32
+	maxUsernameLength          = 256
+)
+
+// Validate returns every invalid value at once so that startup fails with the full list.
+func (c Config) Validate() error {
+	var invalid []string
+	check := func(ok bool, format string, a ...any) {
+		if !ok {
+			invalid = append(invalid, fmt.Sprintf(format, a...))
+		}
+	}
+
+	check(c.Server.Address != "", "server.address must not be empty")
+	check(c.Server.ReadTimeout > 0, "server.readTimeout must be positive")
+	check(c.Server.WriteTimeout > 0, "server.writeTimeout must be positive")
+	check(c.Server.IdleTimeout > 0, "server.idleTimeout must be positive")
+	check(c.Server.MaxHeaderBytes >= 512, "server.maxHeaderBytes must be at least 512")
+	check(c.Server.ShutdownDelay >= 0, "server.shutdownDelay must not be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdownTimeout must be positive")
+
+	tls := c.Server.TLS
+	check((tls.CertFile == "") == (tls.KeyFile == ""), "server.tls.certFile and server.tls.keyFile must be set together")
+	_, err := tlsconfig.ParseVersion(tls.MinVersion)
+	check(err == nil, "server.tls.minVersion: %v", err)
+	_, err = tlsconfig.ParseCipherSuites(tls.CipherSuites)
+	check(err == nil, "server.tls.cipherSuites: %v", err)
+	switch tls.ClientAuth {
+	case tlsconfig.ClientAuthNone:
+	case tlsconfig.ClientAuthOptional, tlsconfig.ClientAuthRequire:
+		check(tls.Enabled(), "server.tls.clientAuth requires server.tls.certFile and server.tls.keyFile")
+		check(tls.ClientCAFile != "", "server.tls.clientAuth requires server.tls.clientCAFile")
+	default:
+		check(false, "server.tls.clientAuth should be %s, %s or %s",
+			tlsconfig.ClientAuthNone, tlsconfig.ClientAuthOptional, tlsconfig.ClientAuthRequire)
+	}
+	check(len(tls.ClientCertIdentities) == 0 || tls.ClientAuth != tlsconfig.ClientAuthNone,
+		"server.tls.clientCertIdentities requires server.tls.clientAuth")
+
+	check(c.Database.URI != "", "database.uri must not be empty")
+	check(c.Database.Name != "", "database.name must not be empty")
+	check(c.Database.ConnectTimeout > 0, "database.connectTimeout must be positive")
+
+	check(c.Auth.AccessTokenSecret != "", "auth.accessTokenSecret must not be empty")
+	if c.Auth.AccessTokenSecret != "" && !c.Dev {
+		check(!weakSecret(c.Auth.AccessTokenSecret),
+			"auth.accessTokenSecret is weak, use at least %d random bytes, weak secrets are only allowed with dev: true",
+			minAccessTokenSecretLength)
+	}
+	for i, secret := range c.Auth.PreviousAccessTokenSecrets {
+		check(c.Dev || !weakSecret(secret), "auth.previousAccessTokenSecrets[%d] is weak", i)
+	}
+
+	for _, p := range c.Server.TrustedProxies {
+		_, _, err := net.ParseCIDR(p)
+		check(err == nil || net.ParseIP(p) != nil, "server.trustedProxies: invalid IP or CIDR: %s", p)
+	}
+	for name, g := range map[string]RateLimitGroup{"public": c.RateLimit.Public, "api": c.RateLimit.API, "adminAPI": c.RateLimit.AdminAPI, "apiPerIP": c.RateLimit.APIPerIP} {
+		check(g.Requests >= 0, "rateLimit.%s.requests must not be negative", name)
+		check(g.Requests == 0 || g.Period > 0, "rateLimit.%s.period must be positive", name)
+	}
+
+	for _, o := range c.Server.CORS.AllowedOrigins {
+		check(o == "*" || strings.HasPrefix(o, "http://") || strings.HasPrefix(o, "https://"),
+			"server.cors.allowedOrigins: invalid origin: %s, should be * or start with http:// or https://", o)
+	}
+
+	check(c.Auth.AccessTokenTTL > 0, "auth.accessTokenTTL must be positive")
+	check(c.Auth.ImpersonationTTL > 0 && c.Auth.ImpersonationTTL <= time.Hour, "auth.impersonationTTL should be between 0 and 1h")
+	lo := c.Auth.Lockout
+	for name, l := range map[string]LockoutLimits{"username": lo.Username, "ip": lo.IP} {
+		check(l.FreeAttempts >= 1, "auth.lockout.%s.freeAttempts must be at least 1", name)
+		check(l.Threshold == 0 || l.Threshold > l.FreeAttempts,
+			"auth.lockout.%s.threshold should be 0 or above auth.lockout.%s.freeAttempts", name, name)
+	}
+	check(lo.BaseDelay > 0, "auth.lockout.baseDelay must be positive")
+	check(lo.MaxDelay >= lo.BaseDelay, "auth.lockout.maxDelay must not be below auth.lockout.baseDelay")
+	check(lo.Duration > 0, "auth.lockout.duration must be positive")
+	check(lo.Window >= lo.MaxDelay, "auth.lockout.window must not be below auth.lockout.maxDelay")
+
+	switch c.Mail.Driver {
+	case MailDriverLog:
+	case MailDriverFile:
+		check(c.Mail.OutboxDir != "", "mail.outboxDir must not be empty with mail.driver: %s", MailDriverFile)
+	case MailDriverSMTP:
+		check(c.Mail.SMTP.Host != "", "mail.smtp.host must not be empty with mail.driver: %s", MailDriverSMTP)
+		check(c.Mail.SMTP.Port > 0 && c.Mail.SMTP.Port < 65536, "mail.smtp.port should be between 1 and 65535")
+	default:
+		check(false, "mail.driver should be %s, %s or %s", MailDriverLog, MailDriverFile, MailDriverSMTP)
+	}
+	_, err = mail.ParseAddress(c.Mail.From)
+	check(err == nil, "mail.from should be an email address")
+	check(c.Email.VerificationTTL > 0, "email.verificationTTL must be positive")
+	check(c.Email.ResendCooldown >= 0, "email.resendCooldown must not be negative")
+	check(c.Email.VerificationURL == "" || strings.Contains(c.Email.VerificationURL, "{token}"),
+		"email.verificationURL must contain {token}")
+	check(c.MFA.Issuer != "", "mfa.issuer must not be empty")
+	check(c.MFA.ChallengeTTL > 0, "mfa.challengeTTL must be positive")
+	check(c.MFA.RecoveryCodes > 0 && c.MFA.RecoveryCodes <= 100, "mfa.recoveryCodes should be between 1 and 100")
+	if c.WebAuthn.RPID != "" {
+		check(len(c.WebAuthn.Origins) > 0, "webauthn.origins must not be empty with webauthn.rpID")
+		for _, o := range c.WebAuthn.Origins {
+			u, err := url.Parse(o)
+			ok := err == nil && (u.Scheme == "https" || (u.Scheme == "http" && u.Hostname() == "localhost")) && u.Path == ""
+			check(ok, "webauthn.origins: invalid origin: %s, should be https://host[:port] or http://localhost[:port]", o)
+			if ok {
+				host := u.Hostname()
+				check(host == c.WebAuthn.RPID || strings.HasSuffix(host, "."+c.WebAuthn.RPID),
+					"webauthn.origins: %s is not on webauthn.rpID %s or a subdomain of it", o, c.WebAuthn.RPID)
+			}
+		}
+		check(c.WebAuthn.UserVerification == webauthn.UserVerificationRequired || c.WebAuthn.UserVerification == webauthn.UserVerificationPreferred,
+			"webauthn.userVerification should be %s or %s", webauthn.UserVerificationRequired, webauthn.UserVerificationPreferred)
+		check(c.WebAuthn.ChallengeTTL > 0, "webauthn.challengeTTL must be positive")
+		check(c.WebAuthn.MaxCredentials > 0 && c.WebAuthn.MaxCredentials <= 100, "webauthn.maxCredentials should be between 1 and 100")
+	}
+	check(c.PasswordReset.TokenTTL > 0, "passwordReset.tokenTTL must be positive")
+	check(c.PasswordReset.Cooldown >= 0, "passwordReset.cooldown must not be negative")
+	check(c.PasswordReset.URL == "" || strings.Contains(c.PasswordReset.URL, "{token}"),
+		"passwordReset.url must contain {token}")
+	check(c.Username.MinLength >= 1, "username.minLength must be at least 1")
+	check(c.Username.MaxLength >= c.Username.MinLength && c.Username.MaxLength <= maxUsernameLength,
+		"username.maxLength should be between username.minLength and %d", maxUsernameLength)
+	_, err = regexp.Compile(c.Username.AllowedPattern)
+	check(err == nil, "username.allowedPattern: %v", err)
+	check(c.Password.MinLength >= 1, "password.minLength must be at least 1")
+	// bcrypt ignores anything after 72 bytes, argon2id has no such limit
+	maxPasswordBytes := 1024
+	if c.Password.Hashing.Algorithm == passwordhash.AlgorithmBcrypt {
+		maxPasswordBytes = passwordpolicy.MaxBytes
+	}
+	check(c.Password.MaxBytes >= c.Password.MinLength && c.Password.MaxBytes <= maxPasswordBytes,
+		"password.maxBytes should be between password.minLength and %d", maxPasswordBytes)
+	check(c.Password.MinCharClasses >= 0 && c.Password.MinCharClasses <= 4, "password.minCharClasses should be between 0 and 4")
+	check(c.Password.MaxAge >= 0, "password.maxAge must not be negative")
+	check(c.Password.Hashing.Workers >= 0, "password.hashing.workers must not be negative")
+	check(c.Password.Hashing.QueueSize >= 0, "password.hashing.queueSize must not be negative")
+	check(c.Password.Hashing.QueueTimeout > 0, "password.hashing.queueTimeout must be positive")
+	switch h := c.Password.Hashing; h.Algorithm {
+	case passwordhash.AlgorithmArgon2id:
+		check(h.Argon2Iterations >= 1 && h.Argon2Iterations <= passwordhash.MaxArgon2Iterations,
+			"password.hashing.argon2Iterations should be between 1 and %d", passwordhash.MaxArgon2Iterations)
+		check(h.Argon2Parallelism >= 1 && h.Argon2Parallelism <= passwordhash.MaxArgon2Parallelism,
+			"password.hashing.argon2Parallelism should be between 1 and %d", passwordhash.MaxArgon2Parallelism)
+		check(h.Argon2Memory >= 8*uint32(h.Argon2Parallelism) && h.Argon2Memory <= passwordhash.MaxArgon2Memory,
+			"password.hashing.argon2Memory should be between 8 KiB per thread and 1 GiB")
+	case passwordhash.AlgorithmBcrypt:
+		check(h.BcryptCost >= bcrypt.MinCost && h.BcryptCost <= bcrypt.MaxCost,
+			"password.hashing.bcryptCost should be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	default:
+		check(false, "password.hashing.algorithm should be %s or %s", passwordhash.AlgorithmArgon2id, passwordhash.AlgorithmBcrypt)
+	}
+	check(c.Password.HistorySize >= 0 && c.Password.HistorySize <= 24, "password.historySize should be between 0 and 24")
+	switch c.PasswordReset.Notifier {
+	case NotifierMail:
+	case NotifierWebhook:
+		u, err := url.Parse(c.PasswordReset.WebhookURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"passwordReset.webhookURL should be an http(s) URL with passwordReset.notifier: %s", NotifierWebhook)
+	default:
+		check(false, "passwordReset.notifier should be %s or %s", NotifierMail, NotifierWebhook)
+	}
+
+	_, err = logging.ParseLevel(c.Log.Level)
+	check(err == nil, "log.level: %v", err)
+
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(invalid, "\n  "))
+	}
+	return nil
+}
+
+// weakSecret rejects short secrets and low entropy placeholders such as a run of dashes.
+func weakSecret(secret string) bool {
+	if len(secret) < minAccessTokenSecretLength {
+		return true
+	}
+	distinct := make(map[rune]struct{})
+	for _, r := range secret {
+		distinct[r] = struct{}{}
+	}
+	if len(distinct) < 10 {
+		return true
+	}
+	lower := strings.ToLower(secret)
+	for _, p := range []string{"changeme", "change-me", "secret", "password", "placeholder"} {
+		if strings.Contains(lower, p) {
+			return true
+		}
+	}
+	return false
+}
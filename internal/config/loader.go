@@ -0,0 +1,294 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const EnvPrefix = "APP"
+
+type key struct {
+	name  string
+	def   any
+	usage string
+	// legacy is the flat key name used before the config was grouped
+	legacy string
+	// secret values can not be passed as flags, they can be read from a file given in <name>File or <ENV>_FILE instead
+	secret bool
+	// reloadable values are applied on reload, other values require a restart
+	reloadable bool
+}
+
+var keys = []key{
+	{name: "dev", def: false, usage: "development mode, allows weak secrets"},
+	{name: "server.address", def: ":8081", usage: "listen address", legacy: "serverAddress"},
+	{name: "server.readTimeout", def: 15 * time.Second, usage: "maximum duration for reading a request"},
+	{name: "server.writeTimeout", def: 15 * time.Second, usage: "maximum duration for writing a response"},
+	{name: "server.idleTimeout", def: 60 * time.Second, usage: "maximum duration to keep idle keep-alive connections"},
+	{name: "server.maxHeaderBytes", def: 1024, usage: "maximum size of request headers"},
+	{name: "server.shutdownDelay", def: time.Duration(0), usage: "delay between reporting not ready and draining requests", legacy: "shutdownDelay"},
+	{name: "server.shutdownTimeout", def: 30 * time.Second, usage: "deadline for draining requests on shutdown", legacy: "shutdownTimeout"},
+	{name: "server.tls.certFile", def: "", usage: "TLS certificate file, enables TLS", legacy: "tlsCertFile"},
+	{name: "server.tls.keyFile", def: "", usage: "TLS key file", legacy: "tlsKeyFile"},
+	{name: "server.tls.minVersion", def: "1.2", usage: "minimum TLS version, 1.2 or 1.3", legacy: "tlsMinVersion"},
+	{name: "server.tls.cipherSuites", def: []string{}, usage: "allowed TLS 1.2 cipher suites, empty for Go defaults", legacy: "tlsCipherSuites"},
+	{name: "server.tls.clientAuth", def: "none", usage: "client certificate auth, none, optional or require", legacy: "tlsClientAuth"},
+	{name: "server.tls.clientCAFile", def: "", usage: "CA bundle for verifying client certificates", legacy: "tlsClientCAFile"},
+	{name: "server.tls.clientCertIdentities", def: []string{}, usage: "client certificate identities allowed as admin", legacy: "tlsClientCertIdentities"},
+	{name: "server.cors.allowedOrigins", def: []string{}, usage: "origins allowed for CORS requests, * allows any", reloadable: true},
+	{name: "server.trustedProxies", def: []string{}, usage: "IPs or CIDRs of proxies whose X-Forwarded-For header is trusted"},
+	{name: "database.uri", def: "", legacy: "userDb", secret: true},
+	{name: "database.name", def: "userDB", usage: "database name"},
+	{name: "database.connectTimeout", def: 10 * time.Second, usage: "timeout for connecting to the database"},
+	{name: "auth.accessTokenSecret", def: "", legacy: "accessTokenSecret", secret: true, reloadable: true},
+	{name: "auth.previousAccessTokenSecrets", def: []string{}, secret: true, reloadable: true},
+	{name: "auth.accessTokenTTL", def: 15 * time.Minute, usage: "time to live of issued access tokens"},
+	{name: "auth.loginWithEmail", def: false, usage: "allow logging in with a verified email in place of the username"},
+	{name: "auth.impersonationTTL", def: 10 * time.Minute, usage: "time to live of the tokens admins act as another user with"},
+	{name: "auth.allowSelfDeletion", def: false, usage: "allow admins to delete themselves"},
+	{name: "auth.allowSelfDemotion", def: false, usage: "allow admins to change their own role"},
+	{name: "auth.lockout.username.freeAttempts", def: 3, usage: "failed logins for a username before delays start"},
+	{name: "auth.lockout.username.threshold", def: 10, usage: "failed logins which lock a username, 0 only delays"},
+	{name: "auth.lockout.ip.freeAttempts", def: 20, usage: "failed logins from a client IP before delays start"},
+	{name: "auth.lockout.ip.threshold", def: 100, usage: "failed logins which lock a client IP, 0 only delays"},
+	{name: "auth.lockout.baseDelay", def: time.Second, usage: "delay after the first failed login past the free attempts, doubled by every further failure"},
+	{name: "auth.lockout.maxDelay", def: time.Minute, usage: "maximum delay between failed logins"},
+	{name: "auth.lockout.duration", def: 15 * time.Minute, usage: "how long a username or client IP stays locked"},
+	{name: "auth.lockout.window", def: 15 * time.Minute, usage: "how long failed logins are counted after the last one"},
+	{name: "log.level", def: "info", usage: "log level, debug, info, warn or error", reloadable: true},
+	{name: "profile.attributesSchemaFile", def: "", usage: "JSON Schema file for profile attributes"},
+	{name: "mail.driver", def: "log", usage: "mailer, log, file or smtp"},
+	{name: "mail.from", def: "no-reply@localhost", usage: "sender address"},
+	{name: "mail.outboxDir", def: "outbox", usage: "directory the file mailer writes messages to"},
+	{name: "mail.smtp.host", def: "", usage: "SMTP host"},
+	{name: "mail.smtp.port", def: 587, usage: "SMTP port"},
+	{name: "mail.smtp.username", def: "", usage: "SMTP username"},
+	{name: "mail.smtp.password", def: "", secret: true},
+	{name: "mail.smtp.implicitTLS", def: false, usage: "connect to SMTP with TLS from the start instead of STARTTLS"},
+	{name: "email.verificationTTL", def: 24 * time.Hour, usage: "time to live of email verification tokens"},
+	{name: "email.verificationURL", def: "", usage: "email verification link, {token} is replaced with the token"},
+	{name: "email.resendCooldown", def: time.Minute, usage: "minimum time between verification emails to a user"},
+	{name: "mfa.issuer", def: "User Management Service", usage: "service name shown in authenticator apps"},
+	{name: "mfa.requireForAdmins", def: false, usage: "make admins enroll a second factor and use it for sensitive routes"},
+	{name: "mfa.challengeTTL", def: 5 * time.Minute, usage: "time to enter the second factor after the password"},
+	{name: "mfa.recoveryCodes", def: 10, usage: "how many single-use recovery codes are generated"},
+	{name: "webauthn.rpID", def: "", usage: "domain passkeys are scoped to, passkeys are disabled when empty"},
+	{name: "webauthn.rpName", def: "User Management Service", usage: "service name shown when creating a passkey"},
+	{name: "webauthn.origins", def: []string{}, usage: "origins of the pages using passkeys"},
+	{name: "webauthn.userVerification", def: "required", usage: "passkey user verification, required or preferred"},
+	{name: "webauthn.challengeTTL", def: 5 * time.Minute, usage: "time to complete a passkey registration or login"},
+	{name: "webauthn.maxCredentials", def: 10, usage: "maximum passkeys per user"},
+	{name: "passwordReset.tokenTTL", def: time.Hour, usage: "time to live of password reset tokens"},
+	{name: "passwordReset.url", def: "", usage: "password reset link, {token} is replaced with the token"},
+	{name: "passwordReset.cooldown", def: time.Minute, usage: "minimum time between password reset tokens for a user"},
+	{name: "passwordReset.notifier", def: "mail", usage: "password reset token delivery, mail or webhook"},
+	{name: "passwordReset.webhookURL", def: "", usage: "URL the webhook notifier POSTs notifications to"},
+	{name: "username.minLength", def: 1, usage: "minimum username length in characters, once normalized"},
+	{name: "username.maxLength", def: 64, usage: "maximum username length in characters, once normalized"},
+	{name: "username.allowedPattern", def: `^[\p{L}\p{M}\p{N}._@+-]+$`, usage: "regular expression normalized usernames have to match"},
+	{name: "password.minLength", def: 8, usage: "minimum password length in characters"},
+	{name: "password.maxBytes", def: 72, usage: "maximum password length in bytes, at most 72 with bcrypt which ignores anything after it"},
+	{name: "password.minCharClasses", def: 0, usage: "how many of lowercase, uppercase, digits and symbols passwords need"},
+	{name: "password.disallowUsername", def: true, usage: "reject passwords containing the username"},
+	{name: "password.dictionaryFile", def: "", usage: "file of words, one per line, which may not be used as passwords"},
+	{name: "password.breachedFile", def: "", usage: "Pwned Passwords SHA-1 file ordered by hash, or a directory of its range files"},
+	{name: "password.historySize", def: 5, usage: "how many previous passwords may not be reused, 0 disables the check"},
+	{name: "password.maxAge", def: time.Duration(0), usage: "make users change passwords older than this on login, 0 disables it"},
+	{name: "password.hashing.algorithm", def: "argon2id", usage: "algorithm of new password hashes, argon2id or bcrypt"},
+	{name: "password.hashing.bcryptCost", def: 10, usage: "bcrypt cost"},
+	{name: "password.hashing.argon2Memory", def: 64 * 1024, usage: "argon2id memory in KiB"},
+	{name: "password.hashing.argon2Iterations", def: 3, usage: "argon2id iterations"},
+	{name: "password.hashing.argon2Parallelism", def: 2, usage: "argon2id parallelism"},
+	{name: "password.hashing.workers", def: 0, usage: "how many passwords are hashed at a time, 0 is half the CPUs"},
+	{name: "password.hashing.queueSize", def: 64, usage: "how many password hashings may wait for a worker"},
+	{name: "password.hashing.queueTimeout", def: 5 * time.Second, usage: "how long a password hashing may wait for a worker"},
+	{name: "rateLimit.public.requests", def: 60, usage: "requests per period to routes before logging in for a client IP, 0 disables the limit", reloadable: true},
+	{name: "rateLimit.public.period", def: time.Minute, usage: "period of rateLimit.public.requests", reloadable: true},
+	{name: "rateLimit.api.requests", def: 300, usage: "requests per period to authenticated routes for a user, 0 disables the limit", reloadable: true},
+	{name: "rateLimit.api.period", def: time.Minute, usage: "period of rateLimit.api.requests", reloadable: true},
+	{name: "rateLimit.adminAPI.requests", def: 120, usage: "requests per period to admin routes for a user, 0 disables the limit", reloadable: true},
+	{name: "rateLimit.adminAPI.period", def: time.Minute, usage: "period of rateLimit.adminAPI.requests", reloadable: true},
+	{name: "rateLimit.apiPerIP.requests", def: 1200, usage: "requests per period to authenticated and admin routes for a client IP, checked before the access token, 0 disables the limit", reloadable: true},
+	{name: "rateLimit.apiPerIP.period", def: time.Minute, usage: "period of rateLimit.apiPerIP.requests", reloadable: true},
+	{name: "seed.file", def: "", usage: "users seed file to reconcile UserDB against on startup"},
+}
+
+type Loader struct {
+	flags          *pflag.FlagSet
+	configFile     *string
+	configFileUsed string
+}
+
+// NewLoader registers the config flags on fs, Load must be called after fs is parsed.
+func NewLoader(fs *pflag.FlagSet) *Loader {
+	l := &Loader{flags: fs}
+	l.configFile = fs.String("config", "", "config file path (default ./config.yaml if it exists)")
+	for _, k := range keys {
+		if k.secret {
+			fs.String(k.name+"File", "", "file to read "+k.name+" from")
+			continue
+		}
+		switch d := k.def.(type) {
+		case bool:
+			fs.Bool(k.name, d, k.usage)
+		case int:
+			fs.Int(k.name, d, k.usage)
+		case time.Duration:
+			fs.Duration(k.name, d, k.usage)
+		case []string:
+			fs.StringSlice(k.name, d, k.usage)
+		case string:
+			fs.String(k.name, d, k.usage)
+		}
+	}
+	return l
+}
+
+// Load reads the config with precedence: flags, then environment variables, then config file, then defaults.
+// Every call reads all sources again, so it is also used to reload the config.
+func (l *Loader) Load() (Config, error) {
+	c := Config{}
+	v := viper.New()
+
+	for _, k := range keys {
+		v.SetDefault(k.name, k.def)
+		envs := []string{envName(k.name)}
+		if k.legacy != "" {
+			envs = append(envs, envName(k.legacy))
+		}
+		if err := v.BindEnv(append([]string{k.name}, envs...)...); err != nil {
+			return c, fmt.Errorf("failed to bind env for %s: %w", k.name, err)
+		}
+		if k.secret {
+			if err := v.BindEnv(k.name+"File", envName(k.name)+"_FILE"); err != nil {
+				return c, fmt.Errorf("failed to bind env for %sFile: %w", k.name, err)
+			}
+		}
+		flagName := k.name
+		if k.secret {
+			flagName = k.name + "File"
+		}
+		if f := l.flags.Lookup(flagName); f != nil {
+			if err := v.BindPFlag(flagName, f); err != nil {
+				return c, fmt.Errorf("failed to bind flag %s: %w", flagName, err)
+			}
+		}
+	}
+
+	if err := l.readConfigFile(v); err != nil {
+		return c, err
+	}
+
+	if err := resolveSecretFiles(v); err != nil {
+		return c, err
+	}
+
+	if err := v.Unmarshal(&c); err != nil {
+		return c, fmt.Errorf("failed to decode config: %w", err)
+	}
+
+	return c, c.Validate()
+}
+
+// ConfigFileUsed returns the path of the config file read by the last Load, empty if there was none.
+func (l *Loader) ConfigFileUsed() string {
+	return l.configFileUsed
+}
+
+func (l *Loader) readConfigFile(v *viper.Viper) error {
+	l.configFileUsed = ""
+	if *l.configFile != "" {
+		v.SetConfigFile(*l.configFile)
+	} else {
+		v.AddConfigPath(".")
+		v.SetConfigName("config")
+		v.SetConfigType("yaml")
+	}
+	if err := v.ReadInConfig(); err != nil {
+		if errors.As(err, &viper.ConfigFileNotFoundError{}) {
+			log.Printf("config.yaml file not found, reading config from defaults, environment variables with prefix %s_ and flags", EnvPrefix)
+			return nil
+		}
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	l.configFileUsed = v.ConfigFileUsed()
+	log.Printf("Reading config from %s", l.configFileUsed)
+
+	legacy := make(map[string]any)
+	for _, k := range keys {
+		if k.legacy == "" || !v.InConfig(k.legacy) {
+			continue
+		}
+		if v.InConfig(k.name) {
+			return fmt.Errorf("config file sets both %s and its deprecated name %s", k.name, k.legacy)
+		}
+		log.Printf("Config key %s is deprecated, use %s", k.legacy, k.name)
+		setNested(legacy, k.name, v.Get(k.legacy))
+	}
+	if len(legacy) > 0 {
+		if err := v.MergeConfigMap(legacy); err != nil {
+			return fmt.Errorf("failed to merge deprecated config keys: %w", err)
+		}
+	}
+	return nil
+}
+
+// resolveSecretFiles reads secrets from the files given in <name>File, trailing newlines are trimmed.
+// List secrets are read one per line.
+func resolveSecretFiles(v *viper.Viper) error {
+	for _, k := range keys {
+		if !k.secret {
+			continue
+		}
+		path := v.GetString(k.name + "File")
+		if path == "" {
+			continue
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %sFile: %w", k.name, err)
+		}
+		content := strings.TrimRight(string(b), "\r\n")
+		if _, ok := k.def.([]string); ok {
+			if len(v.GetStringSlice(k.name)) > 0 {
+				return fmt.Errorf("both %s and %sFile are set, only one is allowed", k.name, k.name)
+			}
+			var values []string
+			for _, line := range strings.Split(content, "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					values = append(values, line)
+				}
+			}
+			v.Set(k.name, values)
+			continue
+		}
+		if v.GetString(k.name) != "" {
+			return fmt.Errorf("both %s and %sFile are set, only one is allowed", k.name, k.name)
+		}
+		v.Set(k.name, content)
+	}
+	return nil
+}
+
+func envName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+func setNested(m map[string]any, key string, value any) {
+	path := strings.Split(key, ".")
+	for _, p := range path[:len(path)-1] {
+		next, ok := m[p].(map[string]any)
+		if !ok {
+			next = make(map[string]any)
+			m[p] = next
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = value
+}
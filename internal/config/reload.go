@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+)
+
+type Change struct {
+	Key        string
+	Old        string
+	New        string
+	Reloadable bool
+}
+
+func (ch Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", ch.Key, ch.Old, ch.New)
+}
+
+// Diff returns the changed keys between old and new, secret values are masked.
+func Diff(old, new Config) []Change {
+	oldValues, newValues := flatten(old), flatten(new)
+	var changes []Change
+	for _, k := range keys {
+		o, n := oldValues[k.name], newValues[k.name]
+		if o == n {
+			continue
+		}
+		if k.secret {
+			o, n = "<redacted>", "<redacted, changed>"
+		}
+		changes = append(changes, Change{Key: k.name, Old: o, New: n, Reloadable: k.reloadable})
+	}
+	return changes
+}
+
+// withReloadable returns c with the reloadable values of n, these must match the reloadable keys.
+func (c Config) withReloadable(n Config) Config {
+	c.Log.Level = n.Log.Level
+	c.Server.CORS = n.Server.CORS
+	c.Auth.AccessTokenSecret = n.Auth.AccessTokenSecret
+	c.Auth.PreviousAccessTokenSecrets = n.Auth.PreviousAccessTokenSecrets
+	c.RateLimit = n.RateLimit
+	return c
+}
+
+// flatten maps the dotted key names to their formatted values.
+func flatten(c Config) map[string]string {
+	m := make(map[string]string)
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := prefix + t.Field(i).Tag.Get("mapstructure")
+			if t.Field(i).Type.Kind() == reflect.Struct {
+				walk(name+".", v.Field(i))
+				continue
+			}
+			m[name] = fmt.Sprint(v.Field(i).Interface())
+		}
+	}
+	walk("", reflect.ValueOf(c))
+	return m
+}
+
+type Reloader struct {
+	Loader *Loader
+	// Apply applies the reloadable values of the config, the config is not changed if it returns an error
+	Apply func(Config) error
+
+	mu      sync.Mutex
+	current Config
+}
+
+func NewReloader(l *Loader, current Config, apply func(Config) error) *Reloader {
+	return &Reloader{Loader: l, Apply: apply, current: current}
+}
+
+func (r *Reloader) Current() Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Reload reads and validates the config, then applies the reloadable changes all at once.
+// Changes to values which require a restart are logged but not applied.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, err := r.Loader.Load()
+	if err != nil {
+		return fmt.Errorf("config reload rejected, keeping current config: %w", err)
+	}
+
+	var reloadable []Change
+	for _, ch := range Diff(r.current, n) {
+		if !ch.Reloadable {
+			log.Printf("Config reload: %s requires a restart, not applied", ch)
+			continue
+		}
+		reloadable = append(reloadable, ch)
+	}
+	if len(reloadable) == 0 {
+		log.Printf("Config reload: no reloadable changes")
+		return nil
+	}
+
+	next := r.current.withReloadable(n)
+	if err := r.Apply(next); err != nil {
+		return fmt.Errorf("config reload rejected, keeping current config: %w", err)
+	}
+	r.current = next
+	for _, ch := range reloadable {
+		log.Printf("Config reload: applied %s", ch)
+	}
+	return nil
+}
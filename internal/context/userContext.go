@@ -9,6 +9,14 @@ type userContextKey struct{}
 type UserContext struct {
 	UserID string
 	Role   string
+	// AMR are the authentication methods of the access token
+	AMR []string
+	// ClientCert is true for callers identified by a trusted client certificate instead of a token
+	ClientCert bool
+	// SessionID is the session of the access token, empty for tokens not issued by logging in
+	SessionID string
+	// ActorID is the admin impersonating UserID, empty when UserID is the caller
+	ActorID string
 }
 
 func SetUserContext(ctx context.Context, uc UserContext) context.Context {
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/usernames"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"time"
+)
+
+const CollectionLocks = "locks"
+
+const (
+	// roleAdmin is validation.RoleAdmin, which can't be imported from here
+	roleAdmin = "admin"
+	// lockAdmins is held while removing an admin, so that concurrent removals can't leave none
+	lockAdmins = "admins"
+	// LockSeed is held while reconciling the seed file, so that replicas starting together apply it once
+	LockSeed = "seed"
+	// lockLease is how long a lock is held at most, in case its holder stops without releasing it,
+	// it is renewed every lockRenewInterval while the holder runs
+	lockLease         = 30 * time.Second
+	lockRenewInterval = lockLease / 3
+	// lockReleaseTimeout bounds releasing a lock, which isn't cancelled with the context of its holder
+	lockReleaseTimeout = 5 * time.Second
+	// lockRetryInterval is how often a held lock is tried again
+	lockRetryInterval = 20 * time.Millisecond
+)
+
+// WithLock runs fn holding the lock with id, waiting for it until ctx is done. The lock is a
+// document in CollectionLocks, its unique _id lets a single holder insert it at a time.
+// In a transaction a held lock fails at once with ErrLocked rather than being waited for,
+// the transaction would not see it released.
+func (db UserDatabase) WithLock(ctx context.Context, id string, fn func() error) error {
+	owner := primitive.NewObjectID()
+	inTransaction := mongo.SessionFromContext(ctx) != nil
+	for {
+		now := time.Now()
+		// Upserting where the lease has expired takes over the lock of a holder which has stopped,
+		// the insert fails with a duplicate key error while it is held
+		_, err := db.Collection(CollectionLocks).UpdateOne(ctx,
+			bson.M{"_id": id, "expiresAt": bson.M{"$lte": now}},
+			bson.M{"$set": bson.M{"owner": owner, "expiresAt": now.Add(lockLease)}},
+			options.Update().SetUpsert(true),
+		)
+		if err == nil {
+			break
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("error acquiring lock: %s: %w", id, err)
+		}
+		if inTransaction {
+			return fmt.Errorf("error acquiring lock: %s: %w", id, ErrLocked)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("error waiting for lock: %s: %w", id, ctx.Err())
+		case <-time.After(lockRetryInterval):
+		}
+	}
+
+	// In a transaction the lock is only written on commit, after it has been released,
+	// so that it needs no renewal and has to be released in the transaction
+	releaseCtx := ctx
+	var fnErr error
+	if inTransaction {
+		fnErr = fn()
+	} else {
+		stopRenewing := db.renewLock(id, owner)
+		fnErr = fn()
+		stopRenewing()
+		// Released even when ctx is done, rather than left held until the lease expires
+		var cancel context.CancelFunc
+		releaseCtx, cancel = context.WithTimeout(context.Background(), lockReleaseTimeout)
+		defer cancel()
+	}
+	if _, err := db.Collection(CollectionLocks).DeleteOne(releaseCtx, bson.M{"_id": id, "owner": owner}); err != nil && fnErr == nil {
+		return fmt.Errorf("error releasing lock: %s: %w", id, err)
+	}
+	return fnErr
+}
+
+// renewLock extends the lease of the lock with id held by owner every lockRenewInterval,
+// until the returned function is called.
+func (db UserDatabase) renewLock(id string, owner primitive.ObjectID) (stop func()) {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(lockRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), lockRenewInterval)
+				_, err := db.Collection(CollectionLocks).UpdateOne(ctx,
+					bson.M{"_id": id, "owner": owner},
+					bson.M{"$set": bson.M{"expiresAt": time.Now().Add(lockLease)}},
+				)
+				cancel()
+				if err != nil {
+					log.Printf("renewLock: Error renewing lock: %s, err: %v", id, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// checkNotLastAdmin fails with ErrLastAdmin when the User with username is the only admin,
+// it has to be called holding lockAdmins.
+func (db UserDatabase) checkNotLastAdmin(ctx context.Context, username string) error {
+	var u User
+	err := db.Collection(CollectionUsers).FindOne(ctx, bson.M{"username": usernames.Key(username)},
+		options.FindOne().SetProjection(bson.M{"_id": 1, "role": 1}),
+	).Decode(&u)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		return fmt.Errorf("error finding User, username: %v, err: %w", username, err)
+	}
+	if u.Role != roleAdmin {
+		return nil
+	}
+	// Excluded by _id, as the stored username of another admin may not be normalized
+	others, err := db.Collection(CollectionUsers).CountDocuments(ctx,
+		bson.M{"role": roleAdmin, "_id": bson.M{"$ne": u.ID}},
+		options.Count().SetLimit(1),
+	)
+	if err != nil {
+		return fmt.Errorf("error counting other admins, username: %v, err: %w", username, err)
+	}
+	if others == 0 {
+		return fmt.Errorf("username: %v: %w", username, ErrLastAdmin)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const CollectionAuditEvents = "auditEvents"
+
+// Audit event actions.
+const (
+	AuditImpersonation = "impersonation"
+	// AuditPasswordHashExport is an export of Users with their password hashes
+	AuditPasswordHashExport = "password-hash-export"
+)
+
+// AuditEvent records an action of ActorID, an admin, concerning the User Subject, Subject is empty
+// for actions concerning every User.
+type AuditEvent struct {
+	Time    time.Time         `bson:"time" json:"time"`
+	Action  string            `bson:"action" json:"action"`
+	ActorID string            `bson:"actorId" json:"actorId"`
+	Subject string            `bson:"subject" json:"subject"`
+	IP      string            `bson:"ip" json:"ip"`
+	Details map[string]string `bson:"details,omitempty" json:"details,omitempty"`
+}
+
+func (db UserDatabase) InsertAuditEvent(ctx context.Context, e AuditEvent) error {
+	if _, err := db.Collection(CollectionAuditEvents).InsertOne(ctx, e); err != nil {
+		return fmt.Errorf("error inserting AuditEvent, action: %v, err: %w", e.Action, err)
+	}
+	return nil
+}
@@ -3,38 +3,75 @@ package database
 import (
 	"context"
 	"errors"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"reflect"
 )
 
 const (
-	UserDB          = "userDB"
 	CollectionUsers = "users"
 )
 
-var ErrNoDocumentsModified = errors.New("no documents modified")
+var (
+	ErrNoDocumentsModified = errors.New("no documents modified")
+	ErrDuplicateUsername   = errors.New("duplicate username")
+	ErrLastAdmin           = errors.New("the last admin can't be deleted or demoted")
+	ErrConfusableUsername  = errors.New("username looks like an existing one")
+	ErrDuplicateEmail      = errors.New("email is already in use")
+	// ErrLocked means a lock of WithLock is held by another request, retrying later may succeed
+	ErrLocked = errors.New("another request holds the lock, try again")
+
+	ErrTransactionsNotSupported = errors.New("transactions are not supported, they need a replica set or a sharded cluster")
+)
 
 type UserDatabase struct {
 	*mongo.Database
+	// PasswordHistorySize is how many previous password hashes are kept for each User,
+	// they are stored in the passwordHistory field of the user document, which User has no field for,
+	// so they are only read by FindPasswordHashes and can't end up in a response
+	PasswordHistorySize int
 }
 
 func ConnectUserDB(ctx context.Context, dbURI string) (*mongo.Client, error) {
-	c, err := mongo.Connect(ctx, options.Client().ApplyURI(dbURI))
+	// Embedded documents in untyped fields such as Profile.Attributes decode to maps
+	// rather than bson.D, so that they encode to JSON objects
+	registry := bson.NewRegistryBuilder().
+		RegisterTypeMapEntry(bsontype.EmbeddedDocument, reflect.TypeOf(bson.M{})).
+		Build()
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI(dbURI).SetRegistry(registry))
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = c.Database(UserDB).Collection(CollectionUsers).Indexes().CreateOne(
-		ctx,
-		mongo.IndexModel{
-			Keys:    bson.D{{Key: "username", Value: 1}},
-			Options: options.Index().SetUnique(true),
-		},
-	)
-	if err != nil {
+	if err := c.Ping(ctx, nil); err != nil {
 		return nil, err
 	}
 
 	return c, nil
 }
+
+// WithTransaction runs fn in a transaction which is committed if fn returns nil and aborted otherwise.
+// fn must use the given ctx for every operation, and may be called again on transient errors.
+// Transactions need a replica set or a sharded cluster, ErrTransactionsNotSupported is returned otherwise.
+func (db UserDatabase) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	sess, err := db.Client().StartSession()
+	if err != nil {
+		return fmt.Errorf("error starting session: %w", err)
+	}
+	defer sess.EndSession(ctx)
+
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (any, error) {
+		return nil, fn(sc)
+	})
+	if err != nil {
+		var ce mongo.CommandError
+		if errors.As(err, &ce) && ce.Code == 20 {
+			return fmt.Errorf("%v: %w", err, ErrTransactionsNotSupported)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const CollectionLoginThrottles = "loginThrottles"
+
+// LoginThrottle counts the recent failed logins for a username or a client IP, it is kept apart
+// from User so that usernames which don't exist are throttled the same as those which do.
+type LoginThrottle struct {
+	Key           string    `bson:"_id"`
+	Failures      int       `bson:"failures"`
+	LastFailureAt time.Time `bson:"lastFailureAt"`
+	LockedUntil   time.Time `bson:"lockedUntil,omitempty"`
+	// ExpiresAt removes the LoginThrottle with a TTL index once it no longer has an effect
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// FindLoginThrottles returns the LoginThrottles of keys, keys without failures have none.
+func (db UserDatabase) FindLoginThrottles(ctx context.Context, keys []string) ([]LoginThrottle, error) {
+	var throttles []LoginThrottle
+	cur, err := db.Collection(CollectionLoginThrottles).Find(ctx, bson.M{"_id": bson.M{"$in": keys}})
+	if err != nil {
+		return nil, fmt.Errorf("error getting cursor to find LoginThrottles, keys: %v, err: %w", keys, err)
+	}
+	if err = cur.All(ctx, &throttles); err != nil {
+		return nil, fmt.Errorf("error getting LoginThrottles from cursor, keys: %v, err: %w", keys, err)
+	}
+	return throttles, nil
+}
+
+// RecordLoginFailure counts a failed login for key, failures older than window are forgotten.
+// Reaching lockoutThreshold failures locks key for lockoutDuration, 0 never locks it.
+func (db UserDatabase) RecordLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration,
+	lockoutThreshold int, lockoutDuration time.Duration) (LoginThrottle, error) {
+	// A pipeline, so that concurrent failures are all counted
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"failures": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$lastFailureAt", now.Add(-window)}},
+				bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$failures", 0}}, 1}},
+				1,
+			}},
+			"lastFailureAt": now,
+		}}},
+	}
+	if lockoutThreshold > 0 {
+		update = append(update, bson.D{{Key: "$set", Value: bson.M{
+			"lockedUntil": bson.M{"$cond": bson.A{
+				bson.M{"$gte": bson.A{"$failures", lockoutThreshold}},
+				now.Add(lockoutDuration),
+				"$lockedUntil",
+			}},
+		}}})
+	}
+	update = append(update, bson.D{{Key: "$set", Value: bson.M{
+		"expiresAt": bson.M{"$max": bson.A{now.Add(window), "$lockedUntil"}},
+	}}})
+
+	var t LoginThrottle
+	err := db.Collection(CollectionLoginThrottles).FindOneAndUpdate(ctx, bson.M{"_id": key}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&t)
+	if err != nil {
+		return t, fmt.Errorf("error recording login failure, key: %v, err: %w", key, err)
+	}
+	return t, nil
+}
+
+// ClearLoginThrottle forgets the failed logins of key, it fails with ErrNoDocumentsModified when it has none.
+func (db UserDatabase) ClearLoginThrottle(ctx context.Context, key string) error {
+	r, err := db.Collection(CollectionLoginThrottles).DeleteOne(ctx, bson.M{"_id": key})
+	if err != nil {
+		return fmt.Errorf("error clearing LoginThrottle, key: %v, err: %w", key, err)
+	}
+	if r.DeletedCount == 0 {
+		return fmt.Errorf("no documents deleted when clearing LoginThrottle, key: %v, err: %w", key, ErrNoDocumentsModified)
+	}
+	return nil
+}
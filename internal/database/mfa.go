@@ -0,0 +1,121 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/usernames"
+	"go.mongodb.org/mongo-driver/bson"
+	"time"
+)
+
+// MFA is the TOTP second factor of a User, it is only required at login once EnabledAt is set.
+type MFA struct {
+	TOTPSecret string `bson:"totpSecret"`
+	// LastCounter is the time step of the last accepted code, so that codes can't be replayed
+	LastCounter int64 `bson:"lastCounter"`
+	// RecoveryCodeHashes are the SHA-256 hashes of the unused recovery codes
+	RecoveryCodeHashes [][]byte  `bson:"recoveryCodeHashes"`
+	EnabledAt          time.Time `bson:"enabledAt,omitempty"`
+}
+
+// Enabled reports if mfa has been confirmed.
+func (mfa *MFA) Enabled() bool {
+	return mfa != nil && !mfa.EnabledAt.IsZero()
+}
+
+// SetPendingMFA replaces any pending enrollment of the User with secret,
+// it fails with ErrNoDocumentsModified when MFA is already enabled.
+func (db UserDatabase) SetPendingMFA(ctx context.Context, username string, secret string) error {
+	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+		bson.M{"username": usernames.Key(username), "mfa.enabledAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"mfa": MFA{TOTPSecret: secret}}},
+	)
+	if err != nil {
+		return fmt.Errorf("error setting User pending MFA, username: %v, err: %w", username, err)
+	}
+	if r.MatchedCount == 0 {
+		return fmt.Errorf("no documents matched when setting user pending MFA, username: %v, err: %w", username, ErrNoDocumentsModified)
+	}
+	return nil
+}
+
+// EnableMFA confirms the pending enrollment with secret, counter is the step of the code it was confirmed with.
+func (db UserDatabase) EnableMFA(ctx context.Context, username string, secret string, counter int64, recoveryCodeHashes [][]byte, now time.Time) error {
+	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+		bson.M{"username": usernames.Key(username), "mfa.totpSecret": secret, "mfa.enabledAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{
+			"mfa.lastCounter":        counter,
+			"mfa.recoveryCodeHashes": recoveryCodeHashes,
+			"mfa.enabledAt":          now,
+		}},
+	)
+	if err != nil {
+		return fmt.Errorf("error enabling User MFA, username: %v, err: %w", username, err)
+	}
+	if r.ModifiedCount == 0 {
+		return fmt.Errorf("no documents modified when enabling user MFA, username: %v, err: %w", username, ErrNoDocumentsModified)
+	}
+	return nil
+}
+
+// UseTOTPCounter records counter as the step of the last accepted code, it fails with
+// ErrNoDocumentsModified when a code of the same or a later step has already been accepted.
+func (db UserDatabase) UseTOTPCounter(ctx context.Context, username string, counter int64) error {
+	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+		bson.M{"username": usernames.Key(username), "mfa.enabledAt": bson.M{"$exists": true}, "mfa.lastCounter": bson.M{"$lt": counter}},
+		bson.M{"$set": bson.M{"mfa.lastCounter": counter}},
+	)
+	if err != nil {
+		return fmt.Errorf("error using User TOTP counter, username: %v, err: %w", username, err)
+	}
+	if r.ModifiedCount == 0 {
+		return fmt.Errorf("no documents modified when using user TOTP counter, username: %v, err: %w", username, ErrNoDocumentsModified)
+	}
+	return nil
+}
+
+// UseRecoveryCode removes the recovery code with codeHash, it fails with
+// ErrNoDocumentsModified when the User has no such unused code.
+func (db UserDatabase) UseRecoveryCode(ctx context.Context, username string, codeHash []byte) error {
+	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+		bson.M{"username": usernames.Key(username), "mfa.enabledAt": bson.M{"$exists": true}, "mfa.recoveryCodeHashes": codeHash},
+		bson.M{"$pull": bson.M{"mfa.recoveryCodeHashes": codeHash}},
+	)
+	if err != nil {
+		return fmt.Errorf("error using User recovery code, username: %v, err: %w", username, err)
+	}
+	if r.ModifiedCount == 0 {
+		return fmt.Errorf("no documents modified when using user recovery code, username: %v, err: %w", username, ErrNoDocumentsModified)
+	}
+	return nil
+}
+
+// SetRecoveryCodes replaces the recovery codes of the User with enabled MFA.
+func (db UserDatabase) SetRecoveryCodes(ctx context.Context, username string, recoveryCodeHashes [][]byte) error {
+	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+		bson.M{"username": usernames.Key(username), "mfa.enabledAt": bson.M{"$exists": true}},
+		bson.M{"$set": bson.M{"mfa.recoveryCodeHashes": recoveryCodeHashes}},
+	)
+	if err != nil {
+		return fmt.Errorf("error setting User recovery codes, username: %v, err: %w", username, err)
+	}
+	if r.MatchedCount == 0 {
+		return fmt.Errorf("no documents matched when setting user recovery codes, username: %v, err: %w", username, ErrNoDocumentsModified)
+	}
+	return nil
+}
+
+// ResetMFA removes the second factor of the User, enabled or pending.
+func (db UserDatabase) ResetMFA(ctx context.Context, username string) error {
+	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+		bson.M{"username": usernames.Key(username)},
+		bson.M{"$unset": bson.M{"mfa": ""}},
+	)
+	if err != nil {
+		return fmt.Errorf("error resetting User MFA, username: %v, err: %w", username, err)
+	}
+	if r.MatchedCount == 0 {
+		return fmt.Errorf("no documents matched when resetting user MFA, username: %v, err: %w", username, ErrNoDocumentsModified)
+	}
+	return nil
+}
@@ -0,0 +1,363 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"time"
+)
+
+const CollectionMigrations = "migrations"
+
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, db UserDatabase) error
+}
+
+type appliedMigration struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+// migrations must only be appended to, every migration must be safe to run again
+// since concurrently starting instances may run the same migration.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create unique index on users.username",
+		up: func(ctx context.Context, db UserDatabase) error {
+			_, err := db.Collection(CollectionUsers).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "username", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			})
+			return err
+		},
+	},
+	{
+		version: 2,
+		name:    "populate users.profile from JSON object users.info",
+		up:      populateProfileFromInfo,
+	},
+	{
+		version: 3,
+		name:    "create unique index on users.profile.email and index on users.emailVerification.tokenHash",
+		up: func(ctx context.Context, db UserDatabase) error {
+			// The emails populated from info were never checked for uniqueness
+			if err := clearDuplicateEmails(ctx, db); err != nil {
+				return err
+			}
+			_, err := db.Collection(CollectionUsers).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{
+					Keys: bson.D{{Key: "profile.email", Value: 1}},
+					// Partial so that Users without an email do not collide
+					Options: options.Index().SetUnique(true).SetPartialFilterExpression(
+						bson.M{"profile.email": bson.M{"$type": "string"}},
+					),
+				},
+				{
+					Keys:    bson.D{{Key: "emailVerification.tokenHash", Value: 1}},
+					Options: options.Index().SetSparse(true),
+				},
+			})
+			return err
+		},
+	},
+	{
+		version: 4,
+		name:    "create index on users.passwordReset.tokenHash",
+		up: func(ctx context.Context, db UserDatabase) error {
+			_, err := db.Collection(CollectionUsers).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "passwordReset.tokenHash", Value: 1}},
+				Options: options.Index().SetSparse(true),
+			})
+			return err
+		},
+	},
+	{
+		version: 5,
+		name:    "set users.passwordChangedAt so that password age counts from now",
+		up: func(ctx context.Context, db UserDatabase) error {
+			_, err := db.Collection(CollectionUsers).UpdateMany(ctx,
+				bson.M{"passwordChangedAt": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"passwordChangedAt": time.Now()}},
+			)
+			return err
+		},
+	},
+	{
+		version: 6,
+		name:    "create unique index on users.webauthnCredentials.id and TTL index on webauthnChallenges.expiresAt",
+		up: func(ctx context.Context, db UserDatabase) error {
+			_, err := db.Collection(CollectionUsers).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "webauthnCredentials.id", Value: 1}},
+				// Partial so that Users without credentials, or with none left, do not collide
+				Options: options.Index().SetUnique(true).SetPartialFilterExpression(
+					bson.M{"webauthnCredentials.id": bson.M{"$type": "binData"}},
+				),
+			})
+			if err != nil {
+				return err
+			}
+			_, err = db.Collection(CollectionWebAuthnChallenges).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			})
+			return err
+		},
+	},
+	{
+		version: 7,
+		name:    "create TTL index on loginThrottles.expiresAt",
+		up: func(ctx context.Context, db UserDatabase) error {
+			_, err := db.Collection(CollectionLoginThrottles).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			})
+			return err
+		},
+	},
+	{
+		version: 8,
+		name:    "create index on sessions.userId and TTL index on sessions.expiresAt",
+		up: func(ctx context.Context, db UserDatabase) error {
+			_, err := db.Collection(CollectionSessions).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "lastUsedAt", Value: -1}}},
+				{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+			})
+			return err
+		},
+	},
+	{
+		version: 9,
+		name:    "create indexes on auditEvents.subject and auditEvents.actorId",
+		up: func(ctx context.Context, db UserDatabase) error {
+			_, err := db.Collection(CollectionAuditEvents).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "subject", Value: 1}, {Key: "time", Value: -1}}},
+				{Keys: bson.D{{Key: "actorId", Value: 1}, {Key: "time", Value: -1}}},
+			})
+			return err
+		},
+	},
+	{
+		version: 10,
+		name:    "normalize users.username and create unique indexes on users.usernameSkeleton and case-insensitive users.username",
+		up:      normalizeUsernames,
+	},
+	{
+		version: 11,
+		name:    "normalize users.profile.email",
+		up:      normalizeEmails,
+	},
+	{
+		version: 12,
+		name:    "create sparse index on sessions.actorId",
+		up: func(ctx context.Context, db UserDatabase) error {
+			_, err := db.Collection(CollectionSessions).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "actorId", Value: 1}},
+				Options: options.Index().SetSparse(true),
+			})
+			return err
+		},
+	},
+	{
+		version: 13,
+		name:    "recompute users.usernameSkeleton without digits and Latin look-alikes",
+		up:      normalizeUsernames,
+	},
+}
+
+// Migrate applies the pending migrations in order and returns the names of the applied ones.
+func (db UserDatabase) Migrate(ctx context.Context) ([]string, error) {
+	var applied []appliedMigration
+	cur, err := db.Collection(CollectionMigrations).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting cursor to find applied migrations: %w", err)
+	}
+	if err = cur.All(ctx, &applied); err != nil {
+		return nil, fmt.Errorf("error getting applied migrations from cursor: %w", err)
+	}
+	done := make(map[int]bool)
+	for _, m := range applied {
+		done[m.Version] = true
+	}
+
+	var names []string
+	for _, m := range migrations {
+		if done[m.version] {
+			continue
+		}
+		if err := m.up(ctx, db); err != nil {
+			return names, fmt.Errorf("error applying migration %d: %s: %w", m.version, m.name, err)
+		}
+		_, err := db.Collection(CollectionMigrations).InsertOne(ctx, appliedMigration{
+			Version:   m.version,
+			Name:      m.name,
+			AppliedAt: time.Now(),
+		})
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return names, fmt.Errorf("error recording migration %d: %s: %w", m.version, m.name, err)
+		}
+		names = append(names, fmt.Sprintf("%d: %s", m.version, m.name))
+	}
+	return names, nil
+}
+
+// populateProfileFromInfo fills the profile of Users whose info is a JSON object, as some clients
+// encoded their profile in it, known profile fields are taken from it and everything else becomes attributes.
+// Info itself is left unchanged so that the legacy routes keep returning it.
+func populateProfileFromInfo(ctx context.Context, db UserDatabase) error {
+	cur, err := db.Collection(CollectionUsers).Find(ctx, bson.M{
+		"profile": bson.M{"$exists": false},
+		"info":    bson.M{"$regex": `^\s*\{`},
+	})
+	if err != nil {
+		return fmt.Errorf("error getting cursor to find Users with JSON info: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var u User
+		if err := cur.Decode(&u); err != nil {
+			return fmt.Errorf("error decoding User: %w", err)
+		}
+		p, ok := profileFromInfo(u.Info)
+		if !ok {
+			continue
+		}
+		_, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+			bson.M{"_id": u.ID, "profile": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"profile": p}},
+		)
+		if err != nil {
+			return fmt.Errorf("error setting profile of User with username: %s: %w", u.Username, err)
+		}
+	}
+	return cur.Err()
+}
+
+// emailDuplicate is a User whose email an earlier created User already has.
+type emailDuplicate struct {
+	user User
+	// owner is the username of the first created User with the email
+	owner string
+}
+
+// findEmailDuplicates returns the Users of us, which are in the order they were created, whose email
+// an earlier created User already has.
+func findEmailDuplicates(us []User) []emailDuplicate {
+	var ds []emailDuplicate
+	owners := make(map[string]string)
+	for _, u := range us {
+		if u.Profile.Email == "" {
+			continue
+		}
+		if owner, ok := owners[u.Profile.Email]; ok {
+			ds = append(ds, emailDuplicate{user: u, owner: owner})
+			continue
+		}
+		owners[u.Profile.Email] = u.Username
+	}
+	return ds
+}
+
+// clearDuplicateEmails removes the email of every User whose email an earlier created User already has,
+// so that the unique index on emails can be created. The removed emails are logged, as they are lost.
+func clearDuplicateEmails(ctx context.Context, db UserDatabase) error {
+	var us []User
+	cur, err := db.Collection(CollectionUsers).Find(ctx,
+		bson.M{"profile.email": bson.M{"$type": "string"}},
+		options.Find().SetProjection(bson.M{"username": 1, "profile.email": 1}).SetSort(bson.D{{Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return fmt.Errorf("error getting cursor to find Users with an email: %w", err)
+	}
+	if err = cur.All(ctx, &us); err != nil {
+		return fmt.Errorf("error getting Users with an email from cursor: %w", err)
+	}
+	for _, d := range findEmailDuplicates(us) {
+		_, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+			bson.M{"_id": d.user.ID, "profile.email": d.user.Profile.Email},
+			bson.M{"$unset": bson.M{"profile.email": ""}},
+		)
+		if err != nil {
+			return fmt.Errorf("error clearing duplicate email of User with username: %s: %w", d.user.Username, err)
+		}
+		log.Printf("Email of User with username: %s is also the email of User with username: %s, cleared: %s",
+			d.user.Username, d.owner, d.user.Profile.Email)
+	}
+	return nil
+}
+
+// normalizeEmails stores the emails in the form of NormalizeEmail, emails stored before they were normalized
+// would not be found. An email which differs from another only in case is left as it is and logged, as the
+// unique index refuses it, one of the Users has to change it.
+func normalizeEmails(ctx context.Context, db UserDatabase) error {
+	cur, err := db.Collection(CollectionUsers).Find(ctx,
+		bson.M{"profile.email": bson.M{"$type": "string"}},
+		options.Find().SetProjection(bson.M{"username": 1, "profile.email": 1}),
+	)
+	if err != nil {
+		return fmt.Errorf("error getting cursor to find Users with an email: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var u User
+		if err := cur.Decode(&u); err != nil {
+			return fmt.Errorf("error decoding User: %w", err)
+		}
+		email := NormalizeEmail(u.Profile.Email)
+		if email == u.Profile.Email {
+			continue
+		}
+		_, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+			bson.M{"_id": u.ID, "profile.email": u.Profile.Email},
+			bson.M{"$set": bson.M{"profile.email": email}},
+		)
+		if mongo.IsDuplicateKeyError(err) {
+			log.Printf("Email of User with username: %s only differs in case from the email of another, kept as it is: %s",
+				u.Username, u.Profile.Email)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error normalizing email of User with username: %s: %w", u.Username, err)
+		}
+	}
+	return cur.Err()
+}
+
+func profileFromInfo(info string) (Profile, bool) {
+	p := Profile{}
+	var m map[string]any
+	if err := json.Unmarshal([]byte(info), &m); err != nil {
+		return p, false
+	}
+	fields := map[string]*string{
+		"displayName": &p.DisplayName,
+		"email":       &p.Email,
+		"phone":       &p.Phone,
+		"locale":      &p.Locale,
+		"timezone":    &p.Timezone,
+		"avatarUrl":   &p.AvatarURL,
+	}
+	for k, v := range m {
+		if f, ok := fields[k]; ok {
+			if s, ok := v.(string); ok {
+				*f = s
+				continue
+			}
+		}
+		if p.Attributes == nil {
+			p.Attributes = make(map[string]any)
+		}
+		p.Attributes[k] = v
+	}
+	p.Email = NormalizeEmail(p.Email)
+	return p, true
+}
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"user@example.com", "user@example.com"},
+		{"User@Example.COM", "user@example.com"},
+		{"  user@example.com\t", "user@example.com"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeEmail(tt.email); got != tt.want {
+			t.Errorf("NormalizeEmail(%q) = %q, want %q", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestProfileFromInfo(t *testing.T) {
+	tests := []struct {
+		info string
+		want Profile
+		ok   bool
+	}{
+		{
+			info: `{"displayName":"Alice","email":"Alice@Example.com","team":"blue","age":30}`,
+			want: Profile{DisplayName: "Alice", Email: "alice@example.com", Attributes: map[string]any{"team": "blue", "age": float64(30)}},
+			ok:   true,
+		},
+		{info: `{"email":42}`, want: Profile{Attributes: map[string]any{"email": float64(42)}}, ok: true},
+		{info: `plain text info`},
+		{info: `{"displayName":`},
+	}
+	for _, tt := range tests {
+		got, ok := profileFromInfo(tt.info)
+		if ok != tt.ok || ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("profileFromInfo(%s) = %+v, %v, want %+v, %v", tt.info, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFindEmailDuplicates(t *testing.T) {
+	var us []User
+	for _, u := range []struct{ username, info string }{
+		{"alice", `{"email":"Shared@Example.com"}`},
+		{"bob", `{"email":"bob@example.com"}`},
+		{"carol", `{"email":"shared@example.com"}`},
+		{"dave", `plain text info`},
+		{"erin", `{"displayName":"Erin"}`},
+		{"frank", `{"email":"SHARED@example.com"}`},
+		{"grace", `{"email":"bob@example.com"}`},
+	} {
+		p, _ := profileFromInfo(u.info)
+		us = append(us, User{Username: u.username, Profile: p})
+	}
+
+	got := findEmailDuplicates(us)
+	want := []struct{ username, owner string }{{"carol", "alice"}, {"frank", "alice"}, {"grace", "bob"}}
+	if len(got) != len(want) {
+		t.Fatalf("findEmailDuplicates() = %+v, want %+v", got, want)
+	}
+	for i, w := range want {
+		if got[i].user.Username != w.username || got[i].owner != w.owner {
+			t.Errorf("duplicate %d = %s of %s, want %s of %s", i, got[i].user.Username, got[i].owner, w.username, w.owner)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const CollectionSessions = "sessions"
+
+// Session is a login of a User, the access tokens issued for it carry its ID in the sid claim
+// and are refused once it is deleted. It expires with the last of them.
+type Session struct {
+	ID        string    `bson:"_id"`
+	UserID    string    `bson:"userId"`
+	Device    string    `bson:"device"`
+	IP        string    `bson:"ip"`
+	UserAgent string    `bson:"userAgent"`
+	CreatedAt time.Time `bson:"createdAt"`
+	// IssuedAt is when the last access token of the Session was issued
+	IssuedAt   time.Time `bson:"issuedAt"`
+	LastUsedAt time.Time `bson:"lastUsedAt"`
+	ExpiresAt  time.Time `bson:"expiresAt"`
+	// ActorID is the admin impersonating the User in the Session, empty for logins of the User
+	ActorID string `bson:"actorId,omitempty"`
+}
+
+func (db UserDatabase) InsertSession(ctx context.Context, s Session) error {
+	if _, err := db.Collection(CollectionSessions).InsertOne(ctx, s); err != nil {
+		return fmt.Errorf("error inserting Session, userId: %v, err: %w", s.UserID, err)
+	}
+	return nil
+}
+
+// FindSession returns the unexpired Session with id, a revoked one is mongo.ErrNoDocuments.
+func (db UserDatabase) FindSession(ctx context.Context, id string, now time.Time) (Session, error) {
+	var s Session
+	err := db.Collection(CollectionSessions).FindOne(ctx, bson.M{"_id": id, "expiresAt": bson.M{"$gt": now}}).Decode(&s)
+	if err != nil {
+		return s, fmt.Errorf("error finding Session with ID: %s: %w", id, err)
+	}
+	return s, nil
+}
+
+// FindSessions returns the unexpired Sessions of the User with userID, the last used first.
+func (db UserDatabase) FindSessions(ctx context.Context, userID string, now time.Time) ([]Session, error) {
+	sessions := []Session{}
+	cur, err := db.Collection(CollectionSessions).Find(ctx,
+		bson.M{"userId": userID, "expiresAt": bson.M{"$gt": now}},
+		options.Find().SetSort(bson.D{{Key: "lastUsedAt", Value: -1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error getting cursor to find Sessions, userId: %v, err: %w", userID, err)
+	}
+	if err = cur.All(ctx, &sessions); err != nil {
+		return nil, fmt.Errorf("error getting Sessions from cursor, userId: %v, err: %w", userID, err)
+	}
+	return sessions, nil
+}
+
+// TouchSession sets when the Session with id was last used.
+func (db UserDatabase) TouchSession(ctx context.Context, id string, now time.Time) error {
+	_, err := db.Collection(CollectionSessions).UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"lastUsedAt": now}})
+	if err != nil {
+		return fmt.Errorf("error touching Session with ID: %s: %w", id, err)
+	}
+	return nil
+}
+
+// RenewSession records an access token issued for the Session at now which expires at expiresAt,
+// it fails with ErrNoDocumentsModified when the Session has been revoked.
+func (db UserDatabase) RenewSession(ctx context.Context, id string, userID string, now time.Time, expiresAt time.Time) error {
+	r, err := db.Collection(CollectionSessions).UpdateOne(ctx,
+		bson.M{"_id": id, "userId": userID, "expiresAt": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"issuedAt": now, "lastUsedAt": now, "expiresAt": expiresAt}},
+	)
+	if err != nil {
+		return fmt.Errorf("error renewing Session with ID: %s: %w", id, err)
+	}
+	if r.MatchedCount == 0 {
+		return fmt.Errorf("no documents matched when renewing Session with ID: %s: %w", id, ErrNoDocumentsModified)
+	}
+	return nil
+}
+
+// DeleteSession revokes the Session with id of the User with userID,
+// it fails with ErrNoDocumentsModified when the User has no such Session.
+func (db UserDatabase) DeleteSession(ctx context.Context, id string, userID string) error {
+	r, err := db.Collection(CollectionSessions).DeleteOne(ctx, bson.M{"_id": id, "userId": userID})
+	if err != nil {
+		return fmt.Errorf("error deleting Session with ID: %s: %w", id, err)
+	}
+	if r.DeletedCount == 0 {
+		return fmt.Errorf("no documents deleted when deleting Session with ID: %s: %w", id, ErrNoDocumentsModified)
+	}
+	return nil
+}
+
+// DeleteSessions revokes every Session of the User with userID, including those in which
+// the User impersonates others, and returns how many there were.
+func (db UserDatabase) DeleteSessions(ctx context.Context, userID string) (int64, error) {
+	r, err := db.Collection(CollectionSessions).DeleteMany(ctx, bson.M{"$or": bson.A{bson.M{"userId": userID}, bson.M{"actorId": userID}}})
+	if err != nil {
+		return 0, fmt.Errorf("error deleting Sessions, userId: %v, err: %w", userID, err)
+	}
+	return r.DeletedCount, nil
+}
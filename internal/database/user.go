@@ -2,22 +2,96 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/usernames"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+	"time"
 )
 
 type User struct {
 	ID       primitive.ObjectID `bson:"_id,omitempty" json:"-"`
 	Username string             `bson:"username" json:"username"`
-	Password []byte             `bson:"password" json:"-"`
-	Role     string             `bson:"role" json:"role"`
-	Info     string             `bson:"info" json:"info"`
+	// UsernameSkeleton is the skeleton of Username, which no other User can have so that none looks alike
+	UsernameSkeleton string `bson:"usernameSkeleton,omitempty" json:"-"`
+	// Password is a hash in one of the formats of passwordhash, it identifies its algorithm
+	Password []byte `bson:"password" json:"-"`
+	Role     string `bson:"role" json:"role"`
+	// Info is the legacy free-form profile, kept for the routes which predate Profile
+	Info    string  `bson:"info" json:"info"`
+	Profile Profile `bson:"profile" json:"profile"`
+	// EmailVerified is true once Profile.Email has been verified, it is reset when the email changes
+	EmailVerified     bool               `bson:"emailVerified" json:"emailVerified"`
+	EmailVerification *EmailVerification `bson:"emailVerification,omitempty" json:"-"`
+	PasswordReset     *PasswordReset     `bson:"passwordReset,omitempty" json:"-"`
+	// TokensValidAfter revokes the access tokens issued before it
+	TokensValidAfter time.Time `bson:"tokensValidAfter,omitempty" json:"-"`
+	// MustChangePassword limits logins to changing the password, it is cleared when the password is set
+	MustChangePassword bool      `bson:"mustChangePassword,omitempty" json:"mustChangePassword"`
+	PasswordChangedAt  time.Time `bson:"passwordChangedAt,omitempty" json:"-"`
+	// MFA is the second factor of the User, pending until confirmed
+	MFA *MFA `bson:"mfa,omitempty" json:"-"`
+	// WebAuthnCredentials are the passkeys of the User
+	WebAuthnCredentials []WebAuthnCredential `bson:"webauthnCredentials,omitempty" json:"-"`
 }
 
+// EmailVerification is a pending verification of Email, only the SHA-256 hash of the token is stored.
+type EmailVerification struct {
+	TokenHash []byte    `bson:"tokenHash"`
+	Email     string    `bson:"email"`
+	SentAt    time.Time `bson:"sentAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// PasswordReset is a pending password reset, only the SHA-256 hash of the token is stored.
+type PasswordReset struct {
+	TokenHash []byte    `bson:"tokenHash"`
+	SentAt    time.Time `bson:"sentAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// indexProfileEmail is the unique index on Profile.Email, named by default from its key
+const indexProfileEmail = "profile.email_1"
+
+type Profile struct {
+	DisplayName string `bson:"displayName,omitempty" json:"displayName,omitempty"`
+	Email       string `bson:"email,omitempty" json:"email,omitempty"`
+	Phone       string `bson:"phone,omitempty" json:"phone,omitempty"`
+	Locale      string `bson:"locale,omitempty" json:"locale,omitempty"`
+	Timezone    string `bson:"timezone,omitempty" json:"timezone,omitempty"`
+	AvatarURL   string `bson:"avatarUrl,omitempty" json:"avatarUrl,omitempty"`
+	// Attributes are custom fields validated against the configured JSON Schema
+	Attributes map[string]any `bson:"attributes,omitempty" json:"attributes,omitempty"`
+}
+
+// NormalizeEmail returns the form emails are stored and looked up by, emails are matched
+// case-insensitively as users type them in any case.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// IsZero reports whether p has no field set.
+func (p Profile) IsZero() bool {
+	return p.DisplayName == "" && p.Email == "" && p.Phone == "" && p.Locale == "" && p.Timezone == "" &&
+		p.AvatarURL == "" && len(p.Attributes) == 0
+}
+
+// InsertUser inserts u with its username normalized, a username which looks like an existing one
+// fails with ErrConfusableUsername and an existing one with a duplicate key error.
 func (db UserDatabase) InsertUser(ctx context.Context, u User) (string, error) {
+	if u.PasswordChangedAt.IsZero() {
+		u.PasswordChangedAt = time.Now()
+	}
+	normalizeUser(&u)
 	r, err := db.Collection(CollectionUsers).InsertOne(ctx, u)
 	if err != nil {
+		if isConfusableError(err) {
+			return "", fmt.Errorf("username: %v: %w", u.Username, ErrConfusableUsername)
+		}
 		return "", fmt.Errorf("error inserting User with username: %v: %w", u.Username, err)
 	}
 	return r.InsertedID.(primitive.ObjectID).Hex(), nil
@@ -38,13 +112,23 @@ func (db UserDatabase) FindUserByID(ctx context.Context, id string) (User, error
 
 func (db UserDatabase) FindUserByUsername(ctx context.Context, username string) (User, error) {
 	var u User
-	err := db.Collection(CollectionUsers).FindOne(ctx, bson.M{"username": username}).Decode(&u)
+	err := db.Collection(CollectionUsers).FindOne(ctx, bson.M{"username": usernames.Key(username)}).Decode(&u)
 	if err != nil {
 		return u, fmt.Errorf("error finding User with username: %s: %w", username, err)
 	}
 	return u, nil
 }
 
+// FindUserByEmail finds the User with the email, compared in the form of NormalizeEmail.
+func (db UserDatabase) FindUserByEmail(ctx context.Context, email string) (User, error) {
+	var u User
+	err := db.Collection(CollectionUsers).FindOne(ctx, bson.M{"profile.email": NormalizeEmail(email)}).Decode(&u)
+	if err != nil {
+		return u, fmt.Errorf("error finding User with email: %s: %w", email, err)
+	}
+	return u, nil
+}
+
 func (db UserDatabase) FindAllUsers(ctx context.Context) ([]User, error) {
 	var us []User
 	cur, err := db.Collection(CollectionUsers).Find(ctx, bson.M{})
@@ -57,10 +141,46 @@ func (db UserDatabase) FindAllUsers(ctx context.Context) ([]User, error) {
 	return us, nil
 }
 
-func (db UserDatabase) UpdateUserPassword(ctx context.Context, username string, password []byte) error {
+// FindTokensValidAfter returns the time before which access tokens of the user are revoked,
+// it is zero when the user doesn't exist, like for tokens minted for services.
+func (db UserDatabase) FindTokensValidAfter(ctx context.Context, id string) (time.Time, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return time.Time{}, nil
+	}
+	var u User
+	err = db.Collection(CollectionUsers).FindOne(ctx, bson.M{"_id": objID},
+		options.FindOne().SetProjection(bson.M{"tokensValidAfter": 1}),
+	).Decode(&u)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, fmt.Errorf("error finding tokensValidAfter of User with ID: %s: %w", id, err)
+	}
+	return u.TokensValidAfter, nil
+}
+
+// RevokeUserTokens revokes the access tokens of the User issued until now.
+func (db UserDatabase) RevokeUserTokens(ctx context.Context, username string, now time.Time) error {
 	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
-		bson.M{"username": username},
-		bson.M{"$set": bson.M{"password": password}},
+		bson.M{"username": usernames.Key(username)},
+		bson.M{"$set": bson.M{"tokensValidAfter": now}},
+	)
+	if err != nil {
+		return fmt.Errorf("error revoking User tokens, username: %v, err: %w", username, err)
+	}
+	if r.MatchedCount == 0 {
+		return fmt.Errorf("no documents matched when revoking user tokens, username: %v, err: %w", username, ErrNoDocumentsModified)
+	}
+	return nil
+}
+
+// UpdateUserPassword sets the password, with mustChange the User has to change it on the next login.
+func (db UserDatabase) UpdateUserPassword(ctx context.Context, username string, password []byte, mustChange bool) error {
+	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+		bson.M{"username": usernames.Key(username)},
+		db.setPassword(password, bson.M{"mustChangePassword": mustChange}),
 	)
 	if err != nil {
 		return fmt.Errorf("error updating User password, username: %v, err: %w", username, err)
@@ -71,9 +191,83 @@ func (db UserDatabase) UpdateUserPassword(ctx context.Context, username string,
 	return nil
 }
 
+// setPassword is a pipeline update setting password and the fields in set, the replaced
+// password is moved to the front of passwordHistory, which keeps at most PasswordHistorySize.
+// The password no longer has to be changed unless set says otherwise.
+func (db UserDatabase) setPassword(password []byte, set bson.M) mongo.Pipeline {
+	fields := bson.M{
+		"password":           bson.M{"$literal": password},
+		"passwordChangedAt":  time.Now(),
+		"mustChangePassword": false,
+	}
+	for k, v := range set {
+		fields[k] = v
+	}
+	if db.PasswordHistorySize <= 0 {
+		return mongo.Pipeline{
+			{{Key: "$set", Value: fields}},
+			{{Key: "$unset", Value: "passwordHistory"}},
+		}
+	}
+	// Fields of a $set stage are computed from the document before the stage, so $password is the replaced one
+	fields["passwordHistory"] = bson.M{"$slice": bson.A{
+		bson.M{"$concatArrays": bson.A{bson.A{"$password"}, bson.M{"$ifNull": bson.A{"$passwordHistory", bson.A{}}}}},
+		db.PasswordHistorySize,
+	}}
+	return mongo.Pipeline{{{Key: "$set", Value: fields}}}
+}
+
+// RehashUserPassword replaces the password hash with a new hash of the same password,
+// unless the password has been changed since oldHash was read.
+func (db UserDatabase) RehashUserPassword(ctx context.Context, username string, oldHash []byte, newHash []byte) error {
+	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+		bson.M{"username": usernames.Key(username), "password": oldHash},
+		bson.M{"$set": bson.M{"password": newHash}},
+	)
+	if err != nil {
+		return fmt.Errorf("error rehashing User password, username: %v, err: %w", username, err)
+	}
+	if r.ModifiedCount == 0 {
+		return fmt.Errorf("no documents modified when rehashing user password, username: %v, err: %w", username, ErrNoDocumentsModified)
+	}
+	return nil
+}
+
+func (db UserDatabase) UpdateUserMustChangePassword(ctx context.Context, username string, mustChange bool) error {
+	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+		bson.M{"username": usernames.Key(username)},
+		bson.M{"$set": bson.M{"mustChangePassword": mustChange}},
+	)
+	if err != nil {
+		return fmt.Errorf("error updating User mustChangePassword, username: %v, err: %w", username, err)
+	}
+	if r.MatchedCount == 0 {
+		return fmt.Errorf("no documents matched when updating user mustChangePassword, username: %v, err: %w", username, ErrNoDocumentsModified)
+	}
+	return nil
+}
+
+// FindPasswordHashes returns the current password hash of the User followed by the previous ones.
+func (db UserDatabase) FindPasswordHashes(ctx context.Context, username string) ([][]byte, error) {
+	var u struct {
+		Password        []byte   `bson:"password"`
+		PasswordHistory [][]byte `bson:"passwordHistory"`
+	}
+	err := db.Collection(CollectionUsers).FindOne(ctx, bson.M{"username": usernames.Key(username)},
+		options.FindOne().SetProjection(bson.M{"password": 1, "passwordHistory": 1}),
+	).Decode(&u)
+	if err != nil {
+		return nil, fmt.Errorf("error finding password hashes of User, username: %s: %w", username, err)
+	}
+	if len(u.PasswordHistory) > db.PasswordHistorySize {
+		u.PasswordHistory = u.PasswordHistory[:db.PasswordHistorySize]
+	}
+	return append([][]byte{u.Password}, u.PasswordHistory...), nil
+}
+
 func (db UserDatabase) UpdateUserInfo(ctx context.Context, username string, info string) error {
 	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
-		bson.M{"username": username},
+		bson.M{"username": usernames.Key(username)},
 		bson.M{"$set": bson.M{"info": info}},
 	)
 	if err != nil {
@@ -85,24 +279,222 @@ func (db UserDatabase) UpdateUserInfo(ctx context.Context, username string, info
 	return nil
 }
 
+// UpdateUserRole sets the role, demoting the last admin fails with ErrLastAdmin.
 func (db UserDatabase) UpdateUserRole(ctx context.Context, username string, role string) error {
+	update := func() error {
+		r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+			bson.M{"username": usernames.Key(username)},
+			bson.M{"$set": bson.M{"role": role}},
+		)
+		if err != nil {
+			return fmt.Errorf("error updating User role, username: %v, role: %v, err: %w", username, role, err)
+		}
+		if r.ModifiedCount == 0 {
+			return fmt.Errorf("no documents modified when updating user role, username: %v, role: %v, err: %w", username, role, ErrNoDocumentsModified)
+		}
+		return nil
+	}
+	if role == roleAdmin {
+		return update()
+	}
+	return db.WithLock(ctx, lockAdmins, func() error {
+		if err := db.checkNotLastAdmin(ctx, username); err != nil {
+			return err
+		}
+		return update()
+	})
+}
+
+// UpdateUserProfile sets the profile with its email normalized, the email verification is reset
+// when the email is changed.
+func (db UserDatabase) UpdateUserProfile(ctx context.Context, username string, profile Profile) error {
+	profile.Email = NormalizeEmail(profile.Email)
+	// Pipeline update so the email can be compared with the stored one in the same write
+	emailChanged := bson.M{"$ne": bson.A{"$profile.email", profile.Email}}
 	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
-		bson.M{"username": username},
-		bson.M{"$set": bson.M{"role": role}},
+		bson.M{"username": usernames.Key(username)},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{
+				"emailVerified":     bson.M{"$cond": bson.A{emailChanged, false, "$emailVerified"}},
+				"emailVerification": bson.M{"$cond": bson.A{emailChanged, "$$REMOVE", "$emailVerification"}},
+			}}},
+			{{Key: "$set", Value: bson.M{"profile": bson.M{"$literal": profile}}}},
+		},
 	)
 	if err != nil {
-		return fmt.Errorf("error updating User role, username: %v, role: %v, err: %w", username, role, err)
+		return fmt.Errorf("error updating User profile, username: %v, err: %w", username, err)
 	}
 	if r.ModifiedCount == 0 {
-		return fmt.Errorf("no documents modified when updating user role, username: %v, role: %v, err: %w", username, role, ErrNoDocumentsModified)
+		return fmt.Errorf("no documents modified when updating user profile, username: %v, err: %w", username, ErrNoDocumentsModified)
 	}
 	return nil
 }
 
+func (db UserDatabase) SetEmailVerification(ctx context.Context, username string, ev EmailVerification) error {
+	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+		bson.M{"username": usernames.Key(username), "profile.email": ev.Email},
+		bson.M{"$set": bson.M{"emailVerification": ev}},
+	)
+	if err != nil {
+		return fmt.Errorf("error setting User email verification, username: %v, err: %w", username, err)
+	}
+	if r.ModifiedCount == 0 {
+		return fmt.Errorf("no documents modified when setting user email verification, username: %v, err: %w", username, ErrNoDocumentsModified)
+	}
+	return nil
+}
+
+// ConfirmEmailVerification marks the email of the User with the unexpired token as verified,
+// the token is consumed so it can only be used once.
+func (db UserDatabase) ConfirmEmailVerification(ctx context.Context, tokenHash []byte, now time.Time) (User, error) {
+	var u User
+	err := db.Collection(CollectionUsers).FindOneAndUpdate(ctx,
+		bson.M{
+			"emailVerification.tokenHash": tokenHash,
+			"emailVerification.expiresAt": bson.M{"$gt": now},
+			"$expr":                       bson.M{"$eq": bson.A{"$profile.email", "$emailVerification.email"}},
+		},
+		bson.M{
+			"$set":   bson.M{"emailVerified": true},
+			"$unset": bson.M{"emailVerification": ""},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&u)
+	if err != nil {
+		return u, fmt.Errorf("error confirming User email verification: %w", err)
+	}
+	return u, nil
+}
+
+// DeleteUserByUsername deletes the User and its Sessions, deleting the last admin fails with ErrLastAdmin.
 func (db UserDatabase) DeleteUserByUsername(ctx context.Context, username string) error {
-	_, err := db.Collection(CollectionUsers).DeleteOne(ctx, bson.M{"username": username})
+	return db.WithLock(ctx, lockAdmins, func() error {
+		if err := db.checkNotLastAdmin(ctx, username); err != nil {
+			return err
+		}
+		var u User
+		err := db.Collection(CollectionUsers).FindOneAndDelete(ctx, bson.M{"username": usernames.Key(username)},
+			options.FindOneAndDelete().SetProjection(bson.M{"_id": 1}),
+		).Decode(&u)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return fmt.Errorf("no documents deleted when deleting user, username: %v, err: %w", username, ErrNoDocumentsModified)
+			}
+			return fmt.Errorf("error deleting User with username: %s: %w", username, err)
+		}
+		if _, err := db.DeleteSessions(ctx, u.ID.Hex()); err != nil {
+			return fmt.Errorf("error deleting Sessions of deleted User with username: %s: %w", username, err)
+		}
+		return nil
+	})
+}
+
+// InsertUsers inserts us unordered so that one failing User does not stop the others.
+// The returned slice holds the error of each User by index, nil for inserted ones,
+// a duplicate username is reported as ErrDuplicateUsername and a look-alike as ErrConfusableUsername.
+func (db UserDatabase) InsertUsers(ctx context.Context, us []User) ([]error, error) {
+	docs := make([]any, len(us))
+	now := time.Now()
+	for i, u := range us {
+		if u.PasswordChangedAt.IsZero() {
+			u.PasswordChangedAt = now
+		}
+		normalizeUser(&u)
+		docs[i] = u
+	}
+	errs := make([]error, len(us))
+	_, err := db.Collection(CollectionUsers).InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
 	if err != nil {
-		return fmt.Errorf("error deleting User with username: %s: %w", username, err)
+		var bwe mongo.BulkWriteException
+		if !errors.As(err, &bwe) || bwe.WriteConcernError != nil {
+			return nil, fmt.Errorf("error inserting %d Users: %w", len(us), err)
+		}
+		for _, we := range bwe.WriteErrors {
+			if we.Code == 11000 && strings.Contains(we.Message, indexUsernameSkeleton) {
+				errs[we.Index] = fmt.Errorf("username: %s: %w", us[we.Index].Username, ErrConfusableUsername)
+			} else if we.Code == 11000 && strings.Contains(we.Message, indexProfileEmail) {
+				errs[we.Index] = fmt.Errorf("username: %s: %w", us[we.Index].Username, ErrDuplicateEmail)
+			} else if we.Code == 11000 {
+				errs[we.Index] = fmt.Errorf("username: %s: %w", us[we.Index].Username, ErrDuplicateUsername)
+			} else {
+				errs[we.Index] = fmt.Errorf("error inserting User with username: %s: %w", us[we.Index].Username, we)
+			}
+		}
+	}
+	return errs, nil
+}
+
+// FindExistingUsernames returns which of names already exist, by their canonical forms.
+func (db UserDatabase) FindExistingUsernames(ctx context.Context, names []string) (map[string]bool, error) {
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = usernames.Key(name)
+	}
+	cur, err := db.Collection(CollectionUsers).Find(ctx,
+		bson.M{"username": bson.M{"$in": keys}},
+		options.Find().SetProjection(bson.M{"username": 1}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error getting cursor to find existing usernames: %w", err)
+	}
+	var us []User
+	if err = cur.All(ctx, &us); err != nil {
+		return nil, fmt.Errorf("error getting existing usernames from cursor: %w", err)
+	}
+	existing := make(map[string]bool)
+	for _, u := range us {
+		existing[u.Username] = true
+	}
+	return existing, nil
+}
+
+// SetPasswordReset replaces any pending password reset of the user.
+func (db UserDatabase) SetPasswordReset(ctx context.Context, username string, pr PasswordReset) error {
+	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+		bson.M{"username": usernames.Key(username)},
+		bson.M{"$set": bson.M{"passwordReset": pr}},
+	)
+	if err != nil {
+		return fmt.Errorf("error setting User password reset, username: %v, err: %w", username, err)
+	}
+	if r.MatchedCount == 0 {
+		return fmt.Errorf("no documents matched when setting user password reset, username: %v, err: %w", username, ErrNoDocumentsModified)
 	}
 	return nil
 }
+
+func (db UserDatabase) FindUserByPasswordResetToken(ctx context.Context, tokenHash []byte, now time.Time) (User, error) {
+	var u User
+	err := db.Collection(CollectionUsers).FindOne(ctx, bson.M{
+		"passwordReset.tokenHash": tokenHash,
+		"passwordReset.expiresAt": bson.M{"$gt": now},
+	}).Decode(&u)
+	if err != nil {
+		return u, fmt.Errorf("error finding User by password reset token: %w", err)
+	}
+	return u, nil
+}
+
+// ResetPassword consumes the password reset token with tokenHash, sets the password
+// and revokes the access tokens issued until now and the Sessions.
+func (db UserDatabase) ResetPassword(ctx context.Context, tokenHash []byte, password []byte, now time.Time) (User, error) {
+	var u User
+	err := db.Collection(CollectionUsers).FindOneAndUpdate(ctx,
+		bson.M{
+			"passwordReset.tokenHash": tokenHash,
+			"passwordReset.expiresAt": bson.M{"$gt": now},
+		},
+		append(db.setPassword(password, bson.M{"tokensValidAfter": now}),
+			bson.D{{Key: "$unset", Value: "passwordReset"}},
+		),
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&u)
+	if err != nil {
+		return u, fmt.Errorf("error resetting User password: %w", err)
+	}
+	// The access tokens of the Sessions are already refused by tokensValidAfter
+	if _, err := db.DeleteSessions(ctx, u.ID.Hex()); err != nil {
+		return u, fmt.Errorf("error revoking Sessions after resetting User password: %w", err)
+	}
+	return u, nil
+}
@@ -0,0 +1,247 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/usernames"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"sort"
+	"strings"
+)
+
+const (
+	// indexUsernameSkeleton is unique so that a username can't look like an existing one
+	indexUsernameSkeleton = "usernameSkeleton_1"
+	// indexUsernameCollation is unique for usernames which only differ in case, in case a username
+	// is written without being normalized. It can only be created once there are no collisions.
+	indexUsernameCollation = "username_ci"
+)
+
+// UsernameCollision is a canonical form or a skeleton shared by several usernames.
+type UsernameCollision struct {
+	Key       string
+	Usernames []string
+}
+
+func (c UsernameCollision) String() string {
+	return fmt.Sprintf("%s (%s)", c.Key, strings.Join(c.Usernames, ", "))
+}
+
+// UsernameReport lists the usernames stored before they were normalized which conflict.
+type UsernameReport struct {
+	// Collisions have the same canonical form, all but one of each have to be renamed
+	Collisions []UsernameCollision
+	// Confusables look alike, only the first created of each keeps the skeleton
+	Confusables []UsernameCollision
+	// Invalid aren't allowed by the PRECIS profile, they are kept as they are
+	Invalid []string
+}
+
+// normalizedUser is a User with the canonical form and the skeleton of its username.
+type normalizedUser struct {
+	id       primitive.ObjectID
+	username string
+	key      string
+	skeleton string
+	// storedSkeleton is the skeleton stored by an earlier normalization, if any
+	storedSkeleton string
+	// collides is whether other Users have the same canonical form
+	collides bool
+	// owner is whether the User is the first created with the skeleton
+	owner bool
+}
+
+// normalizeUser sets the canonical form and the skeleton of the username of u, and normalizes its email.
+func normalizeUser(u *User) {
+	u.Username = usernames.Key(u.Username)
+	u.UsernameSkeleton = usernames.Skeleton(u.Username)
+	u.Profile.Email = NormalizeEmail(u.Profile.Email)
+}
+
+// findUsernames returns the usernames and skeletons of every User, in the order they were created.
+func (db UserDatabase) findUsernames(ctx context.Context) ([]User, error) {
+	var us []User
+	cur, err := db.Collection(CollectionUsers).Find(ctx, bson.M{},
+		options.Find().SetProjection(bson.M{"username": 1, "usernameSkeleton": 1}).SetSort(bson.D{{Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error getting cursor to find usernames: %w", err)
+	}
+	if err = cur.All(ctx, &us); err != nil {
+		return nil, fmt.Errorf("error getting usernames from cursor: %w", err)
+	}
+	return us, nil
+}
+
+// planUsernames normalizes the usernames of us, which are in the order they were created. Only the first
+// created User of each skeleton owns it, Users whose canonical form collides own none.
+func planUsernames(us []User) ([]normalizedUser, UsernameReport) {
+	var report UsernameReport
+	nus := make([]normalizedUser, len(us))
+	byKey := make(map[string][]string)
+	for i, u := range us {
+		key, err := usernames.Normalize(u.Username)
+		if err != nil {
+			report.Invalid = append(report.Invalid, u.Username)
+			key = u.Username
+		}
+		nus[i] = normalizedUser{
+			id: u.ID, username: u.Username, key: key, skeleton: usernames.Skeleton(key), storedSkeleton: u.UsernameSkeleton,
+		}
+		byKey[key] = append(byKey[key], u.Username)
+	}
+
+	bySkeleton := make(map[string][]string)
+	for i, nu := range nus {
+		if len(byKey[nu.key]) > 1 {
+			nus[i].collides = true
+			continue
+		}
+		nus[i].owner = len(bySkeleton[nu.skeleton]) == 0
+		bySkeleton[nu.skeleton] = append(bySkeleton[nu.skeleton], nu.key)
+	}
+	report.Collisions = collisions(byKey)
+	report.Confusables = collisions(bySkeleton)
+	return nus, report
+}
+
+func collisions(m map[string][]string) []UsernameCollision {
+	var cs []UsernameCollision
+	for key, names := range m {
+		if len(names) > 1 {
+			cs = append(cs, UsernameCollision{Key: key, Usernames: names})
+		}
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Key < cs[j].Key })
+	return cs
+}
+
+// FindUsernameCollisions reports the usernames which conflict once normalized.
+func (db UserDatabase) FindUsernameCollisions(ctx context.Context) (UsernameReport, error) {
+	us, err := db.findUsernames(ctx)
+	if err != nil {
+		return UsernameReport{}, err
+	}
+	_, report := planUsernames(us)
+	return report, nil
+}
+
+// RenameUser renames the User whose stored username is exactly username, so that Users whose usernames
+// are kept as they are by normalizeUsernames, which the lookups by canonical form can't find, can be renamed.
+// newUsername is stored in its canonical form with its skeleton, a look-alike fails with ErrConfusableUsername.
+func (db UserDatabase) RenameUser(ctx context.Context, username string, newUsername string) error {
+	key := usernames.Key(newUsername)
+	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+		bson.M{"username": username},
+		bson.M{"$set": bson.M{"username": key, "usernameSkeleton": usernames.Skeleton(key)}},
+	)
+	if err != nil {
+		if isConfusableError(err) {
+			return fmt.Errorf("username: %v: %w", key, ErrConfusableUsername)
+		}
+		return fmt.Errorf("error renaming User with username: %v to: %v: %w", username, key, err)
+	}
+	if r.MatchedCount == 0 {
+		return fmt.Errorf("no documents matched when renaming user, username: %v, err: %w", username, ErrNoDocumentsModified)
+	}
+	return nil
+}
+
+// CreateUsernameCollationIndex creates the unique case-insensitive index on usernames, which
+// normalizeUsernames skips while there are collisions. It fails while there still are any.
+func (db UserDatabase) CreateUsernameCollationIndex(ctx context.Context) error {
+	_, err := db.Collection(CollectionUsers).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetName(indexUsernameCollation).SetUnique(true).SetCollation(
+			&options.Collation{Locale: "en", Strength: 2},
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating case-insensitive index on usernames: %w", err)
+	}
+	return nil
+}
+
+// normalizeUsernames stores the canonical forms of usernames and the skeletons, and creates the unique
+// indexes on them. It can be applied again to recompute the skeletons. Collisions, look-alikes and invalid
+// usernames are logged rather than failing the migration: colliding usernames are kept as they are and
+// the case-insensitive index is skipped until they have been renamed, see RenameUser and CreateUsernameCollationIndex.
+func normalizeUsernames(ctx context.Context, db UserDatabase) error {
+	us, err := db.findUsernames(ctx)
+	if err != nil {
+		return err
+	}
+	nus, report := planUsernames(us)
+	for _, c := range report.Confusables {
+		log.Printf("Usernames look alike, only the first created is kept from new look-alikes: %s", c)
+	}
+	if len(report.Invalid) > 0 {
+		log.Printf("Usernames not allowed by the PRECIS profile, kept as they are: %s", strings.Join(report.Invalid, ", "))
+	}
+
+	// Skeletons which are no longer owned are removed first, so that a stored skeleton can't collide with
+	// the new skeleton of another User while the unique index exists from an earlier normalization
+	users := db.Collection(CollectionUsers)
+	for _, nu := range nus {
+		if nu.storedSkeleton == "" || nu.owner && nu.storedSkeleton == nu.skeleton {
+			continue
+		}
+		if _, err := users.UpdateOne(ctx, bson.M{"_id": nu.id}, bson.M{"$unset": bson.M{"usernameSkeleton": ""}}); err != nil {
+			return fmt.Errorf("error removing username skeleton: %s: %w", nu.username, err)
+		}
+	}
+	for _, nu := range nus {
+		set := bson.M{}
+		if nu.key != nu.username && !nu.collides {
+			set["username"] = nu.key
+		}
+		if nu.owner && nu.storedSkeleton != nu.skeleton {
+			set["usernameSkeleton"] = nu.skeleton
+		}
+		if len(set) == 0 {
+			continue
+		}
+		_, err := users.UpdateOne(ctx, bson.M{"_id": nu.id}, bson.M{"$set": set})
+		if isConfusableError(err) {
+			// A look-alike created since the usernames were read has taken the skeleton
+			log.Printf("Username looks like a username created meanwhile, stored without skeleton: %s", nu.username)
+			delete(set, "usernameSkeleton")
+			if len(set) == 0 {
+				continue
+			}
+			_, err = users.UpdateOne(ctx, bson.M{"_id": nu.id}, bson.M{"$set": set})
+		}
+		if err != nil {
+			return fmt.Errorf("error normalizing username: %s: %w", nu.username, err)
+		}
+	}
+
+	_, err = users.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "usernameSkeleton", Value: 1}},
+		Options: options.Index().SetName(indexUsernameSkeleton).SetUnique(true).SetPartialFilterExpression(
+			bson.M{"usernameSkeleton": bson.M{"$type": "string"}},
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating unique index on username skeletons: %w", err)
+	}
+	if len(report.Collisions) > 0 {
+		names := make([]string, len(report.Collisions))
+		for i, c := range report.Collisions {
+			names[i] = c.String()
+		}
+		log.Printf("Usernames which only differ in case or normalization, kept as they are and the case-insensitive index "+
+			"is not created, rename all but one of each with admin usernames rename and run admin usernames collisions: %s", strings.Join(names, "; "))
+		return nil
+	}
+	return db.CreateUsernameCollationIndex(ctx)
+}
+
+// isConfusableError reports whether err is a duplicate key error of indexUsernameSkeleton.
+func isConfusableError(err error) bool {
+	return mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), indexUsernameSkeleton)
+}
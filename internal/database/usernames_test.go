@@ -0,0 +1,57 @@
+package database
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"testing"
+)
+
+func TestPlanUsernames(t *testing.T) {
+	us := []User{
+		{Username: "Alice"},
+		{Username: "alice"},
+		{Username: "paypal", UsernameSkeleton: "paypal"},
+		{Username: "раураl"},
+		{Username: "user1", UsernameSkeleton: "userl"},
+		{Username: "userl"},
+		{Username: "al ice"},
+	}
+	for i := range us {
+		us[i].ID = primitive.NewObjectID()
+	}
+	nus, report := planUsernames(us)
+
+	want := []struct {
+		key      string
+		skeleton string
+		collides bool
+		owner    bool
+	}{
+		{key: "alice", skeleton: "alice", collides: true},
+		{key: "alice", skeleton: "alice", collides: true},
+		{key: "paypal", skeleton: "paypal", owner: true},
+		{key: "раураl", skeleton: "paypal"},
+		{key: "user1", skeleton: "user1", owner: true},
+		{key: "userl", skeleton: "userl", owner: true},
+		{key: "al ice", skeleton: "al ice", owner: true},
+	}
+	for i, w := range want {
+		nu := nus[i]
+		if nu.id != us[i].ID || nu.username != us[i].Username || nu.storedSkeleton != us[i].UsernameSkeleton {
+			t.Errorf("%s: planned %+v, want the ID, username and stored skeleton of the User", us[i].Username, nu)
+		}
+		if nu.key != w.key || nu.skeleton != w.skeleton || nu.collides != w.collides || nu.owner != w.owner {
+			t.Errorf("%s: planned key %q, skeleton %q, collides %v, owner %v, want %+v",
+				us[i].Username, nu.key, nu.skeleton, nu.collides, nu.owner, w)
+		}
+	}
+
+	wantReport := UsernameReport{
+		Collisions:  []UsernameCollision{{Key: "alice", Usernames: []string{"Alice", "alice"}}},
+		Confusables: []UsernameCollision{{Key: "paypal", Usernames: []string{"paypal", "раураl"}}},
+		Invalid:     []string{"al ice"},
+	}
+	if !reflect.DeepEqual(report, wantReport) {
+		t.Errorf("planUsernames() report = %+v, want %+v", report, wantReport)
+	}
+}
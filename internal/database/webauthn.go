@@ -0,0 +1,126 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/usernames"
+	"go.mongodb.org/mongo-driver/bson"
+	"time"
+)
+
+const CollectionWebAuthnChallenges = "webauthnChallenges"
+
+const (
+	WebAuthnRegistration = "registration"
+	WebAuthnLogin        = "login"
+)
+
+// WebAuthnCredential is a passkey, PublicKey is in its COSE form.
+type WebAuthnCredential struct {
+	ID         []byte    `bson:"id"`
+	Name       string    `bson:"name"`
+	PublicKey  []byte    `bson:"publicKey"`
+	SignCount  uint32    `bson:"signCount"`
+	AAGUID     []byte    `bson:"aaguid"`
+	Transports []string  `bson:"transports,omitempty"`
+	CreatedAt  time.Time `bson:"createdAt"`
+	LastUsedAt time.Time `bson:"lastUsedAt,omitempty"`
+}
+
+// WebAuthnChallenge is a pending ceremony, only the SHA-256 hash of the challenge is stored.
+// UserID is only set for registrations, logins find the User by the credential.
+type WebAuthnChallenge struct {
+	ChallengeHash []byte    `bson:"_id"`
+	Ceremony      string    `bson:"ceremony"`
+	UserID        string    `bson:"userId,omitempty"`
+	ExpiresAt     time.Time `bson:"expiresAt"`
+}
+
+func (db UserDatabase) InsertWebAuthnChallenge(ctx context.Context, c WebAuthnChallenge) error {
+	if _, err := db.Collection(CollectionWebAuthnChallenges).InsertOne(ctx, c); err != nil {
+		return fmt.Errorf("error inserting WebAuthn challenge: %w", err)
+	}
+	return nil
+}
+
+// ConsumeWebAuthnChallenge deletes and returns the unexpired challenge with challengeHash of ceremony,
+// so that every challenge is used once. Expired challenges are removed by a TTL index.
+func (db UserDatabase) ConsumeWebAuthnChallenge(ctx context.Context, challengeHash []byte, ceremony string, now time.Time) (WebAuthnChallenge, error) {
+	var c WebAuthnChallenge
+	err := db.Collection(CollectionWebAuthnChallenges).FindOneAndDelete(ctx, bson.M{
+		"_id":       challengeHash,
+		"ceremony":  ceremony,
+		"expiresAt": bson.M{"$gt": now},
+	}).Decode(&c)
+	if err != nil {
+		return c, fmt.Errorf("error consuming WebAuthn challenge: %w", err)
+	}
+	return c, nil
+}
+
+// AddWebAuthnCredential adds c to the credentials of the User unless it already has max of them,
+// a credential ID registered for any User is a duplicate key error.
+func (db UserDatabase) AddWebAuthnCredential(ctx context.Context, username string, c WebAuthnCredential, max int) error {
+	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+		bson.M{
+			"username": usernames.Key(username),
+			"$expr": bson.M{"$lt": bson.A{
+				bson.M{"$size": bson.M{"$ifNull": bson.A{"$webauthnCredentials", bson.A{}}}},
+				max,
+			}},
+		},
+		bson.M{"$push": bson.M{"webauthnCredentials": c}},
+	)
+	if err != nil {
+		return fmt.Errorf("error adding User WebAuthn credential, username: %v, err: %w", username, err)
+	}
+	if r.ModifiedCount == 0 {
+		return fmt.Errorf("no documents modified when adding user WebAuthn credential, username: %v, err: %w", username, ErrNoDocumentsModified)
+	}
+	return nil
+}
+
+func (db UserDatabase) FindUserByWebAuthnCredential(ctx context.Context, credentialID []byte) (User, error) {
+	var u User
+	err := db.Collection(CollectionUsers).FindOne(ctx, bson.M{"webauthnCredentials.id": credentialID}).Decode(&u)
+	if err != nil {
+		return u, fmt.Errorf("error finding User by WebAuthn credential: %w", err)
+	}
+	return u, nil
+}
+
+// UseWebAuthnCredential records an authentication with the credential, unless another one
+// has changed its signCount since oldSignCount was read.
+func (db UserDatabase) UseWebAuthnCredential(ctx context.Context, username string, credentialID []byte, oldSignCount uint32, newSignCount uint32, now time.Time) error {
+	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+		bson.M{
+			"username":            usernames.Key(username),
+			"webauthnCredentials": bson.M{"$elemMatch": bson.M{"id": credentialID, "signCount": oldSignCount}},
+		},
+		bson.M{"$set": bson.M{
+			"webauthnCredentials.$.signCount":  newSignCount,
+			"webauthnCredentials.$.lastUsedAt": now,
+		}},
+	)
+	if err != nil {
+		return fmt.Errorf("error using User WebAuthn credential, username: %v, err: %w", username, err)
+	}
+	if r.MatchedCount == 0 {
+		return fmt.Errorf("no documents matched when using user WebAuthn credential, username: %v, err: %w", username, ErrNoDocumentsModified)
+	}
+	return nil
+}
+
+func (db UserDatabase) DeleteWebAuthnCredential(ctx context.Context, username string, credentialID []byte) error {
+	r, err := db.Collection(CollectionUsers).UpdateOne(ctx,
+		bson.M{"username": usernames.Key(username), "webauthnCredentials.id": credentialID},
+		bson.M{"$pull": bson.M{"webauthnCredentials": bson.M{"id": credentialID}}},
+	)
+	if err != nil {
+		return fmt.Errorf("error deleting User WebAuthn credential, username: %v, err: %w", username, err)
+	}
+	if r.ModifiedCount == 0 {
+		return fmt.Errorf("no documents modified when deleting user WebAuthn credential, username: %v, err: %w", username, ErrNoDocumentsModified)
+	}
+	return nil
+}
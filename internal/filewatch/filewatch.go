@@ -0,0 +1,75 @@
+package filewatch
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Watch calls onChange when any of files changes until ctx is done, changes within debounce are coalesced.
+// The parent directories are watched rather than the files themselves so that files replaced
+// by rename or by symlink swap, as done for Kubernetes secrets and config maps, are also picked up.
+// Events for other files in the directories are ignored by comparing the files' size and modification time.
+func Watch(ctx context.Context, files []string, debounce time.Duration, onChange func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating file watcher: %w", err)
+	}
+	defer w.Close()
+
+	dirs := make(map[string]struct{})
+	for _, f := range files {
+		dirs[filepath.Dir(f)] = struct{}{}
+	}
+	for d := range dirs {
+		if err := w.Add(d); err != nil {
+			return fmt.Errorf("error watching directory: %s: %w", d, err)
+		}
+	}
+
+	last := fingerprint(files)
+	t := time.NewTimer(debounce)
+	t.Stop()
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+			t.Reset(debounce)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("filewatch: File watcher error, err: %v", err)
+		case <-t.C:
+			if fp := fingerprint(files); fp != last {
+				last = fp
+				onChange()
+			}
+		}
+	}
+}
+
+func fingerprint(files []string) string {
+	fp := ""
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			fp += fmt.Sprintf("%s:%d:%d;", f, fi.Size(), fi.ModTime().UnixNano())
+		} else {
+			fp += f + ":missing;"
+		}
+	}
+	return fp
+}
@@ -0,0 +1,347 @@
+// Package jsonschema validates JSON values against the subset of JSON Schema used for
+// profile attributes: type, enum, const, properties, required, additionalProperties,
+// minProperties, maxProperties, items, minItems, maxItems, minLength, maxLength, pattern,
+// minimum, maximum and format (email, uri, date-time). Unsupported keywords are rejected
+// when compiling rather than silently ignored.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type Schema struct {
+	Type                 typeList           `json:"type"`
+	Enum                 []any              `json:"enum"`
+	Const                *any               `json:"const"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *additional        `json:"additionalProperties"`
+	MinProperties        *int               `json:"minProperties"`
+	MaxProperties        *int               `json:"maxProperties"`
+	Items                *Schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Pattern              string             `json:"pattern"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	Format               string             `json:"format"`
+
+	pattern *regexp.Regexp
+}
+
+var annotations = map[string]bool{"$schema": true, "$id": true, "title": true, "description": true, "default": true, "examples": true, "$comment": true}
+
+// typeList is a JSON Schema type, a single type name or a list of them.
+type typeList []string
+
+func (t *typeList) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*t = typeList{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("type should be a string or an array of strings")
+	}
+	*t = list
+	return nil
+}
+
+// additional is additionalProperties, either a boolean or a schema.
+type additional struct {
+	allowed bool
+	schema  *Schema
+}
+
+func (a *additional) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &a.allowed); err == nil {
+		return nil
+	}
+	a.allowed = true
+	a.schema = &Schema{}
+	return json.Unmarshal(b, a.schema)
+}
+
+func Load(path string) (*Schema, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JSON Schema: %s: %w", path, err)
+	}
+	s, err := Compile(b)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling JSON Schema: %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func Compile(b []byte) (*Schema, error) {
+	s := &Schema{}
+	if err := s.compile(b, ""); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Schema) compile(b []byte, path string) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return fmt.Errorf("%s: schema should be an object: %w", pathOrRoot(path), err)
+	}
+	known := make(map[string]bool)
+	t := reflect.TypeOf(*s)
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("json"); tag != "" {
+			known[tag] = true
+		}
+	}
+	var unsupported []string
+	for k := range raw {
+		if !known[k] && !annotations[k] {
+			unsupported = append(unsupported, k)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("%s: unsupported keywords: %v", pathOrRoot(path), unsupported)
+	}
+
+	if err := json.Unmarshal(b, s); err != nil {
+		return fmt.Errorf("%s: %w", pathOrRoot(path), err)
+	}
+	for _, typ := range s.Type {
+		switch typ {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return fmt.Errorf("%s: unknown type: %s", pathOrRoot(path), typ)
+		}
+	}
+	switch s.Format {
+	case "", "email", "uri", "date-time":
+	default:
+		return fmt.Errorf("%s: unsupported format: %s", pathOrRoot(path), s.Format)
+	}
+	if s.Pattern != "" {
+		p, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern: %w", pathOrRoot(path), err)
+		}
+		s.pattern = p
+	}
+
+	// Nested schemas are compiled again from their raw form so that they are checked the same way
+	var nested struct {
+		Properties           map[string]json.RawMessage `json:"properties"`
+		AdditionalProperties json.RawMessage            `json:"additionalProperties"`
+		Items                json.RawMessage            `json:"items"`
+	}
+	_ = json.Unmarshal(b, &nested)
+	for name, pb := range nested.Properties {
+		ps := &Schema{}
+		if err := ps.compile(pb, path+"/properties/"+name); err != nil {
+			return err
+		}
+		s.Properties[name] = ps
+	}
+	if s.AdditionalProperties != nil && s.AdditionalProperties.schema != nil {
+		as := &Schema{}
+		if err := as.compile(nested.AdditionalProperties, path+"/additionalProperties"); err != nil {
+			return err
+		}
+		s.AdditionalProperties.schema = as
+	}
+	if s.Items != nil {
+		is := &Schema{}
+		if err := is.compile(nested.Items, path+"/items"); err != nil {
+			return err
+		}
+		s.Items = is
+	}
+	return nil
+}
+
+// ValidationError lists every violation found, each prefixed with its JSON Pointer.
+type ValidationError struct {
+	Violations []string
+}
+
+func (e *ValidationError) Error() string {
+	return "schema validation failed: " + strings.Join(e.Violations, "; ")
+}
+
+// Validate validates v, a value as decoded by encoding/json into an any.
+func (s *Schema) Validate(v any) error {
+	var violations []string
+	s.validate(v, "", &violations)
+	if len(violations) > 0 {
+		return &ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+func (s *Schema) validate(v any, path string, violations *[]string) {
+	fail := func(format string, a ...any) {
+		*violations = append(*violations, pathOrRoot(path)+": "+fmt.Sprintf(format, a...))
+	}
+
+	if len(s.Type) > 0 {
+		ok := false
+		for _, t := range s.Type {
+			ok = ok || hasType(v, t)
+		}
+		if !ok {
+			fail("should be %s", strings.Join(s.Type, " or "))
+			return
+		}
+	}
+	if len(s.Enum) > 0 {
+		ok := false
+		for _, e := range s.Enum {
+			ok = ok || reflect.DeepEqual(normalize(e), normalize(v))
+		}
+		if !ok {
+			fail("should be one of %v", s.Enum)
+		}
+	}
+	if s.Const != nil && !reflect.DeepEqual(normalize(*s.Const), normalize(v)) {
+		fail("should be %v", *s.Const)
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		for _, r := range s.Required {
+			if _, ok := v[r]; !ok {
+				fail("missing required property: %s", r)
+			}
+		}
+		if s.MinProperties != nil && len(v) < *s.MinProperties {
+			fail("should have at least %d properties", *s.MinProperties)
+		}
+		if s.MaxProperties != nil && len(v) > *s.MaxProperties {
+			fail("should have at most %d properties", *s.MaxProperties)
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p := path + "/" + escapePointer(name)
+			if ps, ok := s.Properties[name]; ok {
+				ps.validate(v[name], p, violations)
+				continue
+			}
+			if s.AdditionalProperties == nil {
+				continue
+			}
+			if !s.AdditionalProperties.allowed {
+				fail("unknown property: %s", name)
+			} else if s.AdditionalProperties.schema != nil {
+				s.AdditionalProperties.schema.validate(v[name], p, violations)
+			}
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("should have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("should have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(item, fmt.Sprintf("%s/%d", path, i), violations)
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("should be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("should be at most %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("should match pattern %s", s.Pattern)
+		}
+		if s.Format != "" && !hasFormat(v, s.Format) {
+			fail("should be a valid %s", s.Format)
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			fail("should be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			fail("should be at most %v", *s.Maximum)
+		}
+	}
+}
+
+func hasType(v any, t string) bool {
+	switch v := v.(type) {
+	case map[string]any:
+		return t == "object"
+	case []any:
+		return t == "array"
+	case string:
+		return t == "string"
+	case float64:
+		return t == "number" || t == "integer" && v == math.Trunc(v)
+	case bool:
+		return t == "boolean"
+	case nil:
+		return t == "null"
+	}
+	return false
+}
+
+func hasFormat(v string, format string) bool {
+	switch format {
+	case "email":
+		a, err := mail.ParseAddress(v)
+		return err == nil && a.Address == v
+	case "uri":
+		u, err := url.Parse(v)
+		return err == nil && u.Scheme != ""
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, v)
+		return err == nil
+	}
+	return true
+}
+
+// normalize converts numbers to float64 so that values from the schema and from documents compare equal.
+func normalize(v any) any {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var n any
+	if err := json.Unmarshal(b, &n); err != nil {
+		return v
+	}
+	return n
+}
+
+func escapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
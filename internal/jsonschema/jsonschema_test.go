@@ -0,0 +1,181 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// suite holds cases of the JSON Schema Test Suite (github.com/json-schema-org/JSON-Schema-Test-Suite)
+// for the supported keywords, with the schema, the data and whether the data is valid.
+var suite = []struct {
+	description string
+	schema      string
+	tests       []suiteTest
+}{
+	{"integer type matches integers", `{"type":"integer"}`, cases(
+		`1`, true, `1.0`, true, `1.1`, false, `"foo"`, false, `"1"`, false, `{}`, false, `[]`, false, `true`, false, `null`, false)},
+	{"number type matches numbers", `{"type":"number"}`, cases(
+		`1`, true, `1.0`, true, `1.1`, true, `"foo"`, false, `"1"`, false, `{}`, false, `[]`, false, `true`, false, `null`, false)},
+	{"string type matches strings", `{"type":"string"}`, cases(
+		`1`, false, `"foo"`, true, `"1"`, true, `""`, true, `{}`, false, `[]`, false, `true`, false, `null`, false)},
+	{"object type matches objects", `{"type":"object"}`, cases(
+		`1`, false, `"foo"`, false, `{}`, true, `[]`, false, `true`, false, `null`, false)},
+	{"array type matches arrays", `{"type":"array"}`, cases(
+		`1`, false, `"foo"`, false, `{}`, false, `[]`, true, `true`, false, `null`, false)},
+	{"boolean type matches booleans", `{"type":"boolean"}`, cases(
+		`0`, false, `""`, false, `{}`, false, `[]`, false, `true`, true, `false`, true, `null`, false)},
+	{"null type matches only the null object", `{"type":"null"}`, cases(
+		`0`, false, `""`, false, `false`, false, `null`, true)},
+	{"multiple types can be specified in an array", `{"type":["integer","string"]}`, cases(
+		`1`, true, `"foo"`, true, `1.1`, false, `{}`, false, `[]`, false, `true`, false, `null`, false)},
+	{"simple enum validation", `{"enum":[1,2,3]}`, cases(
+		`1`, true, `4`, false)},
+	{"heterogeneous enum validation", `{"enum":[6,"foo",[],true,{"foo":12}]}`, cases(
+		`[]`, true, `null`, false, `{"foo":false}`, false, `{"foo":12}`, true, `{"foo":12,"boo":42}`, false)},
+	{"enum with 0 does not match false", `{"enum":[0]}`, cases(
+		`false`, false, `0`, true, `0.0`, true)},
+	{"const validation", `{"const":2}`, cases(
+		`2`, true, `5`, false, `"a"`, false)},
+	{"const with object", `{"const":{"foo":"bar","baz":"bax"}}`, cases(
+		`{"foo":"bar","baz":"bax"}`, true, `{"baz":"bax","foo":"bar"}`, true, `{"foo":"bar"}`, false, `[1,2]`, false)},
+	{"object properties validation", `{"properties":{"foo":{"type":"integer"},"bar":{"type":"string"}}}`, cases(
+		`{"foo":1,"bar":"baz"}`, true, `{"foo":1,"bar":{}}`, false, `{"foo":[],"bar":{}}`, false, `{"quux":[]}`, true, `[]`, true, `12`, true)},
+	{"required validation", `{"properties":{"foo":{},"bar":{}},"required":["foo"]}`, cases(
+		`{"foo":1}`, true, `{"bar":1}`, false, `[]`, true, `""`, true, `12`, true)},
+	{"additionalProperties being false does not allow other properties",
+		`{"properties":{"foo":{},"bar":{}},"additionalProperties":false}`, cases(
+			`{"foo":1}`, true, `{"foo":1,"bar":2,"quux":"boom"}`, false, `[1,2,3]`, true, `"foobarbaz"`, true, `12`, true)},
+	{"additionalProperties allows a schema which should validate",
+		`{"properties":{"foo":{},"bar":{}},"additionalProperties":{"type":"boolean"}}`, cases(
+			`{"foo":1}`, true, `{"foo":1,"bar":2,"quux":true}`, true, `{"foo":1,"bar":2,"quux":12}`, false)},
+	{"additionalProperties can exist by itself", `{"additionalProperties":{"type":"boolean"}}`, cases(
+		`{"foo":true}`, true, `{"foo":1}`, false)},
+	{"minProperties validation", `{"minProperties":1}`, cases(
+		`{"foo":1,"bar":2}`, true, `{"foo":1}`, true, `{}`, false, `[]`, true, `""`, true, `12`, true)},
+	{"maxProperties validation", `{"maxProperties":2}`, cases(
+		`{"foo":1}`, true, `{"foo":1,"bar":2}`, true, `{"foo":1,"bar":2,"baz":3}`, false, `[1,2,3]`, true, `"foobar"`, true)},
+	{"a schema given for items", `{"items":{"type":"integer"}}`, cases(
+		`[1,2,3]`, true, `[1,"x"]`, false, `{"foo":"bar"}`, true, `{"0":"invalid","length":1}`, true)},
+	{"minItems validation", `{"minItems":1}`, cases(
+		`[1,2]`, true, `[1]`, true, `[]`, false, `""`, true)},
+	{"maxItems validation", `{"maxItems":2}`, cases(
+		`[1]`, true, `[1,2]`, true, `[1,2,3]`, false, `"foobar"`, true)},
+	{"minLength validation", `{"minLength":2}`, cases(
+		`"foo"`, true, `"fo"`, true, `"f"`, false, `1`, true, `"💩"`, false)},
+	{"maxLength validation", `{"maxLength":2}`, cases(
+		`"f"`, true, `"fo"`, true, `"foo"`, false, `100`, true, `"💩💩"`, true)},
+	{"pattern validation", `{"pattern":"^a*$"}`, cases(
+		`"aaa"`, true, `"abc"`, false, `true`, true, `123`, true, `null`, true)},
+	{"pattern is not anchored", `{"pattern":"a+"}`, cases(
+		`"xxaayy"`, true)},
+	{"minimum validation", `{"minimum":1.1}`, cases(
+		`2.6`, true, `1.1`, true, `0.6`, false, `"x"`, true)},
+	{"minimum validation with signed integer", `{"minimum":-2}`, cases(
+		`-1`, true, `0`, true, `-2`, true, `-2.0001`, false, `-3`, false)},
+	{"maximum validation", `{"maximum":3.0}`, cases(
+		`2.6`, true, `3.0`, true, `3.5`, false, `"x"`, true)},
+	{"validation of e-mail addresses", `{"format":"email"}`, cases(
+		`"joe.bloggs@example.com"`, true, `"2962"`, false, `12`, true)},
+	{"validation of URIs", `{"format":"uri"}`, cases(
+		`"http://foo.bar/?baz=qux#quux"`, true, `"//foo.bar/?baz=qux#quux"`, false, `"mailto:John.Doe@example.com"`, true)},
+	{"validation of date-time strings", `{"format":"date-time"}`, cases(
+		`"1963-06-19T08:30:06.283185Z"`, true, `"1963-06-19T08:30:06Z"`, true, `"1963-06-19T08:30:06+01:00"`, true,
+		`"06/19/1963 08:30:06 PST"`, false, `"2013-350T01:01:01"`, false, `"1963-06-19"`, false)},
+	{"annotations are ignored", `{"title":"t","description":"d","$comment":"c","type":"string"}`, cases(
+		`"foo"`, true, `1`, false)},
+}
+
+type suiteTest struct {
+	data  string
+	valid bool
+}
+
+// cases pairs data with validity, as the tests of a suite entry.
+func cases(pairs ...any) []suiteTest {
+	tests := make([]suiteTest, len(pairs)/2)
+	for i := range tests {
+		tests[i].data, tests[i].valid = pairs[2*i].(string), pairs[2*i+1].(bool)
+	}
+	return tests
+}
+
+func TestValidate(t *testing.T) {
+	for _, group := range suite {
+		t.Run(group.description, func(t *testing.T) {
+			s, err := Compile([]byte(group.schema))
+			if err != nil {
+				t.Fatalf("Compile(%s) error: %v", group.schema, err)
+			}
+			for _, tt := range group.tests {
+				var v any
+				if err := json.Unmarshal([]byte(tt.data), &v); err != nil {
+					t.Fatalf("error decoding %s: %v", tt.data, err)
+				}
+				err := s.Validate(v)
+				var ve *ValidationError
+				if err != nil && !errors.As(err, &ve) {
+					t.Errorf("Validate(%s) error = %v, want a *ValidationError", tt.data, err)
+				}
+				if (err == nil) != tt.valid {
+					t.Errorf("Validate(%s) error = %v, want valid: %v", tt.data, err, tt.valid)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateViolations(t *testing.T) {
+	s, err := Compile([]byte(`{
+		"type": "object",
+		"properties": {
+			"tags": {"type": "array", "items": {"type": "string", "maxLength": 3}},
+			"a/b": {"type": "integer"}
+		},
+		"required": ["id"],
+		"additionalProperties": false
+	}`))
+	if err != nil {
+		t.Fatalf("Compile() error: %v", err)
+	}
+	var v any
+	_ = json.Unmarshal([]byte(`{"tags":["ok","long",1],"a/b":"x","extra":true}`), &v)
+	err = s.Validate(v)
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatalf("Validate() error = %v, want a *ValidationError", err)
+	}
+	want := []string{
+		"/: missing required property: id",
+		"/a~1b: should be integer",
+		"/: unknown property: extra",
+		"/tags/1: should be at most 3 characters",
+		"/tags/2: should be string",
+	}
+	if !reflect.DeepEqual(ve.Violations, want) {
+		t.Errorf("Violations = %q, want %q", ve.Violations, want)
+	}
+}
+
+func TestCompileInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+	}{
+		{name: "not an object", schema: `[]`},
+		{name: "unsupported keyword", schema: `{"oneOf":[]}`},
+		{name: "nested unsupported keyword", schema: `{"properties":{"a":{"allOf":[]}}}`},
+		{name: "unknown type", schema: `{"type":"decimal"}`},
+		{name: "unsupported format", schema: `{"format":"ipv4"}`},
+		{name: "invalid pattern", schema: `{"pattern":"("}`},
+		{name: "invalid items", schema: `{"items":{"type":"decimal"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Compile([]byte(tt.schema)); err == nil {
+				t.Errorf("Compile(%s) error = nil, want an error", tt.schema)
+			}
+		})
+	}
+}
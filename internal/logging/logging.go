@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+var level atomic.Int32
+
+func init() {
+	level.Store(int32(LevelInfo))
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for l, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level: %s, should be debug, info, warn or error", s)
+}
+
+func SetLevel(l Level) {
+	level.Store(int32(l))
+}
+
+func GetLevel() Level {
+	return Level(level.Load())
+}
+
+func Debugf(format string, v ...any) {
+	logf(LevelDebug, format, v...)
+}
+
+func Infof(format string, v ...any) {
+	logf(LevelInfo, format, v...)
+}
+
+func Warnf(format string, v ...any) {
+	logf(LevelWarn, format, v...)
+}
+
+func Errorf(format string, v ...any) {
+	logf(LevelError, format, v...)
+}
+
+func logf(l Level, format string, v ...any) {
+	if l < GetLevel() {
+		return
+	}
+	_ = log.Output(3, strings.ToUpper(l.String())+" "+fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,45 @@
+package mail
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// OutboxMailer writes every message to an .eml file in Dir instead of sending it,
+// for development and for tests which read the messages back.
+type OutboxMailer struct {
+	Dir  string
+	From string
+}
+
+func (om OutboxMailer) Send(ctx context.Context, m Message) error {
+	msg, err := Compose(om.From, m)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(om.Dir, 0700); err != nil {
+		return fmt.Errorf("error creating outbox directory: %s: %w", om.Dir, err)
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	name := filepath.Join(om.Dir, fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix)))
+	if err := os.WriteFile(name, msg, 0600); err != nil {
+		return fmt.Errorf("error writing message to outbox: %s: %w", name, err)
+	}
+	return nil
+}
+
+// LogMailer logs every message instead of sending it, message bodies may contain secrets
+// such as verification tokens so it is only meant for development.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, m Message) error {
+	log.Printf("LogMailer: To: %s, Subject: %s\n%s", m.To, m.Subject, m.Body)
+	return nil
+}
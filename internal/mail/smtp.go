@@ -0,0 +1,83 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// ImplicitTLS connects with TLS from the start, as on port 465, STARTTLS is required otherwise
+	ImplicitTLS bool
+}
+
+func (sm SMTPMailer) Send(ctx context.Context, m Message) error {
+	msg, err := Compose(sm.From, m)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(sm.Host, strconv.Itoa(sm.Port))
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	if sm.ImplicitTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: sm.Host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("error connecting to SMTP server: %s: %w", addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+
+	c, err := smtp.NewClient(conn, sm.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error creating SMTP client: %w", err)
+	}
+	defer c.Close()
+
+	if !sm.ImplicitTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("SMTP server does not support STARTTLS: %s", addr)
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: sm.Host}); err != nil {
+			return fmt.Errorf("error starting TLS: %w", err)
+		}
+	}
+	if sm.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", sm.Username, sm.Password, sm.Host)); err != nil {
+			return fmt.Errorf("error authenticating to SMTP server: %w", err)
+		}
+	}
+	if err := c.Mail(sm.From); err != nil {
+		return fmt.Errorf("error setting sender: %w", err)
+	}
+	if err := c.Rcpt(m.To); err != nil {
+		return fmt.Errorf("error setting recipient: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("error starting message data: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("error writing message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	return c.Quit()
+}
@@ -0,0 +1,39 @@
+package mergepatch
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Apply applies a JSON Merge Patch (RFC 7396) to the JSON document target.
+func Apply(target []byte, patch []byte) ([]byte, error) {
+	var t, p any
+	if len(target) > 0 {
+		if err := json.Unmarshal(target, &t); err != nil {
+			return nil, fmt.Errorf("error decoding merge patch target: %w", err)
+		}
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, fmt.Errorf("error decoding merge patch: %w", err)
+	}
+	return json.Marshal(merge(t, p))
+}
+
+func merge(target any, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any)
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = merge(t[k], v)
+	}
+	return t
+}
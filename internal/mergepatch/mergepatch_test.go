@@ -0,0 +1,80 @@
+package mergepatch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	// The examples of RFC 7396 appendix A, and the example of section 3
+	tests := []struct {
+		target string
+		patch  string
+		want   string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		{
+			`{"title":"Goodbye!","author":{"givenName":"John","familyName":"Doe"},"tags":["example","sample"],"content":"This will be unchanged"}`,
+			`{"title":"Hello!","phoneNumber":"+01-123-456-7890","author":{"familyName":null},"tags":["example"]}`,
+			`{"title":"Hello!","author":{"givenName":"John"},"tags":["example"],"content":"This will be unchanged","phoneNumber":"+01-123-456-7890"}`,
+		},
+		// An empty target is no document, as a profile which was never set
+		{``, `{"a":"b","c":null}`, `{"a":"b"}`},
+	}
+	for _, tt := range tests {
+		got, err := Apply([]byte(tt.target), []byte(tt.patch))
+		if err != nil {
+			t.Errorf("Apply(%s, %s) error: %v", tt.target, tt.patch, err)
+			continue
+		}
+		if !jsonEqual(t, got, []byte(tt.want)) {
+			t.Errorf("Apply(%s, %s) = %s, want %s", tt.target, tt.patch, got, tt.want)
+		}
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		patch  string
+	}{
+		{name: "invalid target", target: `{"a":`, patch: `{}`},
+		{name: "invalid patch", target: `{}`, patch: `{"a":`},
+		{name: "empty patch", target: `{}`, patch: ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Apply([]byte(tt.target), []byte(tt.patch)); err == nil {
+				t.Error("Apply() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func jsonEqual(t *testing.T, a []byte, b []byte) bool {
+	t.Helper()
+	var va, vb any
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("error decoding %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("error decoding %s: %v", b, err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
@@ -0,0 +1,42 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/mail"
+)
+
+var ErrNoAddress = errors.New("recipient has no address for this notifier")
+
+// Recipient is who a Notification is for, Email is only set when it has been verified.
+type Recipient struct {
+	Username string `json:"username"`
+	Email    string `json:"email,omitempty"`
+}
+
+type Notification struct {
+	// Kind identifies the notification for notifiers which render their own message
+	Kind    string            `json:"kind"`
+	Subject string            `json:"subject"`
+	Body    string            `json:"body"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
+const KindPasswordReset = "password-reset"
+
+// Notifier delivers account notifications, like password reset tokens, to users.
+type Notifier interface {
+	Notify(ctx context.Context, to Recipient, n Notification) error
+}
+
+// MailNotifier delivers notifications to the verified email of the recipient.
+type MailNotifier struct {
+	Mailer mail.Mailer
+}
+
+func (mn MailNotifier) Notify(ctx context.Context, to Recipient, n Notification) error {
+	if to.Email == "" {
+		return ErrNoAddress
+	}
+	return mn.Mailer.Send(ctx, mail.Message{To: to.Email, Subject: n.Subject, Body: n.Body})
+}
@@ -0,0 +1,44 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// WebhookNotifier POSTs every notification as JSON to URL, for delivery
+// through channels this service doesn't know about, like SMS or chat.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (wn WebhookNotifier) Notify(ctx context.Context, to Recipient, n Notification) error {
+	body, err := json.Marshal(struct {
+		To           Recipient `json:"to"`
+		Notification `json:"notification"`
+	}{to, n})
+	if err != nil {
+		return fmt.Errorf("error encoding notification: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wn.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := wn.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling notification webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notification webhook responded with status: %s", resp.Status)
+	}
+	return nil
+}
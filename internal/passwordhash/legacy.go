@@ -0,0 +1,243 @@
+package passwordhash
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"strconv"
+	"strings"
+)
+
+// Legacy algorithms are only verified, for hashes imported from other systems,
+// a successful login rehashes them with the configured algorithm.
+const (
+	// AlgorithmPBKDF2SHA256 is the passlib format $pbkdf2-sha256$<rounds>$<salt>$<checksum>,
+	// salt and checksum in base64 with . in place of +
+	AlgorithmPBKDF2SHA256 = "pbkdf2-sha256"
+	// AlgorithmSHA512Crypt is the crypt(3) format $6$[rounds=<rounds>$]<salt>$<checksum>
+	AlgorithmSHA512Crypt = "sha512-crypt"
+	// AlgorithmSSHA is the LDAP format {SSHA}<base64 of SHA-1(password+salt) followed by salt>
+	AlgorithmSSHA = "ssha"
+)
+
+const (
+	maxPBKDF2Rounds          = 2_000_000
+	maxPBKDF2Salt            = 64
+	minPBKDF2Checksum        = 32
+	maxPBKDF2Checksum        = 64
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMinRounds     = 1000
+	sha512CryptMaxSalt       = 16
+	// sha512CryptMaxRounds is far below the 999,999,999 of crypt(3), which takes minutes to verify
+	sha512CryptMaxRounds = 5_000_000
+)
+
+var ab64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./").WithPadding(base64.NoPadding)
+
+func parsePBKDF2SHA256(hash []byte) (rounds int, salt []byte, key []byte, err error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != AlgorithmPBKDF2SHA256 {
+		return 0, nil, nil, errors.New("malformed pbkdf2-sha256 hash")
+	}
+	rounds, err = strconv.Atoi(parts[2])
+	if err != nil || rounds < 1 || rounds > maxPBKDF2Rounds {
+		return 0, nil, nil, fmt.Errorf("pbkdf2-sha256 rounds should be between 1 and %d", maxPBKDF2Rounds)
+	}
+	if salt, err = ab64.DecodeString(parts[3]); err != nil {
+		return 0, nil, nil, fmt.Errorf("malformed pbkdf2-sha256 salt: %w", err)
+	}
+	if len(salt) > maxPBKDF2Salt {
+		return 0, nil, nil, fmt.Errorf("pbkdf2-sha256 salt should have at most %d bytes", maxPBKDF2Salt)
+	}
+	if key, err = ab64.DecodeString(parts[4]); err != nil {
+		return 0, nil, nil, errors.New("malformed pbkdf2-sha256 checksum")
+	}
+	if len(key) < minPBKDF2Checksum || len(key) > maxPBKDF2Checksum {
+		return 0, nil, nil, fmt.Errorf("pbkdf2-sha256 checksum should have %d to %d bytes", minPBKDF2Checksum, maxPBKDF2Checksum)
+	}
+	return rounds, salt, key, nil
+}
+
+func verifyPBKDF2SHA256(hash []byte, password string) error {
+	rounds, salt, key, err := parsePBKDF2SHA256(hash)
+	if err != nil {
+		return err
+	}
+	other := pbkdf2.Key([]byte(password), salt, rounds, len(key), sha256.New)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+func parseSHA512Crypt(hash []byte) (rounds int, salt []byte, checksum []byte, err error) {
+	if !bytes.HasPrefix(hash, []byte("$6$")) {
+		return 0, nil, nil, errors.New("malformed sha512-crypt hash")
+	}
+	rest := hash[len("$6$"):]
+	rounds = sha512CryptDefaultRounds
+	if bytes.HasPrefix(rest, []byte("rounds=")) {
+		r := rest[len("rounds="):]
+		i := bytes.IndexByte(r, '$')
+		if i < 0 {
+			return 0, nil, nil, errors.New("malformed sha512-crypt rounds")
+		}
+		if rounds, err = strconv.Atoi(string(r[:i])); err != nil {
+			return 0, nil, nil, errors.New("malformed sha512-crypt rounds")
+		}
+		// Too few rounds are clamped like crypt(3) does, too many are rejected
+		if rounds > sha512CryptMaxRounds {
+			return 0, nil, nil, fmt.Errorf("sha512-crypt rounds should be at most %d", sha512CryptMaxRounds)
+		}
+		if rounds < sha512CryptMinRounds {
+			rounds = sha512CryptMinRounds
+		}
+		rest = r[i+1:]
+	}
+	i := bytes.LastIndexByte(rest, '$')
+	if i < 0 || len(rest)-i-1 != 86 {
+		return 0, nil, nil, errors.New("malformed sha512-crypt checksum")
+	}
+	salt, checksum = rest[:i], rest[i+1:]
+	if len(salt) > sha512CryptMaxSalt {
+		salt = salt[:sha512CryptMaxSalt]
+	}
+	return rounds, salt, checksum, nil
+}
+
+func verifySHA512Crypt(hash []byte, password string) error {
+	rounds, salt, checksum, err := parseSHA512Crypt(hash)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(checksum, sha512Crypt([]byte(password), salt, rounds)) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// sha512Crypt returns the encoded checksum of the SHA-512 based crypt(3) by Ulrich Drepper.
+func sha512Crypt(password []byte, salt []byte, rounds int) []byte {
+	h := sha512.New()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(password)
+	h.Write(salt)
+	n := len(password)
+	for ; n > 64; n -= 64 {
+		h.Write(b)
+	}
+	h.Write(b[:n])
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(password)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for i := 0; i < len(password); i++ {
+		h.Write(password)
+	}
+	p := repeatTo(h.Sum(nil), len(password))
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeatTo(h.Sum(nil), len(salt))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i%2 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i%2 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	const alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out []byte
+	encode := func(b2, b1, b0 byte, n int) {
+		w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for ; n > 0; n-- {
+			out = append(out, alphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for i := 0; i < 21; i++ {
+		// The bytes are taken 0, 21, 42, then 22, 43, 1, then 44, 2, 23 and so on
+		j := [3]int{i, i + 21, i + 42}
+		switch i % 3 {
+		case 1:
+			j = [3]int{i + 21, i + 42, i}
+		case 2:
+			j = [3]int{i + 42, i, i + 21}
+		}
+		encode(c[j[0]], c[j[1]], c[j[2]], 4)
+	}
+	encode(0, 0, c[63], 2)
+	return out
+}
+
+func repeatTo(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		m := n - len(out)
+		if m > len(b) {
+			m = len(b)
+		}
+		out = append(out, b[:m]...)
+	}
+	return out
+}
+
+func parseSSHA(hash []byte) (digest []byte, salt []byte, err error) {
+	if !bytes.HasPrefix(hash, []byte("{SSHA}")) {
+		return nil, nil, errors.New("malformed ssha hash")
+	}
+	b, err := base64.StdEncoding.DecodeString(string(hash[len("{SSHA}"):]))
+	if err != nil || len(b) <= sha1.Size {
+		return nil, nil, errors.New("malformed ssha hash")
+	}
+	return b[:sha1.Size], b[sha1.Size:], nil
+}
+
+func verifySSHA(hash []byte, password string) error {
+	digest, salt, err := parseSSHA(hash)
+	if err != nil {
+		return err
+	}
+	h := sha1.New()
+	h.Write([]byte(password))
+	h.Write(salt)
+	if subtle.ConstantTimeCompare(digest, h.Sum(nil)) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package passwordhash
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+var (
+	ErrMismatch         = errors.New("password does not match the hash")
+	ErrUnknownAlgorithm = errors.New("unknown password hash algorithm")
+)
+
+// The argon2id costs are bounded so that a stored or imported hash can't make verifying it
+// take more memory or time than any configured hasher would, MaxArgon2Memory is 1 GiB in KiB.
+const (
+	MaxArgon2Memory      = 1 << 20
+	MaxArgon2Iterations  = 10
+	MaxArgon2Parallelism = 16
+)
+
+// The accepted argon2id salt and key lengths in bytes.
+const (
+	minArgon2SaltLength = 8
+	maxArgon2SaltLength = 64
+	minArgon2KeyLength  = 16
+	maxArgon2KeyLength  = 64
+)
+
+// Argon2Params are the argon2id costs, Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// Hasher creates hashes with Algorithm. Every hash carries its algorithm and costs,
+// argon2id in the PHC string format and bcrypt in its modular crypt format, so hashes
+// created with other settings still verify.
+type Hasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+func (h Hasher) Hash(password string) ([]byte, error) {
+	switch h.Algorithm {
+	case AlgorithmArgon2id:
+		return hashArgon2id(password, h.Argon2)
+	case AlgorithmBcrypt:
+		return bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAlgorithm, h.Algorithm)
+	}
+}
+
+// NeedsRehash reports whether hash uses another algorithm than h or lower costs.
+func (h Hasher) NeedsRehash(hash []byte) bool {
+	alg, err := Algorithm(hash)
+	if err != nil || alg != h.Algorithm {
+		return true
+	}
+	switch alg {
+	case AlgorithmArgon2id:
+		p, _, _, err := parseArgon2id(hash)
+		return err != nil || p.Memory < h.Argon2.Memory || p.Iterations < h.Argon2.Iterations ||
+			p.Parallelism < h.Argon2.Parallelism || p.KeyLength < h.Argon2.KeyLength
+	case AlgorithmBcrypt:
+		cost, err := bcrypt.Cost(hash)
+		return err != nil || cost < h.BcryptCost
+	}
+	return true
+}
+
+// Benchmark returns how long hashing a password takes with h.
+func (h Hasher) Benchmark() (time.Duration, error) {
+	start := time.Now()
+	if _, err := h.Hash("benchmark-password"); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// Algorithm identifies the algorithm of hash.
+func Algorithm(hash []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(hash, []byte("$argon2id$")):
+		return AlgorithmArgon2id, nil
+	case bytes.HasPrefix(hash, []byte("$2a$")), bytes.HasPrefix(hash, []byte("$2b$")), bytes.HasPrefix(hash, []byte("$2y$")):
+		return AlgorithmBcrypt, nil
+	case bytes.HasPrefix(hash, []byte("$pbkdf2-sha256$")):
+		return AlgorithmPBKDF2SHA256, nil
+	case bytes.HasPrefix(hash, []byte("$6$")):
+		return AlgorithmSHA512Crypt, nil
+	case bytes.HasPrefix(hash, []byte("{SSHA}")):
+		return AlgorithmSSHA, nil
+	default:
+		return "", ErrUnknownAlgorithm
+	}
+}
+
+// SameCosts reports whether hashes a and b are of the same algorithm with the same costs, so that
+// they can only differ by their salts or passwords. A hash which was rehashed doesn't have the costs
+// of the hash it replaced, see Hasher.NeedsRehash.
+func SameCosts(a []byte, b []byte) bool {
+	alg, err := Algorithm(a)
+	if err != nil {
+		return false
+	}
+	if other, err := Algorithm(b); err != nil || other != alg {
+		return false
+	}
+	switch alg {
+	case AlgorithmArgon2id:
+		pa, _, _, errA := parseArgon2id(a)
+		pb, _, _, errB := parseArgon2id(b)
+		return errA == nil && errB == nil && pa.Memory == pb.Memory && pa.Iterations == pb.Iterations &&
+			pa.Parallelism == pb.Parallelism && pa.KeyLength == pb.KeyLength
+	case AlgorithmBcrypt:
+		ca, errA := bcrypt.Cost(a)
+		cb, errB := bcrypt.Cost(b)
+		return errA == nil && errB == nil && ca == cb
+	case AlgorithmPBKDF2SHA256:
+		ra, _, ka, errA := parsePBKDF2SHA256(a)
+		rb, _, kb, errB := parsePBKDF2SHA256(b)
+		return errA == nil && errB == nil && ra == rb && len(ka) == len(kb)
+	case AlgorithmSHA512Crypt:
+		ra, _, _, errA := parseSHA512Crypt(a)
+		rb, _, _, errB := parseSHA512Crypt(b)
+		return errA == nil && errB == nil && ra == rb
+	}
+	return true
+}
+
+// Valid checks that hash is a well-formed hash of a known algorithm with costs within the maximums.
+func Valid(hash []byte) error {
+	alg, err := Algorithm(hash)
+	if err != nil {
+		return err
+	}
+	switch alg {
+	case AlgorithmArgon2id:
+		_, _, _, err = parseArgon2id(hash)
+	case AlgorithmBcrypt:
+		_, err = bcrypt.Cost(hash)
+	case AlgorithmPBKDF2SHA256:
+		_, _, _, err = parsePBKDF2SHA256(hash)
+	case AlgorithmSHA512Crypt:
+		_, _, _, err = parseSHA512Crypt(hash)
+	case AlgorithmSSHA:
+		_, _, err = parseSSHA(hash)
+	}
+	return err
+}
+
+// Verify returns nil when password matches hash and ErrMismatch when it doesn't,
+// other errors mean hash could not be used.
+func Verify(hash []byte, password string) error {
+	alg, err := Algorithm(hash)
+	if err != nil {
+		return err
+	}
+	switch alg {
+	case AlgorithmArgon2id:
+		return verifyArgon2id(hash, password)
+	case AlgorithmPBKDF2SHA256:
+		return verifyPBKDF2SHA256(hash, password)
+	case AlgorithmSHA512Crypt:
+		return verifySHA512Crypt(hash, password)
+	case AlgorithmSSHA:
+		return verifySSHA(hash, password)
+	default:
+		err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrMismatch
+		}
+		return err
+	}
+}
+
+func hashArgon2id(password string, p Argon2Params) ([]byte, error) {
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("error generating salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+func verifyArgon2id(hash []byte, password string) error {
+	p, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// parseArgon2id parses $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>.
+func parseArgon2id(hash []byte) (p Argon2Params, salt []byte, key []byte, err error) {
+	parts := bytes.Split(hash, []byte("$"))
+	if len(parts) != 6 || len(parts[0]) != 0 || string(parts[1]) != AlgorithmArgon2id {
+		return p, nil, nil, errors.New("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(string(parts[2]), "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2id version: %s", parts[2])
+	}
+	if _, err := fmt.Sscanf(string(parts[3]), "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+	if p.Iterations < 1 || p.Iterations > MaxArgon2Iterations {
+		return p, nil, nil, fmt.Errorf("argon2id iterations should be between 1 and %d", MaxArgon2Iterations)
+	}
+	if p.Parallelism < 1 || p.Parallelism > MaxArgon2Parallelism {
+		return p, nil, nil, fmt.Errorf("argon2id parallelism should be between 1 and %d", MaxArgon2Parallelism)
+	}
+	if p.Memory > MaxArgon2Memory {
+		return p, nil, nil, fmt.Errorf("argon2id memory should be at most %d KiB", MaxArgon2Memory)
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(string(parts[4])); err != nil {
+		return p, nil, nil, fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	if len(salt) < minArgon2SaltLength || len(salt) > maxArgon2SaltLength {
+		return p, nil, nil, fmt.Errorf("argon2id salt should have %d to %d bytes", minArgon2SaltLength, maxArgon2SaltLength)
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(string(parts[5])); err != nil {
+		return p, nil, nil, errors.New("malformed argon2id key")
+	}
+	if len(key) < minArgon2KeyLength || len(key) > maxArgon2KeyLength {
+		return p, nil, nil, fmt.Errorf("argon2id key should have %d to %d bytes", minArgon2KeyLength, maxArgon2KeyLength)
+	}
+	p.SaltLength, p.KeyLength = uint32(len(salt)), uint32(len(key))
+	return p, salt, key, nil
+}
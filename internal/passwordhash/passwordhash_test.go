@@ -0,0 +1,208 @@
+package passwordhash
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// knownHashes are outputs of the reference implementations: the argon2id vectors of the
+// reference implementation's test.c, pbkdf2-sha256 from passlib's tests and RFC 7914 section 11
+// in the passlib format, sha512-crypt from the crypt(3) specification by Ulrich Drepper and
+// ssha from the OpenLDAP FAQ.
+var knownHashes = []struct {
+	password string
+	hash     string
+}{
+	{"password", "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+	{"password", "$argon2id$v=19$m=256,t=2,p=1$c29tZXNhbHQ$nf65EOgLrQMR/uIPnA4rEsF5h7TKyQwu9U1bMCHGi/4"},
+	{"password", "$argon2id$v=19$m=256,t=2,p=2$c29tZXNhbHQ$bQk8UB/VmZZF4Oo79iDXuL5/0ttZwg2f/5U52iv1cDc"},
+	{"password", "$argon2id$v=19$m=65536,t=1,p=1$c29tZXNhbHQ$9qWtwbpyPd3vm1rB1GThgPzZ3/ydHL92zKL+15XZypg"},
+	{"password", "$pbkdf2-sha256$1212$4vjV83LKPjQzk31VI4E0Vw$hsYF68OiOUPdDZ1Fg.fJPeq1h/gXXY7acBp9/6c.tmQ"},
+	{"passwd", "$pbkdf2-sha256$1$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLxJypzM8Xm2RZkWZLOdd.8xfHG4RbHjC9UJESBB06GXgw"},
+	{"Password", "$pbkdf2-sha256$80000$TmFDbA$TdzY9guYviGDDO5e8icB.WQaRBjQTAQUrv8Ih2s0q1ah1CWhIlgzVJrbhBtRybMXaicr3ruh0HhHj2Kzl/M8jQ"},
+	{"Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+	{"Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+	{"This is just a test", "$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+	{"a very much longer text to encrypt.  This one even stretches over morethan one line.", "$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1"},
+	{"we have a short salt string but not a short password", "$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0"},
+	{"the minimum number is still observed", "$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+	// Too few rounds are clamped to the minimum like crypt(3) does
+	{"the minimum number is still observed", "$6$rounds=10$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+	{"secret", "{SSHA}DkMTwBl+a/3DQTxCYEApdUtNXGgdUac3"},
+}
+
+func TestVerifyKnownHashes(t *testing.T) {
+	for _, k := range knownHashes {
+		if err := Valid([]byte(k.hash)); err != nil {
+			t.Errorf("Valid(%s) error: %v", k.hash, err)
+		}
+		if err := Verify([]byte(k.hash), k.password); err != nil {
+			t.Errorf("Verify(%s, %q) error: %v", k.hash, k.password, err)
+		}
+		if err := Verify([]byte(k.hash), k.password+"x"); !errors.Is(err, ErrMismatch) {
+			t.Errorf("Verify(%s) of another password error = %v, want %v", k.hash, err, ErrMismatch)
+		}
+	}
+}
+
+func TestHashVerify(t *testing.T) {
+	hashers := []Hasher{
+		{Algorithm: AlgorithmArgon2id, Argon2: Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}},
+		{Algorithm: AlgorithmBcrypt, BcryptCost: 4},
+	}
+	for _, h := range hashers {
+		hash, err := h.Hash("password")
+		if err != nil {
+			t.Fatalf("%s: Hash() error: %v", h.Algorithm, err)
+		}
+		if err := Verify(hash, "password"); err != nil {
+			t.Errorf("%s: Verify() error: %v", h.Algorithm, err)
+		}
+		if err := Verify(hash, "Password"); !errors.Is(err, ErrMismatch) {
+			t.Errorf("%s: Verify() of another password error = %v, want %v", h.Algorithm, err, ErrMismatch)
+		}
+		if h.NeedsRehash(hash) {
+			t.Errorf("%s: NeedsRehash() of its own hash = true", h.Algorithm)
+		}
+	}
+}
+
+func TestValidCosts(t *testing.T) {
+	const (
+		argon2Salt = "c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+		pbkdf2Salt = "4vjV83LKPjQzk31VI4E0Vw$hsYF68OiOUPdDZ1Fg.fJPeq1h/gXXY7acBp9/6c.tmQ"
+		sha512Salt = "saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+	)
+	tests := []struct {
+		hash  string
+		valid bool
+	}{
+		{hash: "$argon2id$v=19$m=1048576,t=10,p=16$" + argon2Salt, valid: true},
+		{hash: "$argon2id$v=19$m=1048577,t=2,p=1$" + argon2Salt},
+		{hash: "$argon2id$v=19$m=4194304,t=2,p=1$" + argon2Salt},
+		{hash: "$argon2id$v=19$m=65536,t=11,p=1$" + argon2Salt},
+		{hash: "$argon2id$v=19$m=65536,t=0,p=1$" + argon2Salt},
+		{hash: "$argon2id$v=19$m=65536,t=2,p=17$" + argon2Salt},
+		{hash: "$argon2id$v=19$m=65536,t=2,p=0$" + argon2Salt},
+		{hash: "$argon2id$v=16$m=65536,t=2,p=1$" + argon2Salt},
+		// Salts of 7, 8, 64 and 65 bytes
+		{hash: "$argon2id$v=19$m=65536,t=2,p=1$" + b64(7) + "$" + b64(32)},
+		{hash: "$argon2id$v=19$m=65536,t=2,p=1$" + b64(8) + "$" + b64(32), valid: true},
+		{hash: "$argon2id$v=19$m=65536,t=2,p=1$" + b64(64) + "$" + b64(32), valid: true},
+		{hash: "$argon2id$v=19$m=65536,t=2,p=1$" + b64(65) + "$" + b64(32)},
+		// Keys of 0, 15, 16, 64, 65 and 4096 bytes
+		{hash: "$argon2id$v=19$m=65536,t=2,p=1$" + b64(16) + "$"},
+		{hash: "$argon2id$v=19$m=65536,t=2,p=1$" + b64(16) + "$" + b64(15)},
+		{hash: "$argon2id$v=19$m=65536,t=2,p=1$" + b64(16) + "$" + b64(16), valid: true},
+		{hash: "$argon2id$v=19$m=65536,t=2,p=1$" + b64(16) + "$" + b64(64), valid: true},
+		{hash: "$argon2id$v=19$m=65536,t=2,p=1$" + b64(16) + "$" + b64(65)},
+		{hash: "$argon2id$v=19$m=65536,t=2,p=1$" + b64(16) + "$" + b64(4096)},
+		{hash: "$pbkdf2-sha256$2000000$" + pbkdf2Salt, valid: true},
+		{hash: "$pbkdf2-sha256$2000001$" + pbkdf2Salt},
+		{hash: "$pbkdf2-sha256$0$" + pbkdf2Salt},
+		// Salts of 64 and 65 bytes
+		{hash: "$pbkdf2-sha256$1212$" + b64(64) + "$" + b64(32), valid: true},
+		{hash: "$pbkdf2-sha256$1212$" + b64(65) + "$" + b64(32)},
+		// Checksums of 0, 31, 32, 64, 65 and 4096 bytes
+		{hash: "$pbkdf2-sha256$1212$" + b64(16) + "$"},
+		{hash: "$pbkdf2-sha256$1212$" + b64(16) + "$" + b64(31)},
+		{hash: "$pbkdf2-sha256$1212$" + b64(16) + "$" + b64(32), valid: true},
+		{hash: "$pbkdf2-sha256$1212$" + b64(16) + "$" + b64(64), valid: true},
+		{hash: "$pbkdf2-sha256$1212$" + b64(16) + "$" + b64(65)},
+		{hash: "$pbkdf2-sha256$1212$" + b64(16) + "$" + b64(4096)},
+		{hash: "$6$rounds=5000000$" + sha512Salt, valid: true},
+		{hash: "$6$rounds=5000001$" + sha512Salt},
+		{hash: "$6$rounds=999999999$" + sha512Salt},
+		{hash: "$6$rounds=x$" + sha512Salt},
+		{hash: "$6$" + strings.TrimSuffix(sha512Salt, "1")},
+		{hash: "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", valid: true},
+		{hash: "$2a$32$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"},
+		{hash: "{SSHA}DkMTwBl+a/3DQTxCYEApdUtNXGgdUac3", valid: true},
+		{hash: "{SSHA}DkMTwBl+a/3DQTxCYEApdUtNXGg="},
+		{hash: "$1$saltsalt$2vnaRpHa6Jxjz5n83ok8Z0"},
+	}
+	for _, tt := range tests {
+		if err := Valid([]byte(tt.hash)); (err == nil) != tt.valid {
+			t.Errorf("Valid(%s) error = %v, want valid %v", tt.hash, err, tt.valid)
+		}
+	}
+}
+
+func TestSameCosts(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{
+			a:    "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+			b:    "$argon2id$v=19$m=65536,t=2,p=1$ZGlmZnNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+			want: true,
+		},
+		{
+			a: "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+			b: "$argon2id$v=19$m=65536,t=1,p=1$c29tZXNhbHQ$9qWtwbpyPd3vm1rB1GThgPzZ3/ydHL92zKL+15XZypg",
+		},
+		{
+			a: "$argon2id$v=19$m=256,t=2,p=1$c29tZXNhbHQ$nf65EOgLrQMR/uIPnA4rEsF5h7TKyQwu9U1bMCHGi/4",
+			b: "$argon2id$v=19$m=256,t=2,p=2$c29tZXNhbHQ$bQk8UB/VmZZF4Oo79iDXuL5/0ttZwg2f/5U52iv1cDc",
+		},
+		{
+			a:    "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+			b:    "$2b$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+			want: true,
+		},
+		{
+			a: "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+			b: "$2a$12$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+		},
+		{
+			a:    "$pbkdf2-sha256$1212$4vjV83LKPjQzk31VI4E0Vw$hsYF68OiOUPdDZ1Fg.fJPeq1h/gXXY7acBp9/6c.tmQ",
+			b:    "$pbkdf2-sha256$1212$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLw",
+			want: true,
+		},
+		{
+			a: "$pbkdf2-sha256$1$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLxJypzM8Xm2RZkWZLOdd.8xfHG4RbHjC9UJESBB06GXgw",
+			b: "$pbkdf2-sha256$80000$TmFDbA$TdzY9guYviGDDO5e8icB.WQaRBjQTAQUrv8Ih2s0q1ah1CWhIlgzVJrbhBtRybMXaicr3ruh0HhHj2Kzl/M8jQ",
+		},
+		{
+			a: "$pbkdf2-sha256$1212$4vjV83LKPjQzk31VI4E0Vw$hsYF68OiOUPdDZ1Fg.fJPeq1h/gXXY7acBp9/6c.tmQ",
+			b: "$pbkdf2-sha256$1212$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLxJypzM8Xm2RZkWZLOdd.8xfHG4RbHjC9UJESBB06GXgw",
+		},
+		{
+			// No rounds is the default of 5000
+			a:    "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+			b:    "$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0",
+			want: true,
+		},
+		{
+			a: "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+			b: "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+		},
+		{
+			a:    "{SSHA}DkMTwBl+a/3DQTxCYEApdUtNXGgdUac3",
+			b:    "{SSHA}DkMTwBl+a/3DQTxCYEApdUtNXGgdUac3",
+			want: true,
+		},
+		{
+			a: "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+			b: "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+		},
+		{a: "not a hash", b: "not a hash"},
+	}
+	for _, tt := range tests {
+		if got := SameCosts([]byte(tt.a), []byte(tt.b)); got != tt.want {
+			t.Errorf("SameCosts(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if got := SameCosts([]byte(tt.b), []byte(tt.a)); got != tt.want {
+			t.Errorf("SameCosts(%s, %s) = %v, want %v", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+// b64 is n bytes in unpadded base64, its letters and digits are the same in the argon2id and passlib alphabets.
+func b64(n int) string {
+	return base64.RawStdEncoding.EncodeToString(bytes.Repeat([]byte{'s'}, n))
+}
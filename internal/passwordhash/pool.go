@@ -0,0 +1,164 @@
+package passwordhash
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPoolFull means the queue of a Pool is full or waiting in it took too long.
+var ErrPoolFull = errors.New("password hashing pool is full")
+
+// Pool runs hashing and verification with at most a fixed number at a time, so that
+// bursts of them can't take every core from the other requests. Callers wait in a queue
+// of bounded length for at most the queue timeout, or until their context is done.
+type Pool struct {
+	Hasher Hasher
+
+	slots        chan struct{}
+	maxQueued    int64
+	queueTimeout time.Duration
+
+	queued    atomic.Int64
+	busy      atomic.Int64
+	completed atomic.Uint64
+	rejected  atomic.Uint64
+	canceled  atomic.Uint64
+	waitNanos atomic.Int64
+	workNanos atomic.Int64
+
+	dummyOnce sync.Once
+	dummyHash []byte
+	dummyErr  error
+}
+
+// PoolStats are counters since the Pool was created, besides the Workers, Busy and Queued gauges.
+type PoolStats struct {
+	Workers   int
+	Busy      int64
+	Queued    int64
+	Completed uint64
+	Rejected  uint64
+	Canceled  uint64
+	WaitTime  time.Duration
+	WorkTime  time.Duration
+}
+
+func NewPool(h Hasher, workers int, queueSize int, queueTimeout time.Duration) *Pool {
+	return &Pool{
+		Hasher:       h,
+		slots:        make(chan struct{}, workers),
+		maxQueued:    int64(queueSize),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// Hash hashes password with the Hasher of the pool.
+func (p *Pool) Hash(ctx context.Context, password string) (hash []byte, err error) {
+	if poolErr := p.Do(ctx, func() { hash, err = p.Hasher.Hash(password) }); poolErr != nil {
+		return nil, poolErr
+	}
+	return hash, err
+}
+
+// Verify is like the package level Verify.
+func (p *Pool) Verify(ctx context.Context, hash []byte, password string) (err error) {
+	if poolErr := p.Do(ctx, func() { err = Verify(hash, password) }); poolErr != nil {
+		return poolErr
+	}
+	return err
+}
+
+// VerifyDummy takes as long as verifying a password against a hash of the Hasher, and fails
+// with ErrMismatch, so that a login of an unknown user can't be told apart by its timing.
+// This only holds for hashes of the Hasher, a legacy hash or one of other costs takes another
+// time to verify, so that its user can be told apart until a successful login rehashes it.
+func (p *Pool) VerifyDummy(ctx context.Context, password string) (err error) {
+	poolErr := p.Do(ctx, func() {
+		p.dummyOnce.Do(func() { p.dummyHash, p.dummyErr = p.Hasher.Hash("dummy password") })
+		if p.dummyErr != nil {
+			err = p.dummyErr
+			return
+		}
+		_ = Verify(p.dummyHash, password)
+		err = ErrMismatch
+	})
+	if poolErr != nil {
+		return poolErr
+	}
+	return err
+}
+
+// Do runs fn once a worker is free, it returns ErrPoolFull or the error of ctx when fn didn't run.
+func (p *Pool) Do(ctx context.Context, fn func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		if p.queued.Add(1) > p.maxQueued {
+			p.queued.Add(-1)
+			p.rejected.Add(1)
+			return ErrPoolFull
+		}
+		start := time.Now()
+		timer := time.NewTimer(p.queueTimeout)
+		var err error
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			p.canceled.Add(1)
+			err = ctx.Err()
+		case <-timer.C:
+			p.rejected.Add(1)
+			err = ErrPoolFull
+		}
+		timer.Stop()
+		p.queued.Add(-1)
+		p.waitNanos.Add(int64(time.Since(start)))
+		if err != nil {
+			return err
+		}
+	}
+	p.busy.Add(1)
+	defer func() {
+		p.busy.Add(-1)
+		<-p.slots
+	}()
+
+	start := time.Now()
+	fn()
+	p.workNanos.Add(int64(time.Since(start)))
+	p.completed.Add(1)
+	return nil
+}
+
+// RetryAfter estimates when the queue will have room again, at least a second.
+func (p *Pool) RetryAfter() time.Duration {
+	completed := p.completed.Load()
+	if completed == 0 {
+		return time.Second
+	}
+	avg := time.Duration(p.workNanos.Load() / int64(completed))
+	d := avg * time.Duration(p.queued.Load()+p.busy.Load()) / time.Duration(cap(p.slots))
+	if d < time.Second {
+		return time.Second
+	}
+	return d
+}
+
+func (p *Pool) Stats() PoolStats {
+	return PoolStats{
+		Workers:   cap(p.slots),
+		Busy:      p.busy.Load(),
+		Queued:    p.queued.Load(),
+		Completed: p.completed.Load(),
+		Rejected:  p.rejected.Load(),
+		Canceled:  p.canceled.Load(),
+		WaitTime:  time.Duration(p.waitNanos.Load()),
+		WorkTime:  time.Duration(p.workNanos.Load()),
+	}
+}
@@ -0,0 +1,146 @@
+package passwordpolicy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxLineBytes bounds a line of a breached passwords file, "<40 hex>:<count>\r\n" is far shorter.
+const maxLineBytes = 256
+
+// Breached looks passwords up offline in the Have I Been Pwned Pwned Passwords data,
+// by the SHA-1 of the password. Path is either the file ordered by hash, with lines
+// like <SHA-1>:<count>, which is binary searched without loading it, or a directory of
+// range files named <first 5 hex of the SHA-1>.txt with lines like <remaining 35 hex>:<count>,
+// as served by the range API.
+type Breached struct {
+	Path string
+	dir  bool
+}
+
+// OpenBreached checks that path exists.
+func OpenBreached(path string) (*Breached, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening breached passwords: %w", err)
+	}
+	return &Breached{Path: path, dir: fi.IsDir()}, nil
+}
+
+func (b *Breached) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	if b.dir {
+		return b.containsInRange(hash)
+	}
+	return b.containsInOrdered(hash)
+}
+
+func (b *Breached) containsInRange(hash string) (bool, error) {
+	f, err := os.Open(filepath.Join(b.Path, hash[:5]+".txt"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error opening breached passwords range: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if strings.EqualFold(hashOfLine(sc.Bytes()), hash[5:]) {
+			return true, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return false, fmt.Errorf("error reading breached passwords range: %w", err)
+	}
+	return false, nil
+}
+
+// containsInOrdered binary searches the byte offsets of the file, [lo, hi) holds the
+// offsets where the line with hash may start.
+func (b *Breached) containsInOrdered(hash string) (bool, error) {
+	f, err := os.Open(b.Path)
+	if err != nil {
+		return false, fmt.Errorf("error opening breached passwords: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, fmt.Errorf("error opening breached passwords: %w", err)
+	}
+
+	lo, hi := int64(0), fi.Size()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, line, err := lineFrom(f, mid, fi.Size())
+		if err != nil {
+			return false, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+		switch c := strings.Compare(strings.ToUpper(hashOfLine(line)), hash); {
+		case c == 0:
+			return true, nil
+		case c < 0:
+			lo = start + int64(len(line)) + 1
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// lineFrom returns the first line starting at or after off, start is size when there is none.
+func lineFrom(r io.ReaderAt, off int64, size int64) (start int64, line []byte, err error) {
+	start = off
+	if off > 0 {
+		buf := make([]byte, maxLineBytes)
+		n, err := r.ReadAt(buf, off-1)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, nil, fmt.Errorf("error reading breached passwords: %w", err)
+		}
+		i := bytes.IndexByte(buf[:n], '\n')
+		if i < 0 {
+			if off-1+int64(n) >= size {
+				return size, nil, nil
+			}
+			return 0, nil, errors.New("error reading breached passwords: line too long")
+		}
+		start = off + int64(i)
+	}
+	if start >= size {
+		return size, nil, nil
+	}
+
+	buf := make([]byte, maxLineBytes)
+	n, err := r.ReadAt(buf, start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, nil, fmt.Errorf("error reading breached passwords: %w", err)
+	}
+	line = buf[:n]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	} else if start+int64(n) < size {
+		return 0, nil, errors.New("error reading breached passwords: line too long")
+	}
+	return start, line, nil
+}
+
+func hashOfLine(line []byte) string {
+	s := string(bytes.TrimRight(line, "\r"))
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
@@ -0,0 +1,143 @@
+package passwordpolicy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fixture is a few lines of the Pwned Passwords SHA-1 file ordered by hash, with its CRLF line endings.
+const fixture = "testdata/pwned-passwords-sha1-ordered-by-hash.txt"
+
+func TestContainsInOrdered(t *testing.T) {
+	tests := []struct {
+		name string
+		hash string
+		want bool
+	}{
+		{name: "first line", hash: "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8", want: true},
+		{name: "second line", hash: "7C4A8D09CA3762AF61E59520943DC26494F8941B", want: true},
+		{name: "middle line", hash: "ABF7AAD6438836DBE526AA231ABDE2D0EEF74D42", want: true},
+		{name: "line before last", hash: "B7A875FC1EA228B9061041B7CEC4BD3C52AB3CE3", want: true},
+		{name: "last line", hash: "EE8D8728F435FD550F83852AABAB5234CE1DA528", want: true},
+		{name: "before first line", hash: "0000000000000000000000000000000000000000"},
+		{name: "between lines", hash: "96ADC644E2F986B251869735F8808602B9604B19"},
+		{name: "prefix of a line", hash: "ABF7AAD6438836DBE526AA231ABDE2D0EEF74D4"},
+		{name: "after last line", hash: "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"},
+	}
+	lines := readFixture(t)
+	files := map[string]string{
+		"crlf":                lines,
+		"lf":                  strings.ReplaceAll(lines, "\r\n", "\n"),
+		"no trailing newline": strings.TrimSuffix(lines, "\r\n"),
+		"lower case":          strings.ToLower(lines),
+	}
+	for file, content := range files {
+		b := &Breached{Path: writeFile(t, content)}
+		for _, tt := range tests {
+			t.Run(file+"/"+tt.name, func(t *testing.T) {
+				got, err := b.containsInOrdered(tt.hash)
+				if err != nil {
+					t.Fatalf("containsInOrdered() error: %v", err)
+				}
+				if got != tt.want {
+					t.Errorf("containsInOrdered(%s) = %v, want %v", tt.hash, got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestContainsInOrderedSmallFiles(t *testing.T) {
+	const hash = "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8"
+	tests := []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{name: "empty", content: ""},
+		{name: "single line", content: hash + ":9545824\r\n", want: true},
+		{name: "single other line", content: "7C4A8D09CA3762AF61E59520943DC26494F8941B:37359195\r\n"},
+		{name: "hash only", content: hash, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := (&Breached{Path: writeFile(t, tt.content)}).containsInOrdered(hash)
+			if err != nil {
+				t.Fatalf("containsInOrdered() error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("containsInOrdered() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainsInOrderedLineTooLong(t *testing.T) {
+	content := "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:" + strings.Repeat("9", maxLineBytes) + "\r\n" +
+		"7C4A8D09CA3762AF61E59520943DC26494F8941B:37359195\r\n"
+	if _, err := (&Breached{Path: writeFile(t, content)}).containsInOrdered("0000000000000000000000000000000000000000"); err == nil {
+		t.Error("containsInOrdered() error = nil, want line too long")
+	}
+}
+
+func TestContains(t *testing.T) {
+	lines := readFixture(t)
+	rangeDir := t.TempDir()
+	for _, line := range strings.Split(strings.TrimSpace(lines), "\r\n") {
+		f, err := os.OpenFile(filepath.Join(rangeDir, line[:5]+".txt"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString(line[5:] + "\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{password: "password", want: true},
+		{password: "123456", want: true},
+		{password: "iloveyou", want: true},
+		{password: "correct horse battery staple", want: true},
+		{password: "Password"},
+		{password: "not-breached-Zx9!q"},
+	}
+	for _, path := range []string{fixture, rangeDir} {
+		b, err := OpenBreached(path)
+		if err != nil {
+			t.Fatalf("OpenBreached() error: %v", err)
+		}
+		for _, tt := range tests {
+			got, err := b.Contains(tt.password)
+			if err != nil {
+				t.Fatalf("Contains() error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("%s: Contains(%q) = %v, want %v", path, tt.password, got, tt.want)
+			}
+		}
+	}
+}
+
+func readFixture(t *testing.T) string {
+	t.Helper()
+	b, err := os.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pwned-passwords.txt")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,164 @@
+package passwordpolicy
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordhash"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxBytes is the most bcrypt hashes, it silently ignores anything after it.
+const MaxBytes = 72
+
+const (
+	RuleMinLength   = "minLength"
+	RuleMaxBytes    = "maxBytes"
+	RuleCharClasses = "charClasses"
+	RuleUsername    = "username"
+	RuleDictionary  = "dictionary"
+	RuleBreached    = "breached"
+	RuleHistory     = "history"
+)
+
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Error lists every rule a password violates.
+type Error struct {
+	Violations []Violation
+}
+
+func (e *Error) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return "password does not satisfy the policy: " + strings.Join(messages, "; ")
+}
+
+type Policy struct {
+	// MinLength is in characters
+	MinLength int
+	// MaxBytes is in UTF-8 bytes and at most MaxBytes
+	MaxBytes int
+	// MinCharClasses is how many of lowercase, uppercase, digits and symbols are required
+	MinCharClasses int
+	// DisallowUsername rejects passwords containing the username
+	DisallowUsername bool
+	// Dictionary holds lowercase words which may not be used as the password
+	Dictionary map[string]bool
+	// Breached is checked when not nil
+	Breached *Breached
+	// HistorySize is how many previous passwords may not be reused, besides the current one
+	HistorySize int
+}
+
+// Check returns an *Error when password violates p, any other error means a rule couldn't be checked.
+// A nil Policy accepts any password.
+func (p *Policy) Check(password string, username string) error {
+	if p == nil {
+		return nil
+	}
+	var violations []Violation
+	check := func(ok bool, rule string, format string, a ...any) {
+		if !ok {
+			violations = append(violations, Violation{Rule: rule, Message: fmt.Sprintf(format, a...)})
+		}
+	}
+
+	check(utf8.RuneCountInString(password) >= p.MinLength, RuleMinLength,
+		"password should be at least %d characters", p.MinLength)
+	check(len(password) <= p.MaxBytes, RuleMaxBytes,
+		"password should be at most %d bytes", p.MaxBytes)
+	check(charClasses(password) >= p.MinCharClasses, RuleCharClasses,
+		"password should contain at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinCharClasses)
+	if p.DisallowUsername && username != "" {
+		check(!strings.Contains(strings.ToLower(password), strings.ToLower(username)), RuleUsername,
+			"password should not contain the username")
+	}
+	if len(p.Dictionary) > 0 {
+		check(!p.Dictionary[dictionaryForm(password)], RuleDictionary,
+			"password should not be a dictionary word")
+	}
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		check(!breached, RuleBreached, "password has appeared in a data breach")
+	}
+
+	if len(violations) > 0 {
+		return &Error{Violations: violations}
+	}
+	return nil
+}
+
+// CheckReuse returns an *Error when password matches any of hashes,
+// the hashes of the current and previous passwords.
+func (p *Policy) CheckReuse(password string, hashes [][]byte) error {
+	if p == nil || p.HistorySize <= 0 {
+		return nil
+	}
+	for _, h := range hashes {
+		if passwordhash.Verify(h, password) == nil {
+			return &Error{Violations: []Violation{{
+				Rule:    RuleHistory,
+				Message: fmt.Sprintf("password should not be the current or any of the last %d passwords", p.HistorySize),
+			}}}
+		}
+	}
+	return nil
+}
+
+func charClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// dictionaryForm lowercases password and trims the digits and symbols around it,
+// so that padding a word like in Password123! doesn't get past the dictionary.
+func dictionaryForm(password string) string {
+	return strings.TrimFunc(strings.ToLower(password), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+}
+
+// LoadDictionary reads one word per line, empty lines and lines starting with # are skipped.
+func LoadDictionary(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening dictionary: %w", err)
+	}
+	defer f.Close()
+	words := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		w := strings.TrimSpace(sc.Text())
+		if w == "" || strings.HasPrefix(w, "#") {
+			continue
+		}
+		words[strings.ToLower(w)] = true
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("error reading dictionary: %s: %w", path, err)
+	}
+	return words, nil
+}
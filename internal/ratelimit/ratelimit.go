@@ -0,0 +1,129 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit allows Requests per Period, as a token bucket holding Requests tokens which refills
+// over Period, so that a burst of up to Requests is allowed after being idle.
+// A zero Requests is no limit.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+func (l Limit) Enabled() bool {
+	return l.Requests > 0
+}
+
+// rate is the refill rate in tokens per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// Result is the state of a bucket after taking from it.
+type Result struct {
+	Allowed bool
+	// Remaining is how many whole tokens are left
+	Remaining int
+	// RetryAfter is how long until a token is available when not Allowed
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// Store keeps the buckets, it is in memory by default, a Store shared by every
+// instance makes the limits apply to the service as a whole.
+type Store interface {
+	// Take takes a token from the bucket of key with limit l, a new bucket is full.
+	Take(ctx context.Context, key string, l Limit, now time.Time) (Result, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket is full again, so that it can be forgotten
+	full time.Time
+}
+
+// MemoryStore keeps the buckets of a single instance, Sweep has to be called regularly
+// to forget the buckets which have refilled.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+func (s *MemoryStore) Take(_ context.Context, key string, l Limit, now time.Time) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	capacity, rate := float64(l.Requests), l.rate()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		s.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * rate
+		b.updated = now
+	}
+	// Also when the limit has been lowered since
+	if b.tokens > capacity {
+		b.tokens = capacity
+	}
+
+	r := Result{}
+	if b.tokens >= 1 {
+		b.tokens--
+		r.Allowed = true
+	} else {
+		r.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+	r.Remaining = int(math.Floor(b.tokens))
+	r.Reset = seconds((capacity - b.tokens) / rate)
+	b.full = now.Add(r.Reset)
+	return r, nil
+}
+
+// Sweep forgets the buckets which are full by now, they are the same as new ones.
+func (s *MemoryStore) Sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, k)
+		}
+	}
+}
+
+// Len is how many buckets are kept.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buckets)
+}
+
+// SweepEvery calls Sweep every interval until ctx is done.
+func (s *MemoryStore) SweepEvery(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.Sweep(now)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
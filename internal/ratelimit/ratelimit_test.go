@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func take(t *testing.T, s *MemoryStore, key string, l Limit, now time.Time) Result {
+	t.Helper()
+	r, err := s.Take(context.Background(), key, l, now)
+	if err != nil {
+		t.Fatalf("Take() error: %v", err)
+	}
+	return r
+}
+
+func TestMemoryStoreBurst(t *testing.T) {
+	s := NewMemoryStore()
+	l := Limit{Requests: 3, Period: 3 * time.Second}
+	for i := 2; i >= 0; i-- {
+		r := take(t, s, "k", l, start)
+		if !r.Allowed || r.Remaining != i {
+			t.Fatalf("Take() = %+v, want allowed with %d remaining", r, i)
+		}
+		if want := time.Duration(3-i) * time.Second; r.Reset != want {
+			t.Errorf("Take() reset = %v, want %v", r.Reset, want)
+		}
+	}
+	r := take(t, s, "k", l, start)
+	if r.Allowed || r.Remaining != 0 || r.RetryAfter != time.Second || r.Reset != 3*time.Second {
+		t.Errorf("Take() = %+v, want denied, retry after 1s and reset in 3s", r)
+	}
+}
+
+func TestMemoryStoreRefill(t *testing.T) {
+	s := NewMemoryStore()
+	l := Limit{Requests: 2, Period: 2 * time.Second}
+	take(t, s, "k", l, start)
+	take(t, s, "k", l, start)
+	if r := take(t, s, "k", l, start.Add(500*time.Millisecond)); r.Allowed || r.RetryAfter != 500*time.Millisecond {
+		t.Errorf("Take() after 0.5s = %+v, want denied, retry after 0.5s", r)
+	}
+	if r := take(t, s, "k", l, start.Add(time.Second)); !r.Allowed || r.Remaining != 0 {
+		t.Errorf("Take() after 1s = %+v, want allowed with 0 remaining", r)
+	}
+	// Idle for longer than the period doesn't fill the bucket over its capacity
+	if r := take(t, s, "k", l, start.Add(time.Minute)); !r.Allowed || r.Remaining != 1 {
+		t.Errorf("Take() after 1m = %+v, want allowed with 1 remaining", r)
+	}
+}
+
+func TestMemoryStoreKeys(t *testing.T) {
+	s := NewMemoryStore()
+	l := Limit{Requests: 1, Period: time.Minute}
+	if r := take(t, s, "a", l, start); !r.Allowed {
+		t.Errorf("Take(a) = %+v, want allowed", r)
+	}
+	if r := take(t, s, "b", l, start); !r.Allowed {
+		t.Errorf("Take(b) = %+v, want allowed", r)
+	}
+	if r := take(t, s, "a", l, start); r.Allowed {
+		t.Errorf("Take(a) again = %+v, want denied", r)
+	}
+}
+
+func TestMemoryStoreLoweredLimit(t *testing.T) {
+	s := NewMemoryStore()
+	take(t, s, "k", Limit{Requests: 10, Period: 10 * time.Second}, start)
+	l := Limit{Requests: 2, Period: 2 * time.Second}
+	if r := take(t, s, "k", l, start); !r.Allowed || r.Remaining != 1 {
+		t.Errorf("Take() with lowered limit = %+v, want allowed with 1 remaining", r)
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	s := NewMemoryStore()
+	l := Limit{Requests: 2, Period: 2 * time.Second}
+	take(t, s, "once", l, start)
+	take(t, s, "twice", l, start)
+	take(t, s, "twice", l, start)
+
+	s.Sweep(start.Add(time.Second))
+	if s.Len() != 1 {
+		t.Errorf("Len() after 1s = %d, want 1, the bucket taken from twice isn't full", s.Len())
+	}
+	if r := take(t, s, "twice", l, start.Add(time.Second)); !r.Allowed || r.Remaining != 0 {
+		t.Errorf("Take() of the kept bucket = %+v, want allowed with 0 remaining", r)
+	}
+	s.Sweep(start.Add(3 * time.Second))
+	if s.Len() != 0 {
+		t.Errorf("Len() after 3s = %d, want 0", s.Len())
+	}
+}
+
+func TestLimitEnabled(t *testing.T) {
+	if (Limit{}).Enabled() {
+		t.Error("Enabled() of zero Limit = true")
+	}
+	if !(Limit{Requests: 1, Period: time.Second}).Enabled() {
+		t.Error("Enabled() = false")
+	}
+}
@@ -0,0 +1,228 @@
+package seed
+
+import (
+	"context"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordhash"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/usernames"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/validation"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sort"
+	"strings"
+)
+
+// File lists the users managed by reconcile, YAML or JSON.
+type File struct {
+	// Prune removes users which are not listed
+	Prune bool   `yaml:"prune"`
+	Users []User `yaml:"users"`
+}
+
+type User struct {
+	Username string `yaml:"username"`
+	Role     string `yaml:"role"`
+	Info     string `yaml:"info"`
+	// Only one of PasswordHash, a hash in a format passwordhash verifies, or PasswordEnv, the name of an environment variable
+	// holding the plaintext password, should be set. A PasswordHash is only restored while the stored hash has
+	// its costs, once rehashed on login with other costs the password can't be compared with it.
+	PasswordHash string `yaml:"passwordHash"`
+	PasswordEnv  string `yaml:"passwordEnv"`
+}
+
+type ActionKind string
+
+const (
+	ActionCreate         ActionKind = "create"
+	ActionUpdateRole     ActionKind = "update-role"
+	ActionUpdateInfo     ActionKind = "update-info"
+	ActionUpdatePassword ActionKind = "update-password"
+	ActionDelete         ActionKind = "delete"
+)
+
+type Action struct {
+	Kind     ActionKind
+	Username string
+	From     string
+	To       string
+
+	user     database.User
+	password []byte
+}
+
+func (a Action) String() string {
+	switch a.Kind {
+	case ActionCreate:
+		return fmt.Sprintf("+ create %s (role: %s)", a.Username, a.To)
+	case ActionDelete:
+		return fmt.Sprintf("- delete %s", a.Username)
+	case ActionUpdatePassword:
+		return fmt.Sprintf("~ %s %s", a.Kind, a.Username)
+	default:
+		return fmt.Sprintf("~ %s %s: %q -> %q", a.Kind, a.Username, a.From, a.To)
+	}
+}
+
+func Load(path string) (File, error) {
+	f := File{}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return f, fmt.Errorf("error reading seed file: %s: %w", path, err)
+	}
+	// YAML is a superset of JSON, so this reads both
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return f, fmt.Errorf("error decoding seed file: %s: %w", path, err)
+	}
+	if err := f.Validate(); err != nil {
+		return f, err
+	}
+	// Compared with the stored usernames, which are normalized
+	for i := range f.Users {
+		f.Users[i].Username = usernames.Key(f.Users[i].Username)
+	}
+	return f, nil
+}
+
+func (f File) Validate() error {
+	var invalid []string
+	seen := make(map[string]bool)
+	for i, u := range f.Users {
+		if u.Username == "" {
+			invalid = append(invalid, fmt.Sprintf("users[%d]: username must not be empty", i))
+			continue
+		}
+		key, err := usernames.Normalize(u.Username)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("users[%d]: %v", i, err))
+		} else if seen[key] {
+			invalid = append(invalid, fmt.Sprintf("users[%d]: duplicate username: %s", i, u.Username))
+		}
+		seen[key] = true
+		if err := validation.Role(u.Role); err != nil {
+			invalid = append(invalid, fmt.Sprintf("users[%d]: %v", i, err))
+		}
+		if (u.PasswordHash == "") == (u.PasswordEnv == "") {
+			invalid = append(invalid, fmt.Sprintf("users[%d]: exactly one of passwordHash or passwordEnv must be set", i))
+		}
+		if u.PasswordHash != "" {
+			if err := validation.PasswordHash(u.PasswordHash); err != nil {
+				invalid = append(invalid, fmt.Sprintf("users[%d]: %v", i, err))
+			}
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid seed file:\n  %s", strings.Join(invalid, "\n  "))
+	}
+	return nil
+}
+
+// Plan compares the seed file with UserDB and returns the actions needed to reconcile them.
+// Passwords from PasswordEnv are hashed with hasher.
+func Plan(ctx context.Context, db database.UserDatabase, f File, hasher passwordhash.Hasher) ([]Action, error) {
+	existing, err := db.FindAllUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byUsername := make(map[string]database.User)
+	for _, u := range existing {
+		byUsername[u.Username] = u
+	}
+
+	var actions []Action
+	managed := make(map[string]bool)
+	for _, su := range f.Users {
+		managed[su.Username] = true
+
+		u, ok := byUsername[su.Username]
+		if !ok {
+			password, err := su.password(hasher)
+			if err != nil {
+				return nil, err
+			}
+			actions = append(actions, Action{
+				Kind:     ActionCreate,
+				Username: su.Username,
+				To:       su.Role,
+				user:     database.User{Username: su.Username, Password: password, Role: su.Role, Info: su.Info},
+			})
+			continue
+		}
+		if u.Role != su.Role {
+			actions = append(actions, Action{Kind: ActionUpdateRole, Username: su.Username, From: u.Role, To: su.Role})
+		}
+		if u.Info != su.Info {
+			actions = append(actions, Action{Kind: ActionUpdateInfo, Username: su.Username, From: u.Info, To: su.Info})
+		}
+		if su.passwordDrifted(u.Password) {
+			password, err := su.password(hasher)
+			if err != nil {
+				return nil, err
+			}
+			actions = append(actions, Action{Kind: ActionUpdatePassword, Username: su.Username, password: password})
+		}
+	}
+
+	if f.Prune {
+		var unmanaged []string
+		for username := range byUsername {
+			if !managed[username] {
+				unmanaged = append(unmanaged, username)
+			}
+		}
+		sort.Strings(unmanaged)
+		for _, username := range unmanaged {
+			actions = append(actions, Action{Kind: ActionDelete, Username: username})
+		}
+	}
+	return actions, nil
+}
+
+// Apply applies the actions in order, stopping at the first error.
+func Apply(ctx context.Context, db database.UserDatabase, actions []Action) error {
+	for _, a := range actions {
+		var err error
+		switch a.Kind {
+		case ActionCreate:
+			_, err = db.InsertUser(ctx, a.user)
+		case ActionUpdateRole:
+			err = db.UpdateUserRole(ctx, a.Username, a.To)
+		case ActionUpdateInfo:
+			err = db.UpdateUserInfo(ctx, a.Username, a.To)
+		case ActionUpdatePassword:
+			err = db.UpdateUserPassword(ctx, a.Username, a.password, false)
+		case ActionDelete:
+			err = db.DeleteUserByUsername(ctx, a.Username)
+		}
+		if err != nil {
+			return fmt.Errorf("error applying %s: %w", a, err)
+		}
+	}
+	return nil
+}
+
+// password returns the hash to store for u.
+func (u User) password(hasher passwordhash.Hasher) ([]byte, error) {
+	if u.PasswordHash != "" {
+		return []byte(u.PasswordHash), nil
+	}
+	plain, ok := os.LookupEnv(u.PasswordEnv)
+	if !ok || plain == "" {
+		return nil, fmt.Errorf("password env %s of user %s is not set", u.PasswordEnv, u.Username)
+	}
+	hashed, err := hasher.Hash(plain)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing password of user %s: %w", u.Username, err)
+	}
+	return hashed, nil
+}
+
+// passwordDrifted reports whether the stored password isn't the one of u. A PasswordHash is only
+// compared with a stored hash of the same costs, logging in rehashes it when the configured
+// costs are higher, and the rehashed password is still the one of the seed file.
+func (u User) passwordDrifted(stored []byte) bool {
+	if u.PasswordHash != "" {
+		return passwordhash.SameCosts([]byte(u.PasswordHash), stored) && u.PasswordHash != string(stored)
+	}
+	return passwordhash.Verify(stored, os.Getenv(u.PasswordEnv)) != nil
+}
@@ -0,0 +1,43 @@
+package seed
+
+import (
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordhash"
+	"testing"
+)
+
+func TestPasswordDrifted(t *testing.T) {
+	seeded := passwordhash.Hasher{Algorithm: passwordhash.AlgorithmBcrypt, BcryptCost: 4}
+	rehashed := passwordhash.Hasher{Algorithm: passwordhash.AlgorithmArgon2id, Argon2: passwordhash.Argon2Params{
+		Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32,
+	}}
+	hash := func(h passwordhash.Hasher, password string) []byte {
+		t.Helper()
+		b, err := h.Hash(password)
+		if err != nil {
+			t.Fatalf("error hashing: %v", err)
+		}
+		return b
+	}
+	seedHash := hash(seeded, "seed-password")
+	t.Setenv("SEED_PASSWORD", "seed-password")
+
+	tests := []struct {
+		name   string
+		user   User
+		stored []byte
+		want   bool
+	}{
+		{name: "same hash", user: User{PasswordHash: string(seedHash)}, stored: seedHash},
+		{name: "changed with same costs", user: User{PasswordHash: string(seedHash)}, stored: hash(seeded, "other"), want: true},
+		{name: "rehashed on login", user: User{PasswordHash: string(seedHash)}, stored: hash(rehashed, "seed-password")},
+		{name: "env password kept", user: User{PasswordEnv: "SEED_PASSWORD"}, stored: hash(rehashed, "seed-password")},
+		{name: "env password changed", user: User{PasswordEnv: "SEED_PASSWORD"}, stored: hash(seeded, "other"), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.user.passwordDrifted(tt.stored); got != tt.want {
+				t.Errorf("passwordDrifted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
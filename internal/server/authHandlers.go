@@ -0,0 +1,257 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/accesstoken"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/context"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordhash"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/usernames"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/validation"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// loginResponse is the response of the routes completing a login, with MFARequired
+// the MFAToken has to be sent with the second factor to /auth/login/mfa for the access token.
+type loginResponse struct {
+	AccessToken string `json:"accessToken,omitempty"`
+	TokenType   string `json:"tokenType,omitempty"`
+	ExpiresIn   int    `json:"expiresIn"`
+	// PasswordChangeRequired means the token can only be used to change the password
+	PasswordChangeRequired bool `json:"passwordChangeRequired,omitempty"`
+	// MFAEnrollmentRequired means the token can only be used to enroll a second factor
+	MFAEnrollmentRequired bool   `json:"mfaEnrollmentRequired,omitempty"`
+	MFARequired           bool   `json:"mfaRequired,omitempty"`
+	MFAToken              string `json:"mfaToken,omitempty"`
+}
+
+// newLoginResponse issues the access token of u authenticated with amr for the session of r, restricted
+// to changing the password or enrolling a second factor when either is required.
+func (s Server) newLoginResponse(r *http.Request, u database.User, amr []string) (loginResponse, error) {
+	now := time.Now()
+	sid, err := s.issueSession(r, u, now, now.Add(s.Auth.AccessTokenTTL))
+	if err != nil {
+		return loginResponse{}, err
+	}
+	claims := accesstoken.Claims{Subject: u.ID.Hex(), Role: u.Role, AMR: amr, SessionID: sid}
+	switch {
+	case u.MustChangePassword:
+		claims.Scope = accesstoken.ScopePasswordChange
+	case s.MFA.RequireForAdmins && u.Role == validation.RoleAdmin && !u.MFA.Enabled():
+		claims.Scope = accesstoken.ScopeMFAEnrollment
+	}
+	at, err := accesstoken.NewWithClaims(s.Settings.Load().AccessTokenKeys[0], claims, s.Auth.AccessTokenTTL)
+	if err != nil {
+		return loginResponse{}, err
+	}
+	return loginResponse{
+		AccessToken:            string(at),
+		TokenType:              "Bearer",
+		ExpiresIn:              int(s.Auth.AccessTokenTTL.Seconds()),
+		PasswordChangeRequired: claims.Scope == accesstoken.ScopePasswordChange,
+		MFAEnrollmentRequired:  claims.Scope == accesstoken.ScopeMFAEnrollment,
+	}, nil
+}
+
+func (s Server) loginHandler() http.HandlerFunc {
+	type request struct {
+		// Username may be a verified email when Auth.LoginWithEmail is enabled
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("loginHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if req.Username == "" || req.Password == "" {
+			http.Error(w, "username and password must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		var u database.User
+		var err error
+		// throttled is the name failed logins are counted for, which is the entered one normalized for unknown users
+		throttled := usernames.Key(req.Username)
+		if s.Auth.LoginWithEmail && strings.Contains(req.Username, "@") {
+			throttled = database.NormalizeEmail(req.Username)
+			u, err = s.UserDB.FindUserByEmail(r.Context(), throttled)
+			if err == nil && !u.EmailVerified {
+				err = mongo.ErrNoDocuments
+			}
+		} else {
+			u, err = s.UserDB.FindUserByUsername(r.Context(), req.Username)
+		}
+		found := err == nil
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("loginHandler: Error getting User, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if found {
+			throttled = u.Username
+		}
+
+		ip, now := s.clientIP(r), time.Now()
+		wait, err := s.loginRetryAfter(r, throttled, ip, now)
+		if err != nil {
+			log.Printf("loginHandler: Error getting failed logins, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if wait > 0 {
+			writeTooManyLogins(w, wait)
+			return
+		}
+
+		// Unknown users are verified against a dummy hash, so that they take as long as known ones.
+		// Failures against legacy or cheaper hashes are verified against it too, so that they take
+		// at least as long, though still longer than unknown users by the cost of the stored hash.
+		if found {
+			err = s.Passwords.Verify(r.Context(), u.Password, req.Password)
+			if errors.Is(err, passwordhash.ErrMismatch) && s.Passwords.Hasher.NeedsRehash(u.Password) {
+				_ = s.Passwords.VerifyDummy(r.Context(), req.Password)
+			}
+		} else {
+			err = s.Passwords.VerifyDummy(r.Context(), req.Password)
+		}
+		if err != nil {
+			if s.hashingUnavailable(w, err) {
+				return
+			}
+			if !errors.Is(err, passwordhash.ErrMismatch) {
+				log.Printf("loginHandler: Error verifying password, username: %s, err: %v", throttled, err)
+			}
+			if err := s.recordLoginFailure(r, throttled, ip, now); err != nil {
+				log.Printf("loginHandler: Error recording failed login, err: %v", err)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		s.rehashPassword(r.Context(), u, req.Password)
+
+		if !u.MustChangePassword && s.Auth.PasswordMaxAge > 0 && time.Since(u.PasswordChangedAt) > s.Auth.PasswordMaxAge {
+			if err := s.UserDB.UpdateUserMustChangePassword(r.Context(), u.Username, true); err != nil {
+				log.Printf("loginHandler: Error marking expired password, err: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			u.MustChangePassword = true
+		}
+
+		if u.MFA.Enabled() {
+			mfaToken, err := accesstoken.NewMFAChallenge(s.Settings.Load().AccessTokenKeys[0], u.ID.Hex(), s.MFA.ChallengeTTL)
+			if err != nil {
+				log.Printf("loginHandler: Error creating MFA token, err: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			s.writeJsonResponse(w, loginResponse{
+				ExpiresIn:   int(s.MFA.ChallengeTTL.Seconds()),
+				MFARequired: true,
+				MFAToken:    string(mfaToken),
+			}, http.StatusOK)
+			return
+		}
+		// With MFA failed logins are only forgotten by mfaLoginHandler, once the second factor is verified
+		if err := s.clearLoginFailures(r, u.Username); err != nil {
+			log.Printf("loginHandler: Error clearing failed logins, err: %v", err)
+		}
+
+		resp, err := s.newLoginResponse(r, u, []string{accesstoken.AMRPassword})
+		if err != nil {
+			log.Printf("loginHandler: Error creating access token, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		s.writeJsonResponse(w, resp, http.StatusOK)
+	}
+}
+
+// changePasswordHandler changes the password of the calling user, it is the only route
+// allowed for the restricted tokens issued when the password has to be changed.
+func (s Server) changePasswordHandler() http.HandlerFunc {
+	type request struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	type response struct {
+		Success bool `json:"success"`
+		loginResponse
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("changePasswordHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if req.CurrentPassword == "" || req.NewPassword == "" {
+			http.Error(w, "currentPassword and newPassword must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		uc, err := context.GetUserContext(r.Context())
+		if err != nil {
+			log.Printf("changePasswordHandler: Error getting user context, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		u, err := s.UserDB.FindUserByID(r.Context(), uc.UserID)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			log.Printf("changePasswordHandler: Error getting User, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if err := s.Passwords.Verify(r.Context(), u.Password, req.CurrentPassword); err != nil {
+			if s.hashingUnavailable(w, err) {
+				return
+			}
+			if !errors.Is(err, passwordhash.ErrMismatch) {
+				log.Printf("changePasswordHandler: Error verifying password, username: %s, err: %v", u.Username, err)
+			}
+			http.Error(w, "current password is incorrect", http.StatusForbidden)
+			return
+		}
+		if !s.checkPassword(w, r, req.NewPassword, u.Username) {
+			return
+		}
+
+		hashedPassword, err := s.hashPassword(r.Context(), req.NewPassword)
+		if err != nil {
+			if s.hashingUnavailable(w, err) {
+				return
+			}
+			log.Printf("changePasswordHandler: Error hashing password, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if err := s.UserDB.UpdateUserPassword(r.Context(), u.Username, hashedPassword, false); err != nil {
+			log.Printf("changePasswordHandler: Error updating password, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// A new access token, so that a restricted one doesn't have to log in again
+		u.MustChangePassword = false
+		resp, err := s.newLoginResponse(r, u, uc.AMR)
+		if err != nil {
+			log.Printf("changePasswordHandler: Error creating access token, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		s.writeJsonResponse(w, response{Success: true, loginResponse: resp}, http.StatusOK)
+	}
+}
@@ -0,0 +1,347 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordhash"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordpolicy"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/validation"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/sync/errgroup"
+	"log"
+	"net/http"
+)
+
+const maxBatchOperations = 100
+
+const (
+	batchModeAtomic     = "atomic"
+	batchModeBestEffort = "best-effort"
+)
+
+const (
+	opCreate         = "create"
+	opUpdatePassword = "update-password"
+	opUpdateRole     = "update-role"
+	opUpdateInfo     = "update-info"
+	opDelete         = "delete"
+)
+
+const (
+	opStatusOK         = "ok"
+	opStatusUnchanged  = "unchanged"
+	opStatusInvalid    = "invalid"
+	opStatusNotFound   = "not-found"
+	opStatusDuplicate  = "duplicate"
+	opStatusConflict   = "conflict"
+	opStatusFailed     = "failed"
+	opStatusRolledBack = "rolled-back"
+	opStatusSkipped    = "skipped"
+)
+
+type batchOperation struct {
+	Op       string `json:"op"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// PasswordHash is a pre-hashed password for create, in place of Password
+	PasswordHash string `json:"passwordHash"`
+	Role         string `json:"role"`
+	Info         string `json:"info"`
+
+	// hashedPassword is the hash of Password by hashBatchPasswords
+	hashedPassword []byte
+}
+
+type batchOperationResult struct {
+	Index    int    `json:"index"`
+	Op       string `json:"op"`
+	Username string `json:"username"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+var errBatchOperationFailed = errors.New("batch operation failed")
+
+func (s Server) batchHandler() http.HandlerFunc {
+	type request struct {
+		Mode       string           `json:"mode"`
+		Operations []batchOperation `json:"operations"`
+	}
+	type response struct {
+		Success bool                   `json:"success"`
+		Mode    string                 `json:"mode"`
+		Results []batchOperationResult `json:"results"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("batchHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		if req.Mode != batchModeAtomic && req.Mode != batchModeBestEffort {
+			http.Error(w, "mode should be atomic or best-effort", http.StatusBadRequest)
+			return
+		}
+		if len(req.Operations) == 0 || len(req.Operations) > maxBatchOperations {
+			http.Error(w, fmt.Sprintf("operations should have 1 to %d items", maxBatchOperations), http.StatusBadRequest)
+			return
+		}
+
+		results := make([]batchOperationResult, len(req.Operations))
+		valid, conflict := true, false
+		for i, op := range req.Operations {
+			results[i] = batchOperationResult{Index: i, Op: op.Op, Username: op.Username}
+			err := op.validate()
+			if err == nil && op.Op == opCreate {
+				op.Username, err = s.UsernamePolicy.Normalize(op.Username)
+				req.Operations[i].Username = op.Username
+			}
+			if err == nil && (op.Op == opCreate || op.Op == opUpdatePassword) && op.Password != "" {
+				err = s.validatePassword(r.Context(), op.Password, op.Username)
+				var pe *passwordpolicy.Error
+				if err != nil && !errors.As(err, &pe) {
+					if s.hashingUnavailable(w, err) {
+						return
+					}
+					log.Printf("batchHandler: Error checking password policy, err: %v", err)
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+			}
+			if err == nil && (op.Op == opDelete || op.Op == opUpdateRole && op.Role != validation.RoleAdmin) {
+				err = s.checkSelfRemoval(r, op.Username, op.Op == opDelete)
+				if errors.Is(err, errSelfDeletion) || errors.Is(err, errSelfDemotion) {
+					results[i].Status, results[i].Error = opStatusConflict, err.Error()
+					valid, conflict = false, true
+					continue
+				}
+				if err != nil {
+					log.Printf("batchHandler: Error checking self-removal, err: %v", err)
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+			}
+			if err != nil {
+				results[i].Status, results[i].Error = opStatusInvalid, err.Error()
+				valid = false
+			}
+		}
+
+		if req.Mode == batchModeAtomic {
+			if !valid {
+				for i := range results {
+					if results[i].Status == "" {
+						results[i].Status = opStatusSkipped
+					}
+				}
+				status := http.StatusBadRequest
+				if conflict {
+					status = http.StatusConflict
+				}
+				s.writeJsonResponse(w, response{Success: false, Mode: req.Mode, Results: results}, status)
+				return
+			}
+			// Hashed before the transaction, so that it isn't held open for as long as hashing takes
+			if err := s.hashBatchPasswords(r.Context(), req.Operations, results, true); err != nil {
+				if s.hashingUnavailable(w, err) {
+					return
+				}
+				log.Printf("batchHandler: Error hashing passwords, err: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			err := s.UserDB.WithTransaction(r.Context(), func(ctx context.Context) error {
+				// The transaction may be retried, so results are recorded from scratch on every attempt
+				for i, op := range req.Operations {
+					var err error
+					results[i].Status, results[i].Error, err = s.applyBatchOperation(ctx, op)
+					if err != nil {
+						// Returned as is so that transient transaction errors are retried
+						return err
+					}
+					if results[i].Status != opStatusOK && results[i].Status != opStatusUnchanged {
+						for j := range results {
+							if j < i {
+								results[j].Status = opStatusRolledBack
+							} else if j > i {
+								results[j].Status, results[j].Error = opStatusSkipped, ""
+							}
+						}
+						return errBatchOperationFailed
+					}
+				}
+				return nil
+			})
+			switch {
+			case err == nil:
+				s.writeJsonResponse(w, response{Success: true, Mode: req.Mode, Results: results}, http.StatusOK)
+			case errors.Is(err, errBatchOperationFailed):
+				s.writeJsonResponse(w, response{Success: false, Mode: req.Mode, Results: results}, http.StatusConflict)
+			case errors.Is(err, database.ErrTransactionsNotSupported):
+				log.Printf("batchHandler: Atomic batch not supported, err: %v", err)
+				http.Error(w, "atomic mode is not supported by the database, use best-effort", http.StatusNotImplemented)
+			default:
+				log.Printf("batchHandler: Error running atomic batch, err: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		success := valid
+		// Not atomic, the operations whose password can't be hashed fail on their own
+		_ = s.hashBatchPasswords(r.Context(), req.Operations, results, false)
+		for i, op := range req.Operations {
+			if results[i].Status != "" {
+				success = false
+				continue
+			}
+			results[i].Status, results[i].Error, _ = s.applyBatchOperation(r.Context(), op)
+			if results[i].Status != opStatusOK && results[i].Status != opStatusUnchanged {
+				success = false
+			}
+		}
+		s.writeJsonResponse(w, response{Success: success, Mode: req.Mode, Results: results}, http.StatusOK)
+	}
+}
+
+// hashBatchPasswords hashes the passwords of the operations without a result yet, concurrently with
+// as many at a time as s.Passwords has workers. When atomic it fails with the first error, otherwise
+// the operations whose password can't be hashed fail.
+func (s Server) hashBatchPasswords(ctx context.Context, ops []batchOperation, results []batchOperationResult, atomic bool) error {
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(s.Passwords.Stats().Workers)
+	for i := range ops {
+		op, result := &ops[i], &results[i]
+		if result.Status != "" || op.Password == "" || op.Op != opCreate && op.Op != opUpdatePassword {
+			continue
+		}
+		g.Go(func() error {
+			hash, err := s.hashPassword(gctx, op.Password)
+			if err != nil {
+				if atomic {
+					return err
+				}
+				result.Status, result.Error = opStatusFailed, hashingErrorMessage(err)
+				return nil
+			}
+			op.hashedPassword = hash
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// hashingErrorMessage is the result error of an operation whose password could not be hashed.
+func hashingErrorMessage(err error) string {
+	if errors.Is(err, passwordhash.ErrPoolFull) {
+		return "password hashing is busy, try again later"
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return "request canceled"
+	}
+	log.Printf("applyBatchOperation: Error hashing password, err: %v", err)
+	return "error hashing password"
+}
+
+func (op batchOperation) validate() error {
+	switch op.Op {
+	case opCreate:
+		if op.PasswordHash != "" {
+			if op.Password != "" {
+				return errors.New("only one of password or passwordHash should be set")
+			}
+			if err := validation.PasswordHash(op.PasswordHash); err != nil {
+				return err
+			}
+			return validation.NewUser(op.Username, op.PasswordHash, op.Role)
+		}
+		return validation.NewUser(op.Username, op.Password, op.Role)
+	case opUpdatePassword:
+		if op.Username == "" {
+			return validation.ErrEmptyUsername
+		}
+		if op.PasswordHash != "" {
+			return errors.New("passwordHash is only supported with create")
+		}
+		if op.Password == "" {
+			return validation.ErrEmptyPassword
+		}
+		return nil
+	case opUpdateInfo, opDelete:
+		if op.Username == "" {
+			return validation.ErrEmptyUsername
+		}
+		return nil
+	case opUpdateRole:
+		if op.Username == "" {
+			return validation.ErrEmptyUsername
+		}
+		return validation.Role(op.Role)
+	default:
+		return fmt.Errorf("op should be one of %s, %s, %s, %s or %s",
+			opCreate, opUpdatePassword, opUpdateRole, opUpdateInfo, opDelete)
+	}
+}
+
+// applyBatchOperation applies a validated operation with its password hashed by hashBatchPasswords,
+// and returns its status and error message, err is only set for unexpected errors.
+func (s Server) applyBatchOperation(ctx context.Context, op batchOperation) (status string, message string, err error) {
+	switch op.Op {
+	case opCreate:
+		hashedPassword := []byte(op.PasswordHash)
+		if op.Password != "" {
+			hashedPassword = op.hashedPassword
+		}
+		_, err = s.UserDB.InsertUser(ctx, database.User{
+			Username: op.Username,
+			Password: hashedPassword,
+			Role:     op.Role,
+			Info:     op.Info,
+		})
+		if errors.Is(err, database.ErrConfusableUsername) {
+			return opStatusDuplicate, database.ErrConfusableUsername.Error(), nil
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return opStatusDuplicate, "username already exists", nil
+		}
+	case opUpdatePassword:
+		err = s.UserDB.UpdateUserPassword(ctx, op.Username, op.hashedPassword, false)
+	case opUpdateRole:
+		err = s.UserDB.UpdateUserRole(ctx, op.Username, op.Role)
+	case opUpdateInfo:
+		err = s.UserDB.UpdateUserInfo(ctx, op.Username, op.Info)
+	case opDelete:
+		err = s.UserDB.DeleteUserByUsername(ctx, op.Username)
+		if errors.Is(err, database.ErrNoDocumentsModified) {
+			return opStatusNotFound, "user not found", nil
+		}
+	}
+
+	if errors.Is(err, database.ErrLastAdmin) {
+		return opStatusConflict, database.ErrLastAdmin.Error(), nil
+	}
+	if errors.Is(err, database.ErrLocked) {
+		return opStatusConflict, database.ErrLocked.Error(), nil
+	}
+	if errors.Is(err, database.ErrNoDocumentsModified) {
+		// Updates setting the current value modify nothing, which is not a failure if the User exists
+		if _, findErr := s.UserDB.FindUserByUsername(ctx, op.Username); findErr == nil {
+			return opStatusUnchanged, "", nil
+		} else if errors.Is(findErr, mongo.ErrNoDocuments) {
+			return opStatusNotFound, "user not found", nil
+		} else {
+			err = findErr
+		}
+	}
+	if err != nil {
+		log.Printf("applyBatchOperation: Error applying %s for username: %s, err: %v", op.Op, op.Username, err)
+		return opStatusFailed, "error applying operation", err
+	}
+	return opStatusOK, "", nil
+}
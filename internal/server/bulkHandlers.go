@@ -0,0 +1,97 @@
+package server
+
+import (
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/bulk"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/context"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const maxImportBytes = 16 << 20
+
+func (s Server) importUsersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format, err := requestFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+
+		rows, err := bulk.Decode(http.MaxBytesReader(w, r.Body, maxImportBytes), format)
+		if err != nil {
+			log.Printf("importUsersHandler: Error decoding %s, err: %v", format, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		report, err := bulk.Import(r.Context(), s.UserDB, rows, s.UsernamePolicy, s.ProfileAttributesSchema, s.PasswordPolicy, s.Passwords, dryRun)
+		if err != nil {
+			if s.hashingUnavailable(w, err) {
+				return
+			}
+			log.Printf("importUsersHandler: Error importing Users, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		s.writeJsonResponse(w, report, http.StatusOK)
+	}
+}
+
+func (s Server) exportUsersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format, err := bulk.ParseFormat(r.URL.Query().Get("format"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		includePasswordHashes, _ := strconv.ParseBool(r.URL.Query().Get("includePasswordHashes"))
+
+		us, err := s.UserDB.FindAllUsers(r.Context())
+		if err != nil {
+			log.Printf("exportUsersHandler: Error getting all Users, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		// Audited before the hashes are sent, so that there is no export of them without an audit event
+		if includePasswordHashes {
+			uc, _ := context.GetUserContext(r.Context())
+			err := s.recordAuditEvent(r, database.AuditEvent{
+				Action:  database.AuditPasswordHashExport,
+				ActorID: uc.UserID,
+				Details: map[string]string{"format": string(format), "users": strconv.Itoa(len(us))},
+			})
+			if err != nil {
+				log.Printf("exportUsersHandler: Error recording audit event, err: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", format.ContentType())
+		w.Header().Set("Content-Disposition", "attachment; filename=users."+string(format))
+		if err := bulk.Encode(w, format, bulk.ExportRows(us, includePasswordHashes)); err != nil {
+			log.Printf("exportUsersHandler: Error writing %s, err: %v", format, err)
+		}
+	}
+}
+
+// requestFormat takes the format from the format query parameter, or else from the Content-Type.
+func requestFormat(r *http.Request) (bulk.Format, error) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return bulk.ParseFormat(f)
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return bulk.FormatCSV, nil
+	case "application/json":
+		return bulk.FormatJSON, nil
+	default:
+		return bulk.ParseFormat(mediaType)
+	}
+}
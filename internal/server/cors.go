@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+var corsAllowedMethods = strings.Join([]string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete}, ", ")
+
+// corsMw wraps the whole router rather than being added with Use,
+// since preflight requests do not match any route and would never reach a route middleware.
+func (s Server) corsMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !s.corsOriginAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s Server) corsOriginAllowed(origin string) bool {
+	for _, o := range s.Settings.Load().CORSAllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/context"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/mail"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/validation"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sendEmailVerificationHandler sends a verification token to the email of the calling user,
+// admins may send it for any user. With resend a pending verification must exist,
+// either way a new token is issued and the previous one stops working.
+func (s Server) sendEmailVerificationHandler(resend bool) http.HandlerFunc {
+	type request struct {
+		Username string `json:"username"`
+	}
+	type response struct {
+		Success   bool      `json:"success"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				log.Printf("sendEmailVerificationHandler: Error decoding JSON, err: %v", err)
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+		}
+
+		uc, err := context.GetUserContext(r.Context())
+		if err != nil {
+			log.Printf("sendEmailVerificationHandler: Error getting user context, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		var u database.User
+		if req.Username != "" {
+			if uc.Role != validation.RoleAdmin {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			u, err = s.UserDB.FindUserByUsername(r.Context(), req.Username)
+		} else {
+			u, err = s.UserDB.FindUserByID(r.Context(), uc.UserID)
+		}
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			log.Printf("sendEmailVerificationHandler: Error getting User, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if u.Profile.Email == "" {
+			http.Error(w, "user has no email", http.StatusConflict)
+			return
+		}
+		if u.EmailVerified {
+			http.Error(w, "email is already verified", http.StatusConflict)
+			return
+		}
+		if resend && u.EmailVerification == nil {
+			http.Error(w, "no pending email verification", http.StatusConflict)
+			return
+		}
+		now := time.Now()
+		if ev := u.EmailVerification; ev != nil && now.Sub(ev.SentAt) < s.Email.ResendCooldown {
+			retryAfter := ev.SentAt.Add(s.Email.ResendCooldown).Sub(now)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+
+		token, tokenHash, err := newOpaqueToken()
+		if err != nil {
+			log.Printf("sendEmailVerificationHandler: Error generating token, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		ev := database.EmailVerification{
+			TokenHash: tokenHash,
+			Email:     u.Profile.Email,
+			SentAt:    now,
+			ExpiresAt: now.Add(s.Email.VerificationTTL),
+		}
+		if err := s.UserDB.SetEmailVerification(r.Context(), u.Username, ev); err != nil {
+			if errors.Is(err, database.ErrNoDocumentsModified) {
+				http.Error(w, "email changed, try again", http.StatusConflict)
+				return
+			}
+			log.Printf("sendEmailVerificationHandler: Error setting email verification, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if err := s.Mailer.Send(r.Context(), s.emailVerificationMessage(u, token, ev.ExpiresAt)); err != nil {
+			log.Printf("sendEmailVerificationHandler: Error sending email verification, username: %s, err: %v", u.Username, err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+
+		s.writeJsonResponse(w, response{Success: true, ExpiresAt: ev.ExpiresAt}, http.StatusOK)
+	}
+}
+
+func (s Server) confirmEmailVerificationHandler() http.HandlerFunc {
+	type request struct {
+		Token string `json:"token"`
+	}
+	type response struct {
+		Success bool `json:"success"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("confirmEmailVerificationHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if req.Token == "" {
+			http.Error(w, "token must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := s.UserDB.ConfirmEmailVerification(r.Context(), hashOpaqueToken(req.Token), time.Now()); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, "invalid or expired token", http.StatusBadRequest)
+				return
+			}
+			log.Printf("confirmEmailVerificationHandler: Error confirming email verification, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		s.writeJsonResponse(w, response{Success: true}, http.StatusOK)
+	}
+}
+
+func (s Server) emailVerificationMessage(u database.User, token string, expiresAt time.Time) mail.Message {
+	link := token
+	if s.Email.VerificationURL != "" {
+		link = strings.ReplaceAll(s.Email.VerificationURL, "{token}", token)
+	}
+	return mail.Message{
+		To:      u.Profile.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hi %s,\n\nVerify your email with:\n\n%s\n\nThis expires at %s.\n",
+			u.Username, link, expiresAt.UTC().Format(time.RFC1123)),
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type Health struct {
+	ready    atomic.Bool
+	dbOK     atomic.Bool
+	inFlight atomic.Int64
+}
+
+func NewHealth() *Health {
+	h := &Health{}
+	h.dbOK.Store(true)
+	return h
+}
+
+func (h *Health) SetReady(ready bool) {
+	h.ready.Store(ready)
+}
+
+func (h *Health) Ready() bool {
+	return h.ready.Load() && h.dbOK.Load()
+}
+
+func (h *Health) InFlight() int64 {
+	return h.inFlight.Load()
+}
+
+// WatchUserDB pings UserDB every interval until ctx is done,
+// readiness is reported as false while UserDB is unreachable.
+func (s Server) WatchUserDB(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			pingCtx, cancel := context.WithTimeout(ctx, interval)
+			err := s.UserDB.Client().Ping(pingCtx, nil)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				if s.Health.dbOK.Swap(false) {
+					log.Printf("WatchUserDB: UserDB unreachable, err: %v", err)
+				}
+				continue
+			}
+			if err == nil && !s.Health.dbOK.Swap(true) {
+				log.Printf("WatchUserDB: UserDB reachable again")
+			}
+		}
+	}
+}
+
+func (s Server) inFlightMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Health.inFlight.Add(1)
+		defer s.Health.inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s Server) liveHandler() http.HandlerFunc {
+	type response struct {
+		Status string `json:"status"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.writeJsonResponse(w, response{Status: "ok"}, http.StatusOK)
+	}
+}
+
+func (s Server) readyHandler() http.HandlerFunc {
+	type response struct {
+		Status string `json:"status"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.Health.Ready() {
+			s.writeJsonResponse(w, response{Status: "not ready"}, http.StatusServiceUnavailable)
+			return
+		}
+		s.writeJsonResponse(w, response{Status: "ready"}, http.StatusOK)
+	}
+}
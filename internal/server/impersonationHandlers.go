@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/accesstoken"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/context"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/validation"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"net/http"
+	"time"
+)
+
+const maxImpersonationReasonLength = 512
+
+// recordAuditEvent stores e and writes it to the log as a JSON line prefixed with AUDIT,
+// so that it can be picked out of the log too.
+func (s Server) recordAuditEvent(r *http.Request, e database.AuditEvent) error {
+	e.Time = time.Now()
+	e.IP = s.clientIP(r)
+	if line, err := json.Marshal(e); err == nil {
+		log.Printf("AUDIT %s", line)
+	}
+	return s.UserDB.InsertAuditEvent(r.Context(), e)
+}
+
+// impersonateHandler issues an admin a short-lived access token of another user, with the admin
+// as the actor in the act claim. authMw refuses it for admin routes and those changing credentials.
+// The token has a session of its own, so that it is listed and revoked with the sessions of the user,
+// and revoking the sessions of the admin revokes it too.
+func (s Server) impersonateHandler() http.HandlerFunc {
+	type request struct {
+		Username string `json:"username"`
+		// Reason is recorded in the audit event, such as a support ticket
+		Reason string `json:"reason"`
+	}
+	type response struct {
+		AccessToken string `json:"accessToken"`
+		TokenType   string `json:"tokenType"`
+		ExpiresIn   int    `json:"expiresIn"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("impersonateHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if req.Username == "" || req.Reason == "" {
+			http.Error(w, "username and reason must not be empty", http.StatusBadRequest)
+			return
+		}
+		if len(req.Reason) > maxImpersonationReasonLength {
+			http.Error(w, "reason is too long", http.StatusBadRequest)
+			return
+		}
+		uc, err := context.GetUserContext(r.Context())
+		if err != nil {
+			log.Printf("impersonateHandler: Error getting user context, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		// Client certificates identify services, which are no user to be the actor of the token
+		if uc.ClientCert {
+			log.Printf("impersonateHandler: Impersonation not allowed for client certificates, identity: %s", uc.UserID)
+			http.Error(w, "client certificates can not impersonate", http.StatusForbidden)
+			return
+		}
+
+		u, err := s.UserDB.FindUserByUsername(r.Context(), req.Username)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			log.Printf("impersonateHandler: Error getting User, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if u.Role == validation.RoleAdmin {
+			http.Error(w, "admins can not be impersonated", http.StatusForbidden)
+			return
+		}
+
+		now := time.Now()
+		session, err := s.newSession(r, u, now, now.Add(s.Auth.ImpersonationTTL))
+		if err != nil {
+			log.Printf("impersonateHandler: Error creating session, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		session.ActorID = uc.UserID
+
+		// Audited before the token is issued, so that there is no token without an audit event
+		err = s.recordAuditEvent(r, database.AuditEvent{
+			Action:  database.AuditImpersonation,
+			ActorID: uc.UserID,
+			Subject: u.Username,
+			Details: map[string]string{"reason": req.Reason, "ttl": s.Auth.ImpersonationTTL.String(), "session": session.ID},
+		})
+		if err != nil {
+			log.Printf("impersonateHandler: Error recording audit event, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if err := s.UserDB.InsertSession(r.Context(), session); err != nil {
+			log.Printf("impersonateHandler: Error inserting session, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		at, err := accesstoken.NewWithClaims(s.Settings.Load().AccessTokenKeys[0],
+			accesstoken.Claims{Subject: u.ID.Hex(), Role: u.Role, SessionID: session.ID, Actor: uc.UserID}, s.Auth.ImpersonationTTL)
+		if err != nil {
+			log.Printf("impersonateHandler: Error creating access token, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		s.writeJsonResponse(w, response{
+			AccessToken: string(at),
+			TokenType:   "Bearer",
+			ExpiresIn:   int(s.Auth.ImpersonationTTL.Seconds()),
+		}, http.StatusOK)
+	}
+}
+
+// checkActor writes the error and returns false when the admin actor of an impersonation token
+// has since been deleted or is no longer an admin.
+func (s Server) checkActor(w http.ResponseWriter, r *http.Request, actor string, userID string) bool {
+	a, err := s.UserDB.FindUserByID(r.Context(), actor)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("authMw: Impersonating admin deleted, sub: %s, act: %s", userID, actor)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return false
+		}
+		log.Printf("authMw: Error getting impersonating admin, err: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	if a.Role != validation.RoleAdmin {
+		log.Printf("authMw: Impersonating user no longer an admin, sub: %s, act: %s", userID, actor)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImpersonateRefusesClientCert(t *testing.T) {
+	h := newRateLimitedServer(RateLimits{}).Router()
+	r := httptest.NewRequest(http.MethodPost, "/user/impersonate", strings.NewReader(`{"username":"user","reason":"ticket 1"}`))
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "admin-service"}}}}}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/context"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefixes of the LoginThrottle keys.
+const (
+	lockoutKeyUsername = "username:"
+	lockoutKeyIP       = "ip:"
+)
+
+// delay is how long after the last of failures the next attempt is allowed, doubling
+// from BaseDelay with every failure from the free attempts on.
+func (o LockoutOptions) delay(l LockoutLimits, failures int) time.Duration {
+	if failures < l.FreeAttempts {
+		return 0
+	}
+	d := o.BaseDelay
+	for i := l.FreeAttempts; i < failures && d < o.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > o.MaxDelay {
+		return o.MaxDelay
+	}
+	return d
+}
+
+// wait is how long from now until the next attempt is allowed by t, 0 when it is.
+func (o LockoutOptions) wait(l LockoutLimits, t database.LoginThrottle, now time.Time) time.Duration {
+	next := t.LockedUntil
+	if delayed := t.LastFailureAt.Add(o.delay(l, t.Failures)); delayed.After(next) {
+		next = delayed
+	}
+	if now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+func (o LockoutOptions) limits(key string) LockoutLimits {
+	if strings.HasPrefix(key, lockoutKeyIP) {
+		return o.IP
+	}
+	return o.Username
+}
+
+// loginRetryAfter returns how long until a login of username from ip is allowed, 0 when it is.
+func (s Server) loginRetryAfter(r *http.Request, username string, ip string, now time.Time) (time.Duration, error) {
+	throttles, err := s.UserDB.FindLoginThrottles(r.Context(), []string{lockoutKeyUsername + username, lockoutKeyIP + ip})
+	if err != nil {
+		return 0, err
+	}
+	var wait time.Duration
+	for _, t := range throttles {
+		if d := s.Auth.Lockout.wait(s.Auth.Lockout.limits(t.Key), t, now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failed login of username from ip against both.
+func (s Server) recordLoginFailure(r *http.Request, username string, ip string, now time.Time) error {
+	o := s.Auth.Lockout
+	for _, key := range []string{lockoutKeyUsername + username, lockoutKeyIP + ip} {
+		l := o.limits(key)
+		t, err := s.UserDB.RecordLoginFailure(r.Context(), key, now, o.Window, l.Threshold, o.Duration)
+		if err != nil {
+			return err
+		}
+		if l.Threshold > 0 && t.Failures == l.Threshold {
+			log.Printf("Login locked after %d failures, %s, until: %v", t.Failures, key, t.LockedUntil)
+		}
+	}
+	return nil
+}
+
+// clearLoginFailures forgets the failed logins of username once it has logged in, those
+// from the client IP are kept so that logging in to one account doesn't allow guessing others.
+func (s Server) clearLoginFailures(r *http.Request, username string) error {
+	err := s.UserDB.ClearLoginThrottle(r.Context(), lockoutKeyUsername+username)
+	if err != nil && !errors.Is(err, database.ErrNoDocumentsModified) {
+		return err
+	}
+	return nil
+}
+
+// writeTooManyLogins writes the response of a throttled login.
+func writeTooManyLogins(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+	http.Error(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+}
+
+// unlockLoginHandler lets an admin clear the failed logins of a username or of a client IP.
+func (s Server) unlockLoginHandler() http.HandlerFunc {
+	type request struct {
+		Username string `json:"username"`
+		IP       string `json:"ip"`
+	}
+	type response struct {
+		Success bool `json:"success"`
+		// Locked is whether there were failed logins to clear
+		Locked bool `json:"locked"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("unlockLoginHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if (req.Username == "") == (req.IP == "") {
+			http.Error(w, "one of username or ip must be set", http.StatusBadRequest)
+			return
+		}
+
+		key := lockoutKeyUsername + req.Username
+		if req.IP != "" {
+			ip := net.ParseIP(req.IP)
+			if ip == nil {
+				http.Error(w, "ip is not an IP address", http.StatusBadRequest)
+				return
+			}
+			key = lockoutKeyIP + ip.String()
+		} else if u, err := s.UserDB.FindUserByUsername(r.Context(), req.Username); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			log.Printf("unlockLoginHandler: Error getting User, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		} else {
+			key = lockoutKeyUsername + u.Username
+		}
+
+		locked := true
+		if err := s.UserDB.ClearLoginThrottle(r.Context(), key); err != nil {
+			if !errors.Is(err, database.ErrNoDocumentsModified) {
+				log.Printf("unlockLoginHandler: Error clearing failed logins, err: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			locked = false
+		}
+		uc, _ := context.GetUserContext(r.Context())
+		log.Printf("unlockLoginHandler: Failed logins cleared, %s, by: %s", key, uc.UserID)
+
+		s.writeJsonResponse(w, response{Success: true, Locked: locked}, http.StatusOK)
+	}
+}
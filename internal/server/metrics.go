@@ -0,0 +1,34 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// metricsHandler writes the password hashing pool and in-flight request metrics
+// in the Prometheus text exposition format.
+func (s Server) metricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := s.Passwords.Stats()
+		var b strings.Builder
+		metric := func(name string, kind string, help string, value any) {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+		}
+		metric("http_requests_in_flight", "gauge", "Requests being served.", s.Health.InFlight())
+		metric("password_hashing_workers", "gauge", "Passwords hashed or verified at a time at most.", st.Workers)
+		metric("password_hashing_busy", "gauge", "Passwords being hashed or verified.", st.Busy)
+		metric("password_hashing_queued", "gauge", "Password hashings waiting for a worker.", st.Queued)
+		metric("password_hashing_completed_total", "counter", "Password hashings completed.", st.Completed)
+		metric("password_hashing_rejected_total", "counter", "Password hashings rejected because the queue was full or timed out.", st.Rejected)
+		metric("password_hashing_canceled_total", "counter", "Password hashings canceled while queued.", st.Canceled)
+		metric("password_hashing_wait_seconds_total", "counter", "Time spent waiting for a worker.", st.WaitTime.Seconds())
+		metric("password_hashing_work_seconds_total", "counter", "Time spent hashing or verifying.", st.WorkTime.Seconds())
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if _, err := w.Write([]byte(b.String())); err != nil {
+			log.Printf("metricsHandler: Error writing metrics, err: %v", err)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/accesstoken"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/context"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/totp"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/validation"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// mfaLoginHandler completes a login of a user with MFA, exchanging the MFA token
+// of loginHandler and a TOTP or recovery code for an access token.
+func (s Server) mfaLoginHandler() http.HandlerFunc {
+	type request struct {
+		MFAToken     string `json:"mfaToken"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("mfaLoginHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if req.MFAToken == "" || (req.Code == "") == (req.RecoveryCode == "") {
+			http.Error(w, "mfaToken and one of code or recoveryCode must be set", http.StatusBadRequest)
+			return
+		}
+
+		token, err := s.parseAccessToken([]byte(req.MFAToken))
+		if err != nil {
+			log.Printf("mfaLoginHandler: Failed to validate MFA token, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if tokenType, _ := token.Get("type"); tokenType != accesstoken.TypeMFAChallenge {
+			log.Printf("mfaLoginHandler: Invalid token type")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		u, err := s.UserDB.FindUserByID(r.Context(), token.Subject())
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			log.Printf("mfaLoginHandler: Error getting User, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		// The password may have been changed or the MFA reset since the token was issued
+		if tokenRevoked(token.IssuedAt(), u.TokensValidAfter) || !u.MFA.Enabled() {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		verified := s.verifySecondFactor(w, r, u, "mfaLoginHandler", http.StatusUnauthorized, func() error {
+			if req.Code != "" {
+				return s.useTOTPCode(r, u, req.Code)
+			}
+			err := s.UserDB.UseRecoveryCode(r.Context(), u.Username, hashRecoveryCode(req.RecoveryCode))
+			if err == nil {
+				log.Printf("mfaLoginHandler: Recovery code used, username: %s, remaining: %d", u.Username, len(u.MFA.RecoveryCodeHashes)-1)
+			}
+			return err
+		})
+		if !verified {
+			return
+		}
+		// Failed logins are only forgotten once both factors were verified
+		if err := s.clearLoginFailures(r, u.Username); err != nil {
+			log.Printf("mfaLoginHandler: Error clearing failed logins, err: %v", err)
+		}
+
+		resp, err := s.newLoginResponse(r, u, []string{accesstoken.AMRPassword, accesstoken.AMROTP})
+		if err != nil {
+			log.Printf("mfaLoginHandler: Error creating access token, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		s.writeJsonResponse(w, resp, http.StatusOK)
+	}
+}
+
+// verifySecondFactor runs verify throttled like the password in loginHandler, a wrong code counts
+// as a failed login of the user and the client IP, so that codes can't be guessed faster than
+// passwords. When verify fails the error is written to w with invalidStatus for a wrong code.
+func (s Server) verifySecondFactor(w http.ResponseWriter, r *http.Request, u database.User, handler string, invalidStatus int, verify func() error) bool {
+	ip, now := s.clientIP(r), time.Now()
+	wait, err := s.loginRetryAfter(r, u.Username, ip, now)
+	if err != nil {
+		log.Printf("%s: Error getting failed logins, err: %v", handler, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	if wait > 0 {
+		writeTooManyLogins(w, wait)
+		return false
+	}
+
+	if err := verify(); err != nil {
+		if errors.Is(err, database.ErrNoDocumentsModified) {
+			if err := s.recordLoginFailure(r, u.Username, ip, now); err != nil {
+				log.Printf("%s: Error recording failed login, err: %v", handler, err)
+			}
+			http.Error(w, "invalid code", invalidStatus)
+			return false
+		}
+		log.Printf("%s: Error verifying second factor, username: %s, err: %v", handler, u.Username, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// useTOTPCode accepts code once, it fails with ErrNoDocumentsModified when the code
+// is wrong or a code of the same or a later step has already been used.
+func (s Server) useTOTPCode(r *http.Request, u database.User, code string) error {
+	counter, ok, err := totp.Validate(u.MFA.TOTPSecret, code, time.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("invalid TOTP code, username: %s: %w", u.Username, database.ErrNoDocumentsModified)
+	}
+	return s.UserDB.UseTOTPCounter(r.Context(), u.Username, counter)
+}
+
+func (s Server) getMFAHandler() http.HandlerFunc {
+	type response struct {
+		Enabled                bool      `json:"enabled"`
+		EnabledAt              time.Time `json:"enabledAt,omitempty"`
+		RecoveryCodesRemaining int       `json:"recoveryCodesRemaining"`
+		// Required means an admin has to enroll when logging in
+		Required bool `json:"required"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := s.callingUser(w, r, "getMFAHandler")
+		if !ok {
+			return
+		}
+		resp := response{Required: s.MFA.RequireForAdmins && u.Role == validation.RoleAdmin}
+		if u.MFA.Enabled() {
+			resp.Enabled, resp.EnabledAt, resp.RecoveryCodesRemaining = true, u.MFA.EnabledAt, len(u.MFA.RecoveryCodeHashes)
+		}
+		s.writeJsonResponse(w, resp, http.StatusOK)
+	}
+}
+
+// enrollTOTPHandler starts enrolling a TOTP second factor for the calling user,
+// it is only enabled once confirmed with a code. Enrolling again replaces a pending secret.
+func (s Server) enrollTOTPHandler() http.HandlerFunc {
+	type response struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := s.callingUser(w, r, "enrollTOTPHandler")
+		if !ok {
+			return
+		}
+		if u.MFA.Enabled() {
+			http.Error(w, "MFA is already enabled", http.StatusConflict)
+			return
+		}
+
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			log.Printf("enrollTOTPHandler: Error generating secret, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if err := s.UserDB.SetPendingMFA(r.Context(), u.Username, secret); err != nil {
+			if errors.Is(err, database.ErrNoDocumentsModified) {
+				http.Error(w, "MFA is already enabled", http.StatusConflict)
+				return
+			}
+			log.Printf("enrollTOTPHandler: Error setting pending MFA, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		s.writeJsonResponse(w, response{Secret: secret, URI: totp.URI(s.MFA.Issuer, u.Username, secret)}, http.StatusOK)
+	}
+}
+
+// confirmTOTPHandler enables the pending TOTP second factor of the calling user with a code from it.
+// The recovery codes are only shown here, the new access token carries the second factor.
+func (s Server) confirmTOTPHandler() http.HandlerFunc {
+	type request struct {
+		Code string `json:"code"`
+	}
+	type response struct {
+		Success       bool     `json:"success"`
+		RecoveryCodes []string `json:"recoveryCodes"`
+		loginResponse
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("confirmTOTPHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if req.Code == "" {
+			http.Error(w, "code must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		u, ok := s.callingUser(w, r, "confirmTOTPHandler")
+		if !ok {
+			return
+		}
+		if u.MFA == nil || u.MFA.Enabled() {
+			http.Error(w, "no pending MFA enrollment", http.StatusConflict)
+			return
+		}
+
+		counter, ok, err := totp.Validate(u.MFA.TOTPSecret, req.Code, time.Now())
+		if err != nil {
+			log.Printf("confirmTOTPHandler: Error validating code, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "invalid code", http.StatusBadRequest)
+			return
+		}
+
+		codes, hashes, err := newRecoveryCodes(s.MFA.RecoveryCodes)
+		if err != nil {
+			log.Printf("confirmTOTPHandler: Error generating recovery codes, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		now := time.Now()
+		if err := s.UserDB.EnableMFA(r.Context(), u.Username, u.MFA.TOTPSecret, counter, hashes, now); err != nil {
+			if errors.Is(err, database.ErrNoDocumentsModified) {
+				// Enrolled again or confirmed by a concurrent request
+				http.Error(w, "no pending MFA enrollment", http.StatusConflict)
+				return
+			}
+			log.Printf("confirmTOTPHandler: Error enabling MFA, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		u.MFA.EnabledAt = now
+
+		resp, err := s.newLoginResponse(r, u, []string{accesstoken.AMRPassword, accesstoken.AMROTP})
+		if err != nil {
+			log.Printf("confirmTOTPHandler: Error creating access token, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		s.writeJsonResponse(w, response{Success: true, RecoveryCodes: codes, loginResponse: resp}, http.StatusOK)
+	}
+}
+
+// regenerateRecoveryCodesHandler replaces the recovery codes of the calling user,
+// a current TOTP code is required so that a stolen access token isn't enough.
+func (s Server) regenerateRecoveryCodesHandler() http.HandlerFunc {
+	type request struct {
+		Code string `json:"code"`
+	}
+	type response struct {
+		Success       bool     `json:"success"`
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("regenerateRecoveryCodesHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if req.Code == "" {
+			http.Error(w, "code must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		u, ok := s.callingUser(w, r, "regenerateRecoveryCodesHandler")
+		if !ok {
+			return
+		}
+		if !u.MFA.Enabled() {
+			http.Error(w, "MFA is not enabled", http.StatusConflict)
+			return
+		}
+		verified := s.verifySecondFactor(w, r, u, "regenerateRecoveryCodesHandler", http.StatusForbidden, func() error {
+			return s.useTOTPCode(r, u, req.Code)
+		})
+		if !verified {
+			return
+		}
+
+		codes, hashes, err := newRecoveryCodes(s.MFA.RecoveryCodes)
+		if err != nil {
+			log.Printf("regenerateRecoveryCodesHandler: Error generating recovery codes, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if err := s.UserDB.SetRecoveryCodes(r.Context(), u.Username, hashes); err != nil {
+			log.Printf("regenerateRecoveryCodesHandler: Error setting recovery codes, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		s.writeJsonResponse(w, response{Success: true, RecoveryCodes: codes}, http.StatusOK)
+	}
+}
+
+// resetMFAHandler removes the second factor of a user who lost it, the user
+// has to enroll again on the next login when MFA is required.
+func (s Server) resetMFAHandler() http.HandlerFunc {
+	type request struct {
+		Username string `json:"username"`
+	}
+	type response struct {
+		Success bool `json:"success"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("resetMFAHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if req.Username == "" {
+			http.Error(w, "username must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		if err := s.UserDB.ResetMFA(r.Context(), req.Username); err != nil {
+			if errors.Is(err, database.ErrNoDocumentsModified) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			log.Printf("resetMFAHandler: Error resetting MFA, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		uc, _ := context.GetUserContext(r.Context())
+		log.Printf("resetMFAHandler: MFA reset, username: %s, by: %s", req.Username, uc.UserID)
+
+		s.writeJsonResponse(w, response{Success: true}, http.StatusOK)
+	}
+}
+
+// callingUser gets the User of the access token, when it fails the error is written to w and false is returned.
+func (s Server) callingUser(w http.ResponseWriter, r *http.Request, handler string) (database.User, bool) {
+	uc, err := context.GetUserContext(r.Context())
+	if err != nil {
+		log.Printf("%s: Error getting user context, err: %v", handler, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return database.User{}, false
+	}
+	u, err := s.UserDB.FindUserByID(r.Context(), uc.UserID)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return u, false
+		}
+		log.Printf("%s: Error getting User, err: %v", handler, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return u, false
+	}
+	return u, true
+}
+
+const recoveryCodeAlphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+
+// newRecoveryCodes returns n random recovery codes of 80 bits formatted as xxxx-xxxx-xxxx-xxxx,
+// and their hashes to store. The entropy is high enough for a fast hash, like opaque tokens.
+func newRecoveryCodes(n int) ([]string, [][]byte, error) {
+	codes := make([]string, n)
+	hashes := make([][]byte, n)
+	b := make([]byte, 16)
+	for i := range codes {
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, fmt.Errorf("error generating recovery code: %w", err)
+		}
+		var sb strings.Builder
+		for j, c := range b {
+			if j > 0 && j%4 == 0 {
+				sb.WriteByte('-')
+			}
+			// 32 characters, so every one carries 5 bits without bias
+			sb.WriteByte(recoveryCodeAlphabet[c%32])
+		}
+		codes[i] = sb.String()
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes code ignoring case, spaces and dashes, as users retype them.
+func hashRecoveryCode(code string) []byte {
+	code = strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+	return hashOpaqueToken(code)
+}
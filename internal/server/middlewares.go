@@ -1,12 +1,17 @@
 package server
 
 import (
+	"errors"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/accesstoken"
 	"github.com/dnflash/demo-p1-go-user-management-service/internal/context"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/tlsconfig"
+	"github.com/gorilla/mux"
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 func (s Server) authMw(next http.Handler) http.Handler {
@@ -14,7 +19,7 @@ func (s Server) authMw(next http.Handler) http.Handler {
 		at := r.Header.Get("Authorization")
 		if strings.HasPrefix(at, "Bearer ") {
 			at = strings.TrimPrefix(at, "Bearer ")
-			token, err := jwt.Parse([]byte(at), jwt.WithKey(jwa.HS256, s.AccessTokenSecret), jwt.WithValidate(true))
+			token, err := s.parseAccessToken([]byte(at))
 			if err != nil {
 				log.Printf("authMw: Failed to validate access token, err: %v", err)
 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
@@ -28,7 +33,7 @@ func (s Server) authMw(next http.Handler) http.Handler {
 				return
 			}
 			tokenType, ok := typeClaim.(string)
-			if !ok || tokenType != "access-token" {
+			if !ok || tokenType != accesstoken.Type {
 				log.Printf("authMw: Invalid token type")
 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return
@@ -60,7 +65,86 @@ func (s Server) authMw(next http.Handler) http.Handler {
 				return
 			}
 
-			ctx := context.SetUserContext(r.Context(), context.UserContext{UserID: userID, Role: role})
+			if scopeClaim, ok := token.Get("scope"); ok {
+				scope, ok := scopeClaim.(string)
+				if !ok {
+					log.Printf("authMw: Invalid access token, invalid scope")
+					http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+					return
+				}
+				if !routeInScope(r, scope) {
+					log.Printf("authMw: Access token scope does not allow route, scope: %s", scope)
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
+			}
+
+			var amr []string
+			if amrClaim, ok := token.Get("amr"); ok {
+				if amr, ok = stringsClaim(amrClaim); !ok {
+					log.Printf("authMw: Invalid access token, invalid amr")
+					http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+					return
+				}
+			}
+
+			validAfter, err := s.UserDB.FindTokensValidAfter(r.Context(), userID)
+			if err != nil {
+				log.Printf("authMw: Error getting tokensValidAfter, err: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if tokenRevoked(token.IssuedAt(), validAfter) {
+				log.Printf("authMw: Access token revoked, sub: %s", userID)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			var sid string
+			if sidClaim, ok := token.Get("sid"); ok {
+				if sid, ok = sidClaim.(string); !ok {
+					log.Printf("authMw: Invalid access token, invalid sid")
+					http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+					return
+				}
+				if !s.checkSession(w, r, sid, userID) {
+					return
+				}
+			}
+
+			var actor string
+			if actClaim, ok := token.Get("act"); ok {
+				act, _ := actClaim.(map[string]any)
+				if actor, ok = act["sub"].(string); !ok || actor == "" {
+					log.Printf("authMw: Invalid access token, invalid act")
+					http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+					return
+				}
+				// Impersonation tokens are issued with a session, which was checked above
+				if sid == "" {
+					log.Printf("authMw: Invalid access token, act without sid")
+					http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+					return
+				}
+				if !s.checkActor(w, r, actor, userID) {
+					return
+				}
+				if routeNamed(r, impersonationBlockedRoutes) {
+					log.Printf("authMw: Route not allowed while impersonating, sub: %s, act: %s", userID, actor)
+					http.Error(w, "not allowed while impersonating", http.StatusForbidden)
+					return
+				}
+				log.Printf("authMw: Impersonated request, sub: %s, act: %s, %s %s", userID, actor, r.Method, r.URL.Path)
+			}
+
+			ctx := context.SetUserContext(r.Context(), context.UserContext{
+				UserID: userID, Role: role, AMR: amr, SessionID: sid, ActorID: actor,
+			})
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		if identity, ok := s.clientCertIdentity(r); ok {
+			ctx := context.SetUserContext(r.Context(), context.UserContext{UserID: identity, Role: "admin", ClientCert: true})
 			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
@@ -69,6 +153,75 @@ func (s Server) authMw(next http.Handler) http.Handler {
 	})
 }
 
+// tokenRevoked reports if a token issued at issuedAt is revoked by tokensValidAfter. As iat only has
+// second precision, tokens issued in the second of the revocation are revoked too.
+func tokenRevoked(issuedAt time.Time, validAfter time.Time) bool {
+	return issuedAt.Before(validAfter.Truncate(time.Second).Add(time.Second))
+}
+
+func routeInScope(r *http.Request, scope string) bool {
+	return routeNamed(r, scopeRoutes[scope])
+}
+
+func routeNamed(r *http.Request, names []string) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	for _, name := range names {
+		if route.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// stringsClaim converts a JSON array claim, which is parsed as []any, to []string.
+func stringsClaim(claim any) ([]string, bool) {
+	values, ok := claim.([]any)
+	if !ok {
+		return nil, false
+	}
+	ss := make([]string, len(values))
+	for i, v := range values {
+		if ss[i], ok = v.(string); !ok {
+			return nil, false
+		}
+	}
+	return ss, true
+}
+
+// parseAccessToken tries every access token key in order, so that tokens signed
+// with a previous key stay valid while the key is being rotated.
+func (s Server) parseAccessToken(at []byte) (jwt.Token, error) {
+	err := errors.New("no access token keys")
+	for _, k := range s.Settings.Load().AccessTokenKeys {
+		var token jwt.Token
+		token, err = jwt.Parse(at, jwt.WithKey(jwa.HS256, k), jwt.WithValidate(true))
+		if err == nil {
+			return token, nil
+		}
+	}
+	return nil, err
+}
+
+// clientCertIdentity returns the first identity of a verified client certificate
+// which is listed in ClientCertIdentities, these are trusted as admin service callers.
+func (s Server) clientCertIdentity(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	for _, id := range tlsconfig.Identities(r.TLS.VerifiedChains[0][0]) {
+		for _, trusted := range s.ClientCertIdentities {
+			if id == trusted {
+				return id, true
+			}
+		}
+	}
+	log.Printf("clientCertIdentity: Client certificate identity not trusted, subject: %s", r.TLS.VerifiedChains[0][0].Subject)
+	return "", false
+}
+
 func (s Server) adminAccessMw(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		uc, err := context.GetUserContext(r.Context())
@@ -78,7 +231,18 @@ func (s Server) adminAccessMw(next http.Handler) http.Handler {
 			return
 		}
 
+		if uc.ActorID != "" {
+			log.Printf("adminAccessMw: Admin route not allowed while impersonating, sub: %s, act: %s", uc.UserID, uc.ActorID)
+			http.Error(w, "not allowed while impersonating", http.StatusForbidden)
+			return
+		}
 		if uc.Role == "admin" {
+			// Client certificates identify services, which have no second factor
+			if s.MFA.RequireForAdmins && !uc.ClientCert && !accesstoken.MultiFactor(uc.AMR) && !routeNamed(r, mfaExemptRoutes) {
+				log.Printf("adminAccessMw: Route requires multi-factor authentication, sub: %s", uc.UserID)
+				http.Error(w, "multi-factor authentication is required", http.StatusForbidden)
+				return
+			}
 			next.ServeHTTP(w, r)
 			return
 		}
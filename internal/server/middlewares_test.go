@@ -0,0 +1,64 @@
+package server
+
+import (
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/accesstoken"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/context"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminAccessRequiresMFA(t *testing.T) {
+	s := Server{MFA: MFAOptions{RequireForAdmins: true}}
+	r := mux.NewRouter()
+	r.Use(s.adminAccessMw)
+	r.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {}).Methods(http.MethodGet)
+
+	tests := []struct {
+		name string
+		uc   context.UserContext
+		want int
+	}{
+		{name: "password", uc: context.UserContext{UserID: "a", Role: "admin", AMR: []string{accesstoken.AMRPassword}}, want: http.StatusForbidden},
+		{name: "password and code", uc: context.UserContext{UserID: "a", Role: "admin", AMR: []string{accesstoken.AMRPassword, accesstoken.AMROTP}}, want: http.StatusOK},
+		{name: "client certificate", uc: context.UserContext{UserID: "admin-service", Role: "admin", ClientCert: true}, want: http.StatusOK},
+		{name: "user", uc: context.UserContext{UserID: "u", Role: "user", AMR: []string{accesstoken.AMRPassword, accesstoken.AMROTP}}, want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			req = req.WithContext(context.SetUserContext(req.Context(), tt.uc))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenRevoked(t *testing.T) {
+	revokedAt := time.Date(2024, 1, 1, 12, 0, 0, int(300*time.Millisecond), time.UTC)
+	second := revokedAt.Truncate(time.Second)
+	tests := []struct {
+		name       string
+		issuedAt   time.Time
+		validAfter time.Time
+		want       bool
+	}{
+		{name: "second before", issuedAt: second.Add(-time.Second), validAfter: revokedAt, want: true},
+		{name: "same second", issuedAt: second, validAfter: revokedAt, want: true},
+		{name: "same second after revocation", issuedAt: revokedAt.Add(500 * time.Millisecond), validAfter: revokedAt, want: true},
+		{name: "second after", issuedAt: second.Add(time.Second), validAfter: revokedAt},
+		{name: "never revoked", issuedAt: second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenRevoked(tt.issuedAt, tt.validAfter); got != tt.want {
+				t.Errorf("tokenRevoked(%v, %v) = %v, want %v", tt.issuedAt, tt.validAfter, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/webauthn"
+	"time"
+)
+
+type AuthOptions struct {
+	AccessTokenTTL time.Duration
+	// LoginWithEmail allows logging in with a verified email in place of the username
+	LoginWithEmail bool
+	// PasswordMaxAge makes users change passwords older than it on login, 0 disables it
+	PasswordMaxAge time.Duration
+	Lockout        LockoutOptions
+	// ImpersonationTTL is the time to live of the tokens admins act as another user with
+	ImpersonationTTL time.Duration
+	// AllowSelfDeletion and AllowSelfDemotion let admins delete or demote themselves
+	AllowSelfDeletion bool
+	AllowSelfDemotion bool
+}
+
+// LockoutOptions throttle failed password logins for a username and for a client IP apart,
+// after the free attempts every failure doubles the delay from BaseDelay up to MaxDelay.
+type LockoutOptions struct {
+	Username  LockoutLimits
+	IP        LockoutLimits
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Duration  time.Duration
+	// Window is how long failures are counted after the last one
+	Window time.Duration
+}
+
+type LockoutLimits struct {
+	FreeAttempts int
+	// Threshold is how many failures lock for LockoutOptions.Duration, 0 only delays
+	Threshold int
+}
+
+type MFAOptions struct {
+	// Issuer names the service in authenticator apps
+	Issuer string
+	// RequireForAdmins makes admins enroll on login and use the second factor for the admin routes
+	RequireForAdmins bool
+	ChallengeTTL     time.Duration
+	RecoveryCodes    int
+}
+
+type WebAuthnOptions struct {
+	// RelyingParty is nil when passkeys are disabled
+	RelyingParty   *webauthn.RelyingParty
+	MaxCredentials int
+}
+
+type EmailOptions struct {
+	VerificationTTL time.Duration
+	// VerificationURL is the link sent for verifying an email, {token} is replaced with the token
+	VerificationURL string
+	ResendCooldown  time.Duration
+}
+
+type PasswordResetOptions struct {
+	TokenTTL time.Duration
+	// URL is the link sent for resetting a password, {token} is replaced with the token
+	URL      string
+	Cooldown time.Duration
+}
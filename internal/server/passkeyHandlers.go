@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/accesstoken"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/context"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/webauthn"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"net/http"
+	"time"
+)
+
+const maxPasskeyNameLength = 64
+
+type passkeyResponse struct {
+	ID         webauthn.URLEncoded `json:"id"`
+	Name       string              `json:"name"`
+	Transports []string            `json:"transports,omitempty"`
+	CreatedAt  time.Time           `json:"createdAt"`
+	LastUsedAt *time.Time          `json:"lastUsedAt,omitempty"`
+}
+
+func newPasskeyResponse(c database.WebAuthnCredential) passkeyResponse {
+	p := passkeyResponse{ID: c.ID, Name: c.Name, Transports: c.Transports, CreatedAt: c.CreatedAt}
+	if !c.LastUsedAt.IsZero() {
+		p.LastUsedAt = &c.LastUsedAt
+	}
+	return p
+}
+
+// passkeysEnabled writes 404 and returns false when passkeys are not configured.
+func (s Server) passkeysEnabled(w http.ResponseWriter) bool {
+	if s.WebAuthn.RelyingParty == nil {
+		http.Error(w, "passkeys are not enabled", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// newWebAuthnChallenge stores a challenge for ceremony and returns it, userID is set for registrations.
+func (s Server) newWebAuthnChallenge(r *http.Request, ceremony string, userID string) ([]byte, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(challenge)
+	err = s.UserDB.InsertWebAuthnChallenge(r.Context(), database.WebAuthnChallenge{
+		ChallengeHash: h[:],
+		Ceremony:      ceremony,
+		UserID:        userID,
+		ExpiresAt:     time.Now().Add(s.WebAuthn.RelyingParty.Timeout),
+	})
+	return challenge, err
+}
+
+// beginPasskeyRegistrationHandler returns the options for navigator.credentials.create
+// to add a passkey for the calling user.
+func (s Server) beginPasskeyRegistrationHandler() http.HandlerFunc {
+	type response struct {
+		PublicKey webauthn.CreationOptions `json:"publicKey"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.passkeysEnabled(w) {
+			return
+		}
+		u, ok := s.callingUser(w, r, "beginPasskeyRegistrationHandler")
+		if !ok {
+			return
+		}
+		if len(u.WebAuthnCredentials) >= s.WebAuthn.MaxCredentials {
+			http.Error(w, "too many passkeys, delete one first", http.StatusConflict)
+			return
+		}
+
+		challenge, err := s.newWebAuthnChallenge(r, database.WebAuthnRegistration, u.ID.Hex())
+		if err != nil {
+			log.Printf("beginPasskeyRegistrationHandler: Error creating challenge, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		displayName := u.Profile.DisplayName
+		if displayName == "" {
+			displayName = u.Username
+		}
+		exclude := make([]webauthn.CredentialDescriptor, len(u.WebAuthnCredentials))
+		for i, c := range u.WebAuthnCredentials {
+			exclude[i] = webauthn.CredentialDescriptor{Type: "public-key", ID: c.ID, Transports: c.Transports}
+		}
+
+		// The user handle is the ObjectID, so that it has no personal information
+		user := webauthn.User{ID: u.ID[:], Name: u.Username, DisplayName: displayName}
+		s.writeJsonResponse(w, response{PublicKey: s.WebAuthn.RelyingParty.CreationOptions(challenge, user, exclude)}, http.StatusOK)
+	}
+}
+
+func (s Server) finishPasskeyRegistrationHandler() http.HandlerFunc {
+	type request struct {
+		// Name tells the passkeys of a user apart, such as the device it is on
+		Name       string                        `json:"name"`
+		Credential webauthn.RegistrationResponse `json:"credential"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.passkeysEnabled(w) {
+			return
+		}
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("finishPasskeyRegistrationHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if len(req.Name) > maxPasskeyNameLength {
+			http.Error(w, "name is too long", http.StatusBadRequest)
+			return
+		}
+		uc, err := context.GetUserContext(r.Context())
+		if err != nil {
+			log.Printf("finishPasskeyRegistrationHandler: Error getting user context, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		challenge, err := req.Credential.Challenge()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h := sha256.Sum256(challenge)
+		pending, err := s.UserDB.ConsumeWebAuthnChallenge(r.Context(), h[:], database.WebAuthnRegistration, time.Now())
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, "invalid or expired challenge", http.StatusBadRequest)
+				return
+			}
+			log.Printf("finishPasskeyRegistrationHandler: Error consuming challenge, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if pending.UserID != uc.UserID {
+			http.Error(w, "invalid or expired challenge", http.StatusBadRequest)
+			return
+		}
+
+		cred, err := s.WebAuthn.RelyingParty.VerifyRegistration(req.Credential, challenge)
+		if err != nil {
+			log.Printf("finishPasskeyRegistrationHandler: Registration rejected, sub: %s, err: %v", uc.UserID, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		u, ok := s.callingUser(w, r, "finishPasskeyRegistrationHandler")
+		if !ok {
+			return
+		}
+		c := database.WebAuthnCredential{
+			ID:         cred.ID,
+			Name:       req.Name,
+			PublicKey:  cred.PublicKey,
+			SignCount:  cred.SignCount,
+			AAGUID:     cred.AAGUID,
+			Transports: cred.Transports,
+			CreatedAt:  time.Now(),
+		}
+		if err := s.UserDB.AddWebAuthnCredential(r.Context(), u.Username, c, s.WebAuthn.MaxCredentials); err != nil {
+			switch {
+			case mongo.IsDuplicateKeyError(err):
+				http.Error(w, "passkey is already registered", http.StatusConflict)
+			case errors.Is(err, database.ErrNoDocumentsModified):
+				http.Error(w, "too many passkeys, delete one first", http.StatusConflict)
+			default:
+				log.Printf("finishPasskeyRegistrationHandler: Error adding credential, err: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		s.writeJsonResponse(w, newPasskeyResponse(c), http.StatusCreated)
+	}
+}
+
+func (s Server) listPasskeysHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := s.callingUser(w, r, "listPasskeysHandler")
+		if !ok {
+			return
+		}
+		passkeys := make([]passkeyResponse, len(u.WebAuthnCredentials))
+		for i, c := range u.WebAuthnCredentials {
+			passkeys[i] = newPasskeyResponse(c)
+		}
+		s.writeJsonResponse(w, passkeys, http.StatusOK)
+	}
+}
+
+func (s Server) deletePasskeyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := base64.RawURLEncoding.DecodeString(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "id should be the base64url passkey ID", http.StatusBadRequest)
+			return
+		}
+		u, ok := s.callingUser(w, r, "deletePasskeyHandler")
+		if !ok {
+			return
+		}
+		if err := s.UserDB.DeleteWebAuthnCredential(r.Context(), u.Username, id); err != nil {
+			if errors.Is(err, database.ErrNoDocumentsModified) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			log.Printf("deletePasskeyHandler: Error deleting credential, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// beginPasskeyLoginHandler returns the options for navigator.credentials.get, the
+// authenticator offers the passkeys it has, so no username is needed.
+func (s Server) beginPasskeyLoginHandler() http.HandlerFunc {
+	type response struct {
+		PublicKey webauthn.RequestOptions `json:"publicKey"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.passkeysEnabled(w) {
+			return
+		}
+		challenge, err := s.newWebAuthnChallenge(r, database.WebAuthnLogin, "")
+		if err != nil {
+			log.Printf("beginPasskeyLoginHandler: Error creating challenge, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		s.writeJsonResponse(w, response{PublicKey: s.WebAuthn.RelyingParty.RequestOptions(challenge)}, http.StatusOK)
+	}
+}
+
+// finishPasskeyLoginHandler verifies an assertion and issues the same tokens as loginHandler.
+func (s Server) finishPasskeyLoginHandler() http.HandlerFunc {
+	type request struct {
+		Credential webauthn.AssertionResponse `json:"credential"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.passkeysEnabled(w) {
+			return
+		}
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("finishPasskeyLoginHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		challenge, err := req.Credential.Challenge()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h := sha256.Sum256(challenge)
+		if _, err := s.UserDB.ConsumeWebAuthnChallenge(r.Context(), h[:], database.WebAuthnLogin, time.Now()); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, "invalid or expired challenge", http.StatusUnauthorized)
+				return
+			}
+			log.Printf("finishPasskeyLoginHandler: Error consuming challenge, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		u, err := s.UserDB.FindUserByWebAuthnCredential(r.Context(), req.Credential.RawID)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			log.Printf("finishPasskeyLoginHandler: Error getting User, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		var cred database.WebAuthnCredential
+		for _, c := range u.WebAuthnCredentials {
+			if bytes.Equal(c.ID, req.Credential.RawID) {
+				cred = c
+			}
+		}
+		if userHandle := req.Credential.Response.UserHandle; len(userHandle) > 0 && !bytes.Equal(userHandle, u.ID[:]) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		assertion, err := s.WebAuthn.RelyingParty.VerifyAssertion(req.Credential, challenge, cred.PublicKey, cred.SignCount)
+		if err != nil {
+			log.Printf("finishPasskeyLoginHandler: Assertion rejected, username: %s, err: %v", u.Username, err)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		// A passkey without user verification is a single factor, which isn't enough in place of a second one
+		if !assertion.UserVerified && u.MFA.Enabled() {
+			http.Error(w, "user verification is required when MFA is enabled", http.StatusUnauthorized)
+			return
+		}
+		if err := s.UserDB.UseWebAuthnCredential(r.Context(), u.Username, cred.ID, cred.SignCount, assertion.SignCount, time.Now()); err != nil {
+			if errors.Is(err, database.ErrNoDocumentsModified) {
+				// Another login with the same passkey won, or it was deleted in the meantime
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			log.Printf("finishPasskeyLoginHandler: Error updating credential, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		amr := []string{accesstoken.AMRHardwareKey}
+		if assertion.UserVerified {
+			amr = append(amr, accesstoken.AMRMultiFactor)
+		}
+		resp, err := s.newLoginResponse(r, u, amr)
+		if err != nil {
+			log.Printf("finishPasskeyLoginHandler: Error creating access token, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		s.writeJsonResponse(w, resp, http.StatusOK)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/notify"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// forgotPasswordHandler always responds the same way, the reset is issued in the background
+// so that neither the response nor its timing reveals whether the account exists.
+func (s Server) forgotPasswordHandler() http.HandlerFunc {
+	type request struct {
+		// Username may also be an email, resets are only sent to verified emails
+		Username string `json:"username"`
+	}
+	type response struct {
+		Success bool `json:"success"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("forgotPasswordHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if req.Username == "" {
+			http.Error(w, "username must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		err := s.Background.Submit(func(ctx context.Context) {
+			if err := s.issuePasswordReset(ctx, req.Username); err != nil {
+				log.Printf("forgotPasswordHandler: Error issuing password reset, err: %v", err)
+			}
+		})
+		if err != nil {
+			log.Printf("forgotPasswordHandler: Error queueing password reset, err: %v", err)
+		}
+
+		s.writeJsonResponse(w, response{Success: true}, http.StatusAccepted)
+	}
+}
+
+func (s Server) issuePasswordReset(ctx context.Context, username string) error {
+	var u database.User
+	var err error
+	if strings.Contains(username, "@") {
+		u, err = s.UserDB.FindUserByEmail(ctx, username)
+		if err == nil && !u.EmailVerified {
+			err = mongo.ErrNoDocuments
+		}
+	} else {
+		u, err = s.UserDB.FindUserByUsername(ctx, username)
+	}
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		return fmt.Errorf("error getting User: %w", err)
+	}
+
+	now := time.Now()
+	if pr := u.PasswordReset; pr != nil && now.Sub(pr.SentAt) < s.PasswordReset.Cooldown {
+		return nil
+	}
+
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	pr := database.PasswordReset{
+		TokenHash: tokenHash,
+		SentAt:    now,
+		ExpiresAt: now.Add(s.PasswordReset.TokenTTL),
+	}
+	if err := s.UserDB.SetPasswordReset(ctx, u.Username, pr); err != nil {
+		return err
+	}
+
+	to := notify.Recipient{Username: u.Username}
+	if u.EmailVerified {
+		to.Email = u.Profile.Email
+	}
+	if err := s.Notifier.Notify(ctx, to, s.passwordResetNotification(u, token, pr.ExpiresAt)); err != nil {
+		return fmt.Errorf("error notifying password reset, username: %s: %w", u.Username, err)
+	}
+	return nil
+}
+
+func (s Server) resetPasswordHandler() http.HandlerFunc {
+	type request struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	type response struct {
+		Success bool `json:"success"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("resetPasswordHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if req.Token == "" || req.Password == "" {
+			http.Error(w, "token and password must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		tokenHash := hashOpaqueToken(req.Token)
+		u, err := s.UserDB.FindUserByPasswordResetToken(r.Context(), tokenHash, time.Now())
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, "invalid or expired token", http.StatusBadRequest)
+				return
+			}
+			log.Printf("resetPasswordHandler: Error getting User, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !s.checkPassword(w, r, req.Password, u.Username) {
+			return
+		}
+
+		hashedPassword, err := s.hashPassword(r.Context(), req.Password)
+		if err != nil {
+			if s.hashingUnavailable(w, err) {
+				return
+			}
+			log.Printf("resetPasswordHandler: Error hashing password, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// The token is checked again, it may have been used or replaced in the meantime
+		if _, err := s.UserDB.ResetPassword(r.Context(), tokenHash, hashedPassword, time.Now()); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, "invalid or expired token", http.StatusBadRequest)
+				return
+			}
+			log.Printf("resetPasswordHandler: Error resetting password, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		s.writeJsonResponse(w, response{Success: true}, http.StatusOK)
+	}
+}
+
+func (s Server) passwordResetNotification(u database.User, token string, expiresAt time.Time) notify.Notification {
+	link := token
+	if s.PasswordReset.URL != "" {
+		link = strings.ReplaceAll(s.PasswordReset.URL, "{token}", token)
+	}
+	return notify.Notification{
+		Kind:    notify.KindPasswordReset,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nReset your password with:\n\n%s\n\nThis expires at %s. "+
+			"If you didn't ask for this you can ignore it.\n",
+			u.Username, link, expiresAt.UTC().Format(time.RFC1123)),
+		Data: map[string]string{"token": token, "link": link, "expiresAt": expiresAt.UTC().Format(time.RFC3339)},
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordhash"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordpolicy"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// hashPassword is the single place passwords are hashed for storage.
+func (s Server) hashPassword(ctx context.Context, password string) ([]byte, error) {
+	return s.Passwords.Hash(ctx, password)
+}
+
+// hashingUnavailable writes 503 when err means the password hashing pool is full, with
+// Retry-After, or that the request was canceled while waiting for it, and reports if it did.
+func (s Server) hashingUnavailable(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, passwordhash.ErrPoolFull):
+		retryAfter := int(math.Ceil(s.Passwords.RetryAfter().Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, "password hashing is busy, try again later", http.StatusServiceUnavailable)
+		return true
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return true
+	default:
+		return false
+	}
+}
+
+// rehashPassword upgrades the stored hash of u, whose password has just been verified,
+// when it was created with another algorithm or lower costs than configured.
+func (s Server) rehashPassword(ctx context.Context, u database.User, password string) {
+	if !s.Passwords.Hasher.NeedsRehash(u.Password) {
+		return
+	}
+	hashedPassword, err := s.hashPassword(ctx, password)
+	if err != nil {
+		// Not worth failing the login for, the next one tries again
+		log.Printf("rehashPassword: Error hashing password, err: %v", err)
+		return
+	}
+	if err := s.UserDB.RehashUserPassword(ctx, u.Username, u.Password, hashedPassword); err != nil {
+		log.Printf("rehashPassword: Error storing rehashed password, err: %v", err)
+	}
+}
+
+type passwordPolicyResponse struct {
+	Error      string                     `json:"error"`
+	Violations []passwordpolicy.Violation `json:"violations"`
+}
+
+// validatePassword checks a new password of username against the policy and, when the user
+// exists, against its password history. A *passwordpolicy.Error lists the violations.
+func (s Server) validatePassword(ctx context.Context, password string, username string) error {
+	if err := s.PasswordPolicy.Check(password, username); err != nil {
+		return err
+	}
+	if s.PasswordPolicy == nil || s.PasswordPolicy.HistorySize <= 0 {
+		return nil
+	}
+	hashes, err := s.UserDB.FindPasswordHashes(ctx, username)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		return err
+	}
+	var reuseErr error
+	if err := s.Passwords.Do(ctx, func() { reuseErr = s.PasswordPolicy.CheckReuse(password, hashes) }); err != nil {
+		return err
+	}
+	return reuseErr
+}
+
+// checkPassword validates password, when it is rejected the violations
+// are written to w and false is returned.
+func (s Server) checkPassword(w http.ResponseWriter, r *http.Request, password string, username string) bool {
+	err := s.validatePassword(r.Context(), password, username)
+	if err == nil {
+		return true
+	}
+	var pe *passwordpolicy.Error
+	if errors.As(err, &pe) {
+		s.writeJsonResponse(w, passwordPolicyResponse{
+			Error:      "password does not satisfy the policy",
+			Violations: pe.Violations,
+		}, http.StatusBadRequest)
+		return false
+	}
+	if s.hashingUnavailable(w, err) {
+		return false
+	}
+	log.Printf("checkPassword: Error checking password policy, err: %v", err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	return false
+}
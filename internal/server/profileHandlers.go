@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/context"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/mergepatch"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/validation"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+)
+
+const maxProfilePatchBytes = 64 << 10
+
+// getUserProfileHandler gets a profile, admins may get any profile and users only their own.
+func (s Server) getUserProfileHandler() http.HandlerFunc {
+	type response database.Profile
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := mux.Vars(r)["username"]
+
+		u, err := s.UserDB.FindUserByUsername(r.Context(), username)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			log.Printf("getUserProfileHandler: Error getting User, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !canSeeProfile(r, u.ID.Hex()) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		s.writeJsonResponse(w, response(u.Profile), http.StatusOK)
+	}
+}
+
+// patchUserProfileHandler applies a JSON Merge Patch to the profile, admins may patch any profile
+// and users only their own.
+func (s Server) patchUserProfileHandler() http.HandlerFunc {
+	type response database.Profile
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := mux.Vars(r)["username"]
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/merge-patch+json" && mediaType != "application/json" {
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		uc, err := context.GetUserContext(r.Context())
+		if err != nil {
+			log.Printf("patchUserProfileHandler: Error getting user context, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		u, err := s.UserDB.FindUserByUsername(r.Context(), username)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			log.Printf("patchUserProfileHandler: Error getting User, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if uc.Role != validation.RoleAdmin && uc.UserID != u.ID.Hex() {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		patch, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxProfilePatchBytes))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		current, err := json.Marshal(u.Profile)
+		if err != nil {
+			log.Printf("patchUserProfileHandler: Error encoding profile, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		patched, err := mergepatch.Apply(current, patch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		p := database.Profile{}
+		dec := json.NewDecoder(bytes.NewReader(patched))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&p); err != nil {
+			http.Error(w, "invalid profile: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		p = validation.NormalizeProfile(p)
+		if err := validation.Profile(p, s.ProfileAttributesSchema); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		err = s.UserDB.UpdateUserProfile(r.Context(), username, p)
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "email is already in use", http.StatusConflict)
+			return
+		}
+		if err != nil && !errors.Is(err, database.ErrNoDocumentsModified) {
+			log.Printf("patchUserProfileHandler: Error updating User profile, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		s.writeJsonResponse(w, response(p), http.StatusOK)
+	}
+}
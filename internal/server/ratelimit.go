@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/context"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/ratelimit"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Route groups with their own rate limit.
+const (
+	rateLimitPublic   = "public"
+	rateLimitAPI      = "api"
+	rateLimitAdminAPI = "adminAPI"
+	rateLimitAPIPerIP = "apiPerIP"
+)
+
+// RateLimits are the limits of the route groups, for every user or client IP.
+type RateLimits struct {
+	Public   ratelimit.Limit
+	API      ratelimit.Limit
+	AdminAPI ratelimit.Limit
+	// APIPerIP limits api and adminAPI for every client IP, before the access token is checked
+	APIPerIP ratelimit.Limit
+}
+
+func (rl RateLimits) group(name string) ratelimit.Limit {
+	switch name {
+	case rateLimitPublic:
+		return rl.Public
+	case rateLimitAPI:
+		return rl.API
+	case rateLimitAdminAPI:
+		return rl.AdminAPI
+	case rateLimitAPIPerIP:
+		return rl.APIPerIP
+	default:
+		return ratelimit.Limit{}
+	}
+}
+
+// rateLimitMw limits the requests to the routes of group for the calling user, or the client IP
+// when the user isn't known yet, so it has to come after authMw to limit users, and before it to limit client IPs.
+// The RateLimit headers are those of the IETF httpapi-ratelimit-headers draft.
+func (s Server) rateLimitMw(group string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			l := s.Settings.Load().RateLimits.group(group)
+			if !l.Enabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key := group + ":ip:" + s.clientIP(r)
+			if uc, err := context.GetUserContext(r.Context()); err == nil {
+				key = group + ":user:" + uc.UserID
+			}
+
+			res, err := s.RateLimitStore.Take(r.Context(), key, l, time.Now())
+			if err != nil {
+				// An unavailable shared store shouldn't make the whole API unavailable
+				log.Printf("rateLimitMw: Error taking from bucket, request allowed, key: %s, err: %v", key, err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			h := w.Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(l.Requests))
+			h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+			h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", l.Requests, ceilSeconds(l.Period)))
+			if !res.Allowed {
+				h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+				http.Error(w, "rate limit exceeded, try again later", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// clientIP is the address of the client the request came from, in the form unlockLoginHandler accepts.
+// Behind TrustedProxies it is the last address of X-Forwarded-For which isn't a trusted proxy,
+// the ones before it could have been sent by the client.
+func (s Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if !s.trustedProxy(ip) {
+		return ip.String()
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !s.trustedProxy(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+func (s Server) trustedProxy(ip net.IP) bool {
+	for _, n := range s.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordhash"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/ratelimit"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newRateLimitedServer(rl RateLimits) Server {
+	return Server{
+		Settings:             NewLiveSettings(Settings{RateLimits: rl}),
+		Health:               NewHealth(),
+		ClientCertIdentities: []string{"admin-service"},
+		Passwords:            passwordhash.NewPool(passwordhash.Hasher{Algorithm: passwordhash.AlgorithmBcrypt, BcryptCost: 4}, 1, 1, time.Second),
+		RateLimitStore:       ratelimit.NewMemoryStore(),
+	}
+}
+
+func TestRateLimitInvalidTokens(t *testing.T) {
+	s := newRateLimitedServer(RateLimits{
+		API:      ratelimit.Limit{Requests: 100, Period: time.Minute},
+		APIPerIP: ratelimit.Limit{Requests: 2, Period: time.Minute},
+	})
+	h := s.Router()
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		r := httptest.NewRequest(http.MethodGet, "/user/get", nil)
+		r.Header.Set("Authorization", "Bearer invalid")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("request %d: status = %d, want %d", i, w.Code, want)
+		}
+	}
+}
+
+func TestRateLimitAdminAPIOnlyCountsOnce(t *testing.T) {
+	s := newRateLimitedServer(RateLimits{
+		API:      ratelimit.Limit{Requests: 1, Period: time.Minute},
+		AdminAPI: ratelimit.Limit{Requests: 3, Period: time.Minute},
+	})
+	h := s.Router()
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "admin-service"}}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("request %d: status = %d, want %d", i, w.Code, want)
+		}
+		if got := w.Header().Get("RateLimit-Limit"); got != "3" {
+			t.Errorf("request %d: RateLimit-Limit = %s, want the adminAPI limit 3", i, got)
+		}
+	}
+}
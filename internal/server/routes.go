@@ -1,27 +1,116 @@
 package server
 
 import (
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/accesstoken"
 	"github.com/gorilla/mux"
 	"net/http"
 )
 
+const (
+	routeChangePassword       = "changePassword"
+	routeMFAEnroll            = "mfaEnroll"
+	routeMFAConfirm           = "mfaConfirm"
+	routeCreateUser           = "createUser"
+	routeUpdateUserPassword   = "updateUserPassword"
+	routeUpdateUserMustChange = "updateUserMustChangePassword"
+	routeUpdateUserRole       = "updateUserRole"
+	routeUpdateUserInfo       = "updateUserInfo"
+	routeDeleteUser           = "deleteUser"
+	routeBatch                = "batch"
+	routeImportUsers          = "importUsers"
+	routeExportUsers          = "exportUsers"
+	routeResetMFA             = "resetMFA"
+	routeUnlockLogin          = "unlockLogin"
+	routeRevokeUserSessions   = "revokeUserSessions"
+	routeImpersonate          = "impersonate"
+	routeRecoveryCodes        = "recoveryCodes"
+	routePatchProfile         = "patchProfile"
+	routeBeginPasskey         = "beginPasskeyRegistration"
+	routeFinishPasskey        = "finishPasskeyRegistration"
+	routeDeletePasskey        = "deletePasskey"
+	routeDeleteSession        = "deleteSession"
+)
+
+// scopeRoutes are the names of the routes which restricted access tokens may call.
+var scopeRoutes = map[string][]string{
+	accesstoken.ScopePasswordChange: {routeChangePassword},
+	accesstoken.ScopeMFAEnrollment:  {routeMFAEnroll, routeMFAConfirm},
+}
+
+// mfaExemptRoutes are the names of the admin routes which don't need a second factor
+// when MFAOptions.RequireForAdmins is set, every other admin route does, new ones included.
+// No route is exempt so far.
+var mfaExemptRoutes []string
+
+// impersonationBlockedRoutes are the names of the routes changing credentials or contact details,
+// which tokens of admins impersonating a user may not call, besides any admin route.
+var impersonationBlockedRoutes = []string{
+	routeChangePassword, routeMFAEnroll, routeMFAConfirm, routeRecoveryCodes, routePatchProfile,
+	routeBeginPasskey, routeFinishPasskey, routeDeletePasskey, routeDeleteSession,
+}
+
+func (s Server) Handler() http.Handler {
+	return s.corsMw(s.Router())
+}
+
 func (s Server) Router() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(s.inFlightMw)
+
+	r.HandleFunc("/health/live", s.liveHandler()).Methods(http.MethodGet)
+	r.HandleFunc("/health/ready", s.readyHandler()).Methods(http.MethodGet)
 
 	r.PathPrefix("/docs").Handler(http.StripPrefix("/docs", http.FileServer(http.Dir("docs"))))
 
+	// Health checks and docs aren't rate limited, so that probes from behind one proxy aren't refused
+	public := r.NewRoute().Subrouter()
+	public.Use(s.rateLimitMw(rateLimitPublic))
+	public.HandleFunc("/auth/login", s.loginHandler()).Methods(http.MethodPost)
+	public.HandleFunc("/auth/login/mfa", s.mfaLoginHandler()).Methods(http.MethodPost)
+	public.HandleFunc("/auth/passkey/login/begin", s.beginPasskeyLoginHandler()).Methods(http.MethodPost)
+	public.HandleFunc("/auth/passkey/login/finish", s.finishPasskeyLoginHandler()).Methods(http.MethodPost)
+	public.HandleFunc("/auth/forgot-password", s.forgotPasswordHandler()).Methods(http.MethodPost)
+	public.HandleFunc("/auth/reset-password", s.resetPasswordHandler()).Methods(http.MethodPost)
+	public.HandleFunc("/user/email/verification/confirm", s.confirmEmailVerificationHandler()).Methods(http.MethodPost)
+
+	// api and adminAPI are siblings so that admin routes only count against the adminAPI limit,
+	// both are limited by client IP first so that requests with invalid tokens are limited too
 	api := r.NewRoute().Subrouter()
-	api.Use(s.authMw)
+	api.Use(s.rateLimitMw(rateLimitAPIPerIP), s.authMw, s.rateLimitMw(rateLimitAPI))
+	api.HandleFunc("/user/change-password", s.changePasswordHandler()).Methods(http.MethodPost).Name(routeChangePassword)
 	api.HandleFunc("/user/get", s.getAllUserHandler()).Methods(http.MethodGet)
 	api.HandleFunc("/user/get/{username}", s.getUserHandler()).Methods(http.MethodGet)
+	api.HandleFunc("/user/profile/{username}", s.getUserProfileHandler()).Methods(http.MethodGet)
+	api.HandleFunc("/user/profile/{username}", s.patchUserProfileHandler()).Methods(http.MethodPatch).Name(routePatchProfile)
+	api.HandleFunc("/user/email/verification/send", s.sendEmailVerificationHandler(false)).Methods(http.MethodPost)
+	api.HandleFunc("/user/email/verification/resend", s.sendEmailVerificationHandler(true)).Methods(http.MethodPost)
+	api.HandleFunc("/user/mfa", s.getMFAHandler()).Methods(http.MethodGet)
+	api.HandleFunc("/user/mfa/totp/enroll", s.enrollTOTPHandler()).Methods(http.MethodPost).Name(routeMFAEnroll)
+	api.HandleFunc("/user/mfa/totp/confirm", s.confirmTOTPHandler()).Methods(http.MethodPost).Name(routeMFAConfirm)
+	api.HandleFunc("/user/mfa/recovery-codes", s.regenerateRecoveryCodesHandler()).Methods(http.MethodPost).Name(routeRecoveryCodes)
+	api.HandleFunc("/user/passkeys", s.listPasskeysHandler()).Methods(http.MethodGet)
+	api.HandleFunc("/user/passkeys/register/begin", s.beginPasskeyRegistrationHandler()).Methods(http.MethodPost).Name(routeBeginPasskey)
+	api.HandleFunc("/user/passkeys/register/finish", s.finishPasskeyRegistrationHandler()).Methods(http.MethodPost).Name(routeFinishPasskey)
+	api.HandleFunc("/user/passkeys/{id}", s.deletePasskeyHandler()).Methods(http.MethodDelete).Name(routeDeletePasskey)
+	api.HandleFunc("/user/sessions", s.listSessionsHandler()).Methods(http.MethodGet)
+	api.HandleFunc("/user/sessions/{id}", s.deleteSessionHandler()).Methods(http.MethodDelete).Name(routeDeleteSession)
 
-	adminAPI := api.NewRoute().Subrouter()
-	adminAPI.Use(s.adminAccessMw)
-	adminAPI.HandleFunc("/user/create", s.createUserHandler()).Methods(http.MethodPost)
-	adminAPI.HandleFunc("/user/update-password", s.updateUserPasswordHandler()).Methods(http.MethodPost)
-	adminAPI.HandleFunc("/user/update-role", s.updateUserRoleHandler()).Methods(http.MethodPost)
-	adminAPI.HandleFunc("/user/update-info", s.updateUserInfoHandler()).Methods(http.MethodPost)
-	adminAPI.HandleFunc("/user/delete", s.deleteUserHandler()).Methods(http.MethodPost)
+	adminAPI := r.NewRoute().Subrouter()
+	adminAPI.Use(s.rateLimitMw(rateLimitAPIPerIP), s.authMw, s.adminAccessMw, s.rateLimitMw(rateLimitAdminAPI))
+	adminAPI.HandleFunc("/user/create", s.createUserHandler()).Methods(http.MethodPost).Name(routeCreateUser)
+	adminAPI.HandleFunc("/user/update-password", s.updateUserPasswordHandler()).Methods(http.MethodPost).Name(routeUpdateUserPassword)
+	adminAPI.HandleFunc("/user/update-must-change-password", s.updateUserMustChangePasswordHandler()).Methods(http.MethodPost).Name(routeUpdateUserMustChange)
+	adminAPI.HandleFunc("/user/update-role", s.updateUserRoleHandler()).Methods(http.MethodPost).Name(routeUpdateUserRole)
+	adminAPI.HandleFunc("/user/update-info", s.updateUserInfoHandler()).Methods(http.MethodPost).Name(routeUpdateUserInfo)
+	adminAPI.HandleFunc("/user/delete", s.deleteUserHandler()).Methods(http.MethodPost).Name(routeDeleteUser)
+	adminAPI.HandleFunc("/user/mfa/reset", s.resetMFAHandler()).Methods(http.MethodPost).Name(routeResetMFA)
+	adminAPI.HandleFunc("/user/unlock", s.unlockLoginHandler()).Methods(http.MethodPost).Name(routeUnlockLogin)
+	adminAPI.HandleFunc("/user/sessions/revoke", s.revokeUserSessionsHandler()).Methods(http.MethodPost).Name(routeRevokeUserSessions)
+	adminAPI.HandleFunc("/user/impersonate", s.impersonateHandler()).Methods(http.MethodPost).Name(routeImpersonate)
+	adminAPI.HandleFunc("/user/batch", s.batchHandler()).Methods(http.MethodPost).Name(routeBatch)
+	adminAPI.HandleFunc("/user/import", s.importUsersHandler()).Methods(http.MethodPost).Name(routeImportUsers)
+	adminAPI.HandleFunc("/user/export", s.exportUsersHandler()).Methods(http.MethodGet).Name(routeExportUsers)
+	adminAPI.HandleFunc("/metrics", s.metricsHandler()).Methods(http.MethodGet)
 
 	return r
 }
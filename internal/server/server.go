@@ -3,14 +3,47 @@ package server
 import (
 	"encoding/json"
 	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
-	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/jsonschema"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/mail"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/notify"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordhash"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordpolicy"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/ratelimit"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/usernames"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/worker"
 	"log"
+	"net"
 	"net/http"
 )
 
 type Server struct {
-	UserDB            database.UserDatabase
-	AccessTokenSecret jwk.Key
+	UserDB   database.UserDatabase
+	Settings *LiveSettings
+	Health   *Health
+	// Verified client certificate identities allowed to call the API as admin
+	ClientCertIdentities []string
+	// Schema for profile attributes, any attributes are accepted when nil
+	ProfileAttributesSchema *jsonschema.Schema
+	Mailer                  mail.Mailer
+	Auth                    AuthOptions
+	MFA                     MFAOptions
+	WebAuthn                WebAuthnOptions
+	Email                   EmailOptions
+	// Notifier delivers password reset tokens
+	Notifier      notify.Notifier
+	PasswordReset PasswordResetOptions
+	// Background runs the work which outlives its request, such as issuing password resets
+	Background *worker.Queue
+	// UsernamePolicy is checked when a user is created
+	UsernamePolicy usernames.Policy
+	// PasswordPolicy is checked whenever a password is set, any password is accepted when nil
+	PasswordPolicy *passwordpolicy.Policy
+	// Passwords hashes and verifies passwords with a bounded number of workers
+	Passwords *passwordhash.Pool
+	// TrustedProxies are the networks of the proxies whose X-Forwarded-For is used for the client IP
+	TrustedProxies []*net.IPNet
+	// RateLimitStore keeps the request counts of the Settings.RateLimits
+	RateLimitStore ratelimit.Store
 }
 
 func (s Server) writeJsonResponse(w http.ResponseWriter, response any, statusCode int) {
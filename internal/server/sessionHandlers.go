@@ -0,0 +1,254 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/context"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	maxUserAgentLength = 512
+	// sessionTouchInterval is how often the last use of a session is recorded, rather than on every request
+	sessionTouchInterval = time.Minute
+)
+
+type sessionResponse struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"userAgent"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	// Current is the session of the access token of the request
+	Current bool `json:"current"`
+	// ActorID is the admin impersonating the user in the session
+	ActorID string `json:"actorId,omitempty"`
+}
+
+// issueSession returns the session for an access token of u issued at now until expiresAt. Tokens issued to
+// an authenticated caller, such as on changing the password, renew its session, logins start a new one.
+func (s Server) issueSession(r *http.Request, u database.User, now time.Time, expiresAt time.Time) (string, error) {
+	if uc, err := context.GetUserContext(r.Context()); err == nil && uc.SessionID != "" {
+		return uc.SessionID, s.UserDB.RenewSession(r.Context(), uc.SessionID, u.ID.Hex(), now, expiresAt)
+	}
+
+	session, err := s.newSession(r, u, now, expiresAt)
+	if err != nil {
+		return "", err
+	}
+	return session.ID, s.UserDB.InsertSession(r.Context(), session)
+}
+
+// newSession returns a new session of u for the client of r, it is not stored yet.
+func (s Server) newSession(r *http.Request, u database.User, now time.Time, expiresAt time.Time) (database.Session, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return database.Session{}, fmt.Errorf("error generating session ID: %w", err)
+	}
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgentLength {
+		ua = ua[:maxUserAgentLength]
+	}
+	return database.Session{
+		ID:         base64.RawURLEncoding.EncodeToString(b),
+		UserID:     u.ID.Hex(),
+		Device:     deviceFromUserAgent(ua),
+		IP:         s.clientIP(r),
+		UserAgent:  ua,
+		CreatedAt:  now,
+		IssuedAt:   now,
+		LastUsedAt: now,
+		ExpiresAt:  expiresAt,
+	}, nil
+}
+
+// checkSession writes the error and returns false when the session sid of userID has been revoked
+// or has expired, otherwise it records the use of the session.
+func (s Server) checkSession(w http.ResponseWriter, r *http.Request, sid string, userID string) bool {
+	now := time.Now()
+	session, err := s.UserDB.FindSession(r.Context(), sid, now)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("authMw: Session revoked, sub: %s", userID)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return false
+		}
+		log.Printf("authMw: Error getting session, err: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	if session.UserID != userID {
+		log.Printf("authMw: Session of another user, sub: %s", userID)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	if now.Sub(session.LastUsedAt) > sessionTouchInterval {
+		if err := s.UserDB.TouchSession(r.Context(), sid, now); err != nil {
+			log.Printf("authMw: Error touching session, err: %v", err)
+		}
+	}
+	return true
+}
+
+// Product tokens of user agents in the order they are looked for, Chromium based browsers
+// also name Chrome and Safari, and Chrome also names Safari.
+var (
+	userAgentBrowsers = [][2]string{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+	}
+	userAgentPlatforms = [][2]string{
+		{"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Android", "Android"}, {"Windows", "Windows"},
+		{"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	}
+)
+
+// deviceFromUserAgent describes the device of ua for listing sessions, such as Firefox on Windows,
+// other clients are named by their first product token.
+func deviceFromUserAgent(ua string) string {
+	var browser, platform string
+	for _, b := range userAgentBrowsers {
+		if strings.Contains(ua, b[0]) {
+			browser = b[1]
+			break
+		}
+	}
+	for _, p := range userAgentPlatforms {
+		if strings.Contains(ua, p[0]) {
+			platform = p[1]
+			break
+		}
+	}
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	}
+	if product, _, _ := strings.Cut(ua, "/"); strings.TrimSpace(product) != "" {
+		return strings.TrimSpace(product)
+	}
+	return "Unknown device"
+}
+
+// listSessionsHandler lists the active sessions of the calling user.
+func (s Server) listSessionsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := s.callingUser(w, r, "listSessionsHandler")
+		if !ok {
+			return
+		}
+		uc, _ := context.GetUserContext(r.Context())
+		sessions, err := s.UserDB.FindSessions(r.Context(), u.ID.Hex(), time.Now())
+		if err != nil {
+			log.Printf("listSessionsHandler: Error getting sessions, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		resp := make([]sessionResponse, 0, len(sessions))
+		for _, session := range sessions {
+			// Its tokens have been revoked, such as by resetting the password
+			if tokenRevoked(session.IssuedAt, u.TokensValidAfter) {
+				continue
+			}
+			resp = append(resp, sessionResponse{
+				ID:         session.ID,
+				Device:     session.Device,
+				IP:         session.IP,
+				UserAgent:  session.UserAgent,
+				CreatedAt:  session.CreatedAt,
+				LastUsedAt: session.LastUsedAt,
+				ExpiresAt:  session.ExpiresAt,
+				Current:    session.ID == uc.SessionID,
+				ActorID:    session.ActorID,
+			})
+		}
+		s.writeJsonResponse(w, resp, http.StatusOK)
+	}
+}
+
+// deleteSessionHandler revokes a session of the calling user, which may be the current one.
+func (s Server) deleteSessionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uc, err := context.GetUserContext(r.Context())
+		if err != nil {
+			log.Printf("deleteSessionHandler: Error getting user context, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if err := s.UserDB.DeleteSession(r.Context(), mux.Vars(r)["id"], uc.UserID); err != nil {
+			if errors.Is(err, database.ErrNoDocumentsModified) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			log.Printf("deleteSessionHandler: Error deleting session, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// revokeUserSessionsHandler lets an admin revoke every session of a user, along with
+// the access tokens issued without a session.
+func (s Server) revokeUserSessionsHandler() http.HandlerFunc {
+	type request struct {
+		Username string `json:"username"`
+	}
+	type response struct {
+		Success bool `json:"success"`
+		// Revoked is how many sessions were revoked
+		Revoked int64 `json:"revoked"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("revokeUserSessionsHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if req.Username == "" {
+			http.Error(w, "username must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		u, err := s.UserDB.FindUserByUsername(r.Context(), req.Username)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			log.Printf("revokeUserSessionsHandler: Error getting User, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		revoked, err := s.UserDB.DeleteSessions(r.Context(), u.ID.Hex())
+		if err != nil {
+			log.Printf("revokeUserSessionsHandler: Error deleting sessions, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if err := s.UserDB.RevokeUserTokens(r.Context(), u.Username, time.Now()); err != nil {
+			log.Printf("revokeUserSessionsHandler: Error revoking tokens, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		uc, _ := context.GetUserContext(r.Context())
+		log.Printf("revokeUserSessionsHandler: Sessions revoked, username: %s, sessions: %d, by: %s", u.Username, revoked, uc.UserID)
+
+		s.writeJsonResponse(w, response{Success: true, Revoked: revoked}, http.StatusOK)
+	}
+}
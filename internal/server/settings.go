@@ -0,0 +1,32 @@
+package server
+
+import (
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"sync/atomic"
+)
+
+// Settings are the server settings which can be changed while serving, they are replaced as a whole.
+type Settings struct {
+	// The first key signs access tokens, all keys are accepted when verifying them
+	AccessTokenKeys    []jwk.Key
+	CORSAllowedOrigins []string
+	RateLimits         RateLimits
+}
+
+type LiveSettings struct {
+	p atomic.Pointer[Settings]
+}
+
+func NewLiveSettings(st Settings) *LiveSettings {
+	ls := &LiveSettings{}
+	ls.Store(st)
+	return ls
+}
+
+func (ls *LiveSettings) Load() *Settings {
+	return ls.p.Load()
+}
+
+func (ls *LiveSettings) Store(st Settings) {
+	ls.p.Store(&st)
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// newOpaqueToken returns a random token to hand out and its hash to store,
+// tokens have 256 bits of entropy so a fast hash is enough.
+func newOpaqueToken() (string, []byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, fmt.Errorf("error generating token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashOpaqueToken(token), nil
+}
+
+func hashOpaqueToken(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return h[:]
+}
@@ -3,20 +3,24 @@ package server
 import (
 	"encoding/json"
 	"errors"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/context"
 	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/validation"
 	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/mongo"
-	"golang.org/x/crypto/bcrypt"
 	"log"
 	"net/http"
 )
 
 func (s Server) createUserHandler() http.HandlerFunc {
 	type request struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-		Role     string `json:"role"`
-		Info     string `json:"info"`
+		Username string           `json:"username"`
+		Password string           `json:"password"`
+		Role     string           `json:"role"`
+		Info     string           `json:"info"`
+		Profile  database.Profile `json:"profile"`
+		// MustChangePassword makes the user change the password on the first login
+		MustChangePassword bool `json:"mustChangePassword"`
 	}
 	type response struct {
 		Success bool `json:"success"`
@@ -29,33 +33,48 @@ func (s Server) createUserHandler() http.HandlerFunc {
 			return
 		}
 
-		if req.Username == "" {
-			http.Error(w, "username must not be empty", http.StatusBadRequest)
+		if err := validation.NewUser(req.Username, req.Password, req.Role); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if req.Password == "" {
-			http.Error(w, "password must not be empty", http.StatusBadRequest)
+		username, err := s.UsernamePolicy.Normalize(req.Username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Username = username
+		req.Profile = validation.NormalizeProfile(req.Profile)
+		if err := validation.Profile(req.Profile, s.ProfileAttributesSchema); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if req.Role != "user" && req.Role != "admin" {
-			http.Error(w, "role should be user or admin", http.StatusBadRequest)
+		if !s.checkPassword(w, r, req.Password, req.Username) {
 			return
 		}
 
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		hashedPassword, err := s.hashPassword(r.Context(), req.Password)
 		if err != nil {
-			log.Printf("createUserHandler: Error generating bcrypt from password, err: %v", err)
+			if s.hashingUnavailable(w, err) {
+				return
+			}
+			log.Printf("createUserHandler: Error hashing password, err: %v", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
 		_, err = s.UserDB.InsertUser(r.Context(), database.User{
-			Username: req.Username,
-			Password: hashedPassword,
-			Role:     req.Role,
-			Info:     req.Info,
+			Username:           req.Username,
+			Password:           hashedPassword,
+			Role:               req.Role,
+			Info:               req.Info,
+			Profile:            req.Profile,
+			MustChangePassword: req.MustChangePassword,
 		})
 		if err != nil {
+			if errors.Is(err, database.ErrConfusableUsername) {
+				http.Error(w, database.ErrConfusableUsername.Error(), http.StatusUnprocessableEntity)
+				return
+			}
 			if mongo.IsDuplicateKeyError(err) {
 				log.Printf("createUserHandler: Error duplicate key when inserting User, err: %v", err)
 				http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
@@ -70,6 +89,20 @@ func (s Server) createUserHandler() http.HandlerFunc {
 	}
 }
 
+// withoutContactDetails returns u with only the parts of its profile which any user may see,
+// the others are returned by getUserProfileHandler to admins and the user itself.
+func withoutContactDetails(u database.User) database.User {
+	u.Profile = database.Profile{DisplayName: u.Profile.DisplayName, AvatarURL: u.Profile.AvatarURL}
+	return u
+}
+
+// canSeeProfile reports whether the calling user may see the whole profile of the User with id.
+func canSeeProfile(r *http.Request, id string) bool {
+	uc, err := context.GetUserContext(r.Context())
+	return err == nil && (uc.Role == validation.RoleAdmin || uc.UserID == id)
+}
+
+// getAllUserHandler lists every User without contact details, see withoutContactDetails.
 func (s Server) getAllUserHandler() http.HandlerFunc {
 	type response []database.User
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -79,11 +112,15 @@ func (s Server) getAllUserHandler() http.HandlerFunc {
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
+		for i := range us {
+			us[i] = withoutContactDetails(us[i])
+		}
 
 		s.writeJsonResponse(w, response(us), http.StatusOK)
 	}
 }
 
+// getUserHandler gets a User, with contact details only for admins and the user itself.
 func (s Server) getUserHandler() http.HandlerFunc {
 	type response database.User
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -103,6 +140,9 @@ func (s Server) getUserHandler() http.HandlerFunc {
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
+		if !canSeeProfile(r, u.ID.Hex()) {
+			u = withoutContactDetails(u)
+		}
 
 		s.writeJsonResponse(w, response(u), http.StatusOK)
 	}
@@ -112,6 +152,8 @@ func (s Server) updateUserPasswordHandler() http.HandlerFunc {
 	type request struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		// MustChangePassword makes the user change the password on the next login
+		MustChangePassword bool `json:"mustChangePassword"`
 	}
 	type response struct {
 		Success bool `json:"success"`
@@ -128,15 +170,25 @@ func (s Server) updateUserPasswordHandler() http.HandlerFunc {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
+		if req.Password == "" {
+			http.Error(w, validation.ErrEmptyPassword.Error(), http.StatusBadRequest)
+			return
+		}
+		if !s.checkPassword(w, r, req.Password, req.Username) {
+			return
+		}
 
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		hashedPassword, err := s.hashPassword(r.Context(), req.Password)
 		if err != nil {
-			log.Printf("updateUserPasswordHandler: Error generating bcrypt from password, err: %v", err)
+			if s.hashingUnavailable(w, err) {
+				return
+			}
+			log.Printf("updateUserPasswordHandler: Error hashing password, err: %v", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
-		if err := s.UserDB.UpdateUserPassword(r.Context(), req.Username, hashedPassword); err != nil {
+		if err := s.UserDB.UpdateUserPassword(r.Context(), req.Username, hashedPassword, req.MustChangePassword); err != nil {
 			if errors.Is(err, database.ErrNoDocumentsModified) {
 				s.writeJsonResponse(w, response{Success: false}, http.StatusOK)
 				return
@@ -183,6 +235,53 @@ func (s Server) updateUserInfoHandler() http.HandlerFunc {
 	}
 }
 
+var (
+	errSelfDeletion = errors.New("admins can't delete themselves")
+	errSelfDemotion = errors.New("admins can't change their own role")
+)
+
+// checkSelfRemoval fails with errSelfDeletion or errSelfDemotion when the caller would delete
+// or demote itself as username and that isn't allowed by AuthOptions.
+func (s Server) checkSelfRemoval(r *http.Request, username string, deleting bool) error {
+	if deleting && s.Auth.AllowSelfDeletion || !deleting && s.Auth.AllowSelfDemotion {
+		return nil
+	}
+	uc, err := context.GetUserContext(r.Context())
+	if err != nil {
+		return err
+	}
+	u, err := s.UserDB.FindUserByUsername(r.Context(), username)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		return err
+	}
+	if u.ID.Hex() != uc.UserID {
+		return nil
+	}
+	if deleting {
+		return errSelfDeletion
+	}
+	return errSelfDemotion
+}
+
+// writeRemovalConflict writes the 409 of a self-removal, of removing the last admin or of a held lock and returns true,
+// or returns false for other errors.
+func writeRemovalConflict(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, errSelfDeletion), errors.Is(err, errSelfDemotion):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, database.ErrLastAdmin):
+		http.Error(w, database.ErrLastAdmin.Error(), http.StatusConflict)
+	case errors.Is(err, database.ErrLocked):
+		http.Error(w, database.ErrLocked.Error(), http.StatusConflict)
+	default:
+		return false
+	}
+	return true
+}
+
 func (s Server) updateUserRoleHandler() http.HandlerFunc {
 	type request struct {
 		Username string `json:"username"`
@@ -203,16 +302,30 @@ func (s Server) updateUserRoleHandler() http.HandlerFunc {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
-		if req.Role != "user" && req.Role != "admin" {
-			http.Error(w, "role should be user or admin", http.StatusBadRequest)
+		if err := validation.Role(req.Role); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if req.Role != validation.RoleAdmin {
+			if err := s.checkSelfRemoval(r, req.Username, false); err != nil {
+				if writeRemovalConflict(w, err) {
+					return
+				}
+				log.Printf("updateUserRoleHandler: Error checking self-demotion, err: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
 
 		if err := s.UserDB.UpdateUserRole(r.Context(), req.Username, req.Role); err != nil {
 			if errors.Is(err, database.ErrNoDocumentsModified) {
 				s.writeJsonResponse(w, response{Success: false}, http.StatusOK)
 				return
 			}
+			if writeRemovalConflict(w, err) {
+				return
+			}
+			log.Printf("updateUserRoleHandler: Error updating role of username: %s, err: %v", req.Username, err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
@@ -236,12 +349,24 @@ func (s Server) deleteUserHandler() http.HandlerFunc {
 			return
 		}
 
+		if err := s.checkSelfRemoval(r, req.Username, true); err != nil {
+			if writeRemovalConflict(w, err) {
+				return
+			}
+			log.Printf("deleteUserHandler: Error checking self-deletion, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
 		err := s.UserDB.DeleteUserByUsername(r.Context(), req.Username)
 		if err != nil {
 			if errors.Is(err, database.ErrNoDocumentsModified) {
 				s.writeJsonResponse(w, response{Success: false}, http.StatusOK)
 				return
 			}
+			if writeRemovalConflict(w, err) {
+				return
+			}
 			log.Printf("deleteUserHandler: Error deleting user with username: %s, err: %v", req.Username, err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
@@ -250,3 +375,38 @@ func (s Server) deleteUserHandler() http.HandlerFunc {
 		s.writeJsonResponse(w, response{Success: true}, http.StatusOK)
 	}
 }
+
+func (s Server) updateUserMustChangePasswordHandler() http.HandlerFunc {
+	type request struct {
+		Username           string `json:"username"`
+		MustChangePassword bool   `json:"mustChangePassword"`
+	}
+	type response struct {
+		Success bool `json:"success"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("updateUserMustChangePasswordHandler: Error decoding JSON, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		if req.Username == "" {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		if err := s.UserDB.UpdateUserMustChangePassword(r.Context(), req.Username, req.MustChangePassword); err != nil {
+			if errors.Is(err, database.ErrNoDocumentsModified) {
+				s.writeJsonResponse(w, response{Success: false}, http.StatusOK)
+				return
+			}
+			log.Printf("updateUserMustChangePasswordHandler: Error updating User, err: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		s.writeJsonResponse(w, response{Success: true}, http.StatusOK)
+	}
+}
@@ -0,0 +1,51 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/filewatch"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %s, key: %s: %w", cr.certFile, cr.keyFile, err)
+	}
+	cr.cert.Store(&cert)
+	return nil
+}
+
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.cert.Load(), nil
+}
+
+// Watch reloads the certificate when the certificate or key file changes until ctx is done.
+// Cert and key are usually written one after the other, so changes are debounced before reloading.
+// A failed reload keeps serving the previous certificate.
+func (cr *CertReloader) Watch(ctx context.Context) error {
+	return filewatch.Watch(ctx, []string{cr.certFile, cr.keyFile}, 500*time.Millisecond, func() {
+		if err := cr.Reload(); err != nil {
+			log.Printf("CertReloader: Error reloading certificate, keeping previous one, err: %v", err)
+			return
+		}
+		log.Printf("CertReloader: Reloaded certificate: %s", cr.certFile)
+	})
+}
@@ -0,0 +1,124 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type Options struct {
+	CertFile     string
+	KeyFile      string
+	MinVersion   string
+	CipherSuites []string
+	ClientCAFile string
+	ClientAuth   string
+}
+
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// New creates a server tls.Config which serves the certificate held by the returned CertReloader.
+func New(o Options) (*tls.Config, *CertReloader, error) {
+	cr, err := NewCertReloader(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	minVersion, err := ParseVersion(o.MinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cipherSuites, err := ParseCipherSuites(o.CipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		GetCertificate: cr.GetCertificate,
+	}
+
+	switch o.ClientAuth {
+	case "", ClientAuthNone:
+		c.ClientAuth = tls.NoClientCert
+	case ClientAuthOptional:
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, nil, fmt.Errorf("invalid client auth: %s, should be %s, %s or %s",
+			o.ClientAuth, ClientAuthNone, ClientAuthOptional, ClientAuthRequire)
+	}
+
+	if c.ClientAuth != tls.NoClientCert {
+		if o.ClientCAFile == "" {
+			return nil, nil, errors.New("client CA file is required when client auth is enabled")
+		}
+		pem, err := os.ReadFile(o.ClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading client CA file: %s: %w", o.ClientCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in client CA file: %s", o.ClientCAFile)
+		}
+		c.ClientCAs = pool
+	}
+
+	return c, cr, nil
+}
+
+func ParseVersion(v string) (uint16, error) {
+	switch v {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("invalid TLS version: %s, should be 1.2 or 1.3", v)
+	}
+}
+
+// ParseCipherSuites maps cipher suite names to IDs, only suites in tls.CipherSuites are accepted
+// since the ones in tls.InsecureCipherSuites have known security issues.
+// Cipher suites are not configurable for TLS 1.3, an empty list keeps the Go defaults.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	secure := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		secure[cs.Name] = cs.ID
+	}
+	var ids []uint16
+	for _, n := range names {
+		id, ok := secure[strings.TrimSpace(n)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite: %s", n)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Identities returns the identities of a certificate, its URI and DNS SANs followed by its subject CN.
+func Identities(cert *x509.Certificate) []string {
+	var ids []string
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	ids = append(ids, cert.DNSNames...)
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return ids
+}
@@ -0,0 +1,87 @@
+// Package totp implements RFC 6238 time-based one-time passwords with HMAC-SHA1,
+// 6 digits and 30 second steps, the parameters every authenticator app supports.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Digits = 6
+	Period = 30 * time.Second
+	// Skew is how many steps before and after the current one are accepted, for clock drift
+	Skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random 160 bit secret in base32, as RFC 4226 recommends.
+func GenerateSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating TOTP secret: %w", err)
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// URI returns the otpauth URI of secret, usually shown as a QR code for authenticator apps.
+func URI(issuer string, account string, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(Digits))
+	q.Set("period", fmt.Sprint(int(Period.Seconds())))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// Counter returns the time step of t.
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+// Code returns the code of secret for the time step counter.
+func Code(secret string, counter int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, v%1000000), nil
+}
+
+// Validate checks code against the steps around t and returns the matching step,
+// callers should reject steps which are not after the last accepted one so codes can't be replayed.
+func Validate(secret string, code string, t time.Time) (counter int64, ok bool, err error) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != Digits {
+		return 0, false, nil
+	}
+	now := Counter(t)
+	for c := now - Skew; c <= now+Skew; c++ {
+		expected, err := Code(secret, c)
+		if err != nil {
+			return 0, false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return c, true, nil
+		}
+	}
+	return 0, false, nil
+}
@@ -0,0 +1,100 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret of the test vectors of RFC 6238 appendix B, "12345678901234567890" in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// rfcVectors are the SHA1 test vectors of RFC 6238 appendix B, truncated to 6 digits.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCode(t *testing.T) {
+	for _, v := range rfcVectors {
+		got, err := Code(rfcSecret, Counter(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code(%d) error: %v", v.unix, err)
+		}
+		if got != v.code {
+			t.Errorf("Code(%d) = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestCodeLowerCaseSecret(t *testing.T) {
+	got, err := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", Counter(time.Unix(59, 0)))
+	if err != nil || got != "287082" {
+		t.Errorf("Code() = %s, %v, want 287082", got, err)
+	}
+}
+
+func TestCodeInvalidSecret(t *testing.T) {
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("Code() error = nil, want an error")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	at := time.Unix(1111111111, 0)
+	now := Counter(at)
+	tests := []struct {
+		name    string
+		code    string
+		ok      bool
+		counter int64
+	}{
+		{name: "current step", code: "050471", ok: true, counter: now},
+		{name: "with spaces", code: "050 471", ok: true, counter: now},
+		{name: "previous step", code: mustCode(t, now-1), ok: true, counter: now - 1},
+		{name: "next step", code: mustCode(t, now+1), ok: true, counter: now + 1},
+		{name: "beyond skew", code: mustCode(t, now-2)},
+		{name: "wrong code", code: "000000"},
+		{name: "too short", code: "05047"},
+		{name: "eight digits", code: "14050471"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter, ok, err := Validate(rfcSecret, tt.code, at)
+			if err != nil {
+				t.Fatalf("Validate() error: %v", err)
+			}
+			if ok != tt.ok || ok && counter != tt.counter {
+				t.Errorf("Validate() = %d, %v, want %d, %v", counter, ok, tt.counter, tt.ok)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	s, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret() error: %v", err)
+	}
+	if len(s) != 32 {
+		t.Errorf("GenerateSecret() = %s, want 32 base32 characters", s)
+	}
+	if _, err := Code(s, 0); err != nil {
+		t.Errorf("Code() of generated secret error: %v", err)
+	}
+}
+
+func mustCode(t *testing.T, counter int64) string {
+	t.Helper()
+	c, err := Code(rfcSecret, counter)
+	if err != nil {
+		t.Fatalf("Code() error: %v", err)
+	}
+	return c
+}
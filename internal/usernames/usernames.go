@@ -0,0 +1,147 @@
+package usernames
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/text/secure/precis"
+	"golang.org/x/text/unicode/norm"
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalid      = errors.New("username has characters which are not allowed")
+	ErrMixedScripts = errors.New("username mixes characters of scripts which can be confused")
+)
+
+// profile is the PRECIS IdentifierClass profile of usernames, UsernameCaseMapped of RFC 8265
+// but with case folding and NFKC, so that compatibility characters such as ligatures and
+// superscripts are the same as the characters they stand for.
+var profile = precis.NewIdentifier(
+	precis.FoldWidth,
+	precis.FoldCase(),
+	precis.Norm(norm.NFKC),
+	precis.BidiRule,
+	precis.DisallowEmpty,
+)
+
+// Normalize returns the canonical form of s which usernames are stored and looked up by,
+// usernames which only differ in case, width or normalization have the same one.
+func Normalize(s string) (string, error) {
+	n, err := profile.String(s)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return n, nil
+}
+
+// Key is the canonical form of s to look it up by, s itself when it can't be normalized,
+// which can only be the username of a User stored before usernames were normalized.
+func Key(s string) string {
+	if n, err := Normalize(s); err == nil {
+		return n
+	}
+	return s
+}
+
+// Policy restricts the usernames of new users beyond the PRECIS profile.
+type Policy struct {
+	// MinLength and MaxLength are in characters of the canonical form, a zero MaxLength is no limit
+	MinLength int
+	MaxLength int
+	// Allowed matches the canonical forms which are allowed, nil allows any
+	Allowed *regexp.Regexp
+}
+
+// Normalize returns the canonical form of s if it is allowed by p.
+func (p Policy) Normalize(s string) (string, error) {
+	n, err := Normalize(s)
+	if err != nil {
+		return "", err
+	}
+	if l := utf8.RuneCountInString(n); l < p.MinLength || p.MaxLength > 0 && l > p.MaxLength {
+		if p.MaxLength > 0 {
+			return "", fmt.Errorf("username should have %d to %d characters", p.MinLength, p.MaxLength)
+		}
+		return "", fmt.Errorf("username should have at least %d characters", p.MinLength)
+	}
+	if p.Allowed != nil && !p.Allowed.MatchString(n) {
+		return "", ErrInvalid
+	}
+	if MixedScripts(n) {
+		return "", ErrMixedScripts
+	}
+	return n, nil
+}
+
+// scriptSets are the scripts which may be mixed in a username, as in the highly restrictive
+// level of Unicode TR39, Japanese, Chinese and Korean with Latin.
+var scriptSets = []map[string]bool{
+	{"Latin": true, "Han": true, "Hiragana": true, "Katakana": true},
+	{"Latin": true, "Han": true, "Bopomofo": true},
+	{"Latin": true, "Han": true, "Hangul": true},
+}
+
+// MixedScripts reports whether s mixes scripts other than those of scriptSets, such as Latin with
+// Cyrillic look-alikes. Characters common to scripts, such as digits and punctuation, are ignored.
+func MixedScripts(s string) bool {
+	scripts := make(map[string]bool)
+	for _, r := range s {
+		if sc := script(r); sc != "" && sc != "Common" && sc != "Inherited" {
+			scripts[sc] = true
+		}
+	}
+	if len(scripts) < 2 {
+		return false
+	}
+	for _, set := range scriptSets {
+		allowed := true
+		for sc := range scripts {
+			if !set[sc] {
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			return false
+		}
+	}
+	return true
+}
+
+func script(r rune) string {
+	for name, table := range unicode.Scripts {
+		if unicode.Is(table, r) {
+			return name
+		}
+	}
+	return ""
+}
+
+// confusables maps characters of canonical forms to the Latin letters they can be mistaken for,
+// a subset of the confusables of Unicode TR39 for the scripts which look most like Latin. Only
+// homoglyphs of other scripts are mapped, digits and Latin letters are not, so that usernames
+// such as user1 and userl or bob0 and bobo stay distinct.
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'с': 'c', 'ԁ': 'd', 'е': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j', 'ӏ': 'l', 'о': 'o',
+	'р': 'p', 'ԛ': 'q', 'ѕ': 's', 'ԝ': 'w', 'х': 'x', 'у': 'y', 'ү': 'y',
+	// Greek
+	'α': 'a', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'ϲ': 'c', 'υ': 'u', 'χ': 'x', 'ϳ': 'j',
+	// Armenian
+	'հ': 'h', 'ո': 'n', 'ս': 'u', 'օ': 'o', 'ց': 'g',
+}
+
+// Skeleton returns the form of the canonical form n with its confusable characters replaced,
+// usernames with the same skeleton look alike, such as paypal and Cyrillic раураl.
+func Skeleton(n string) string {
+	b := make([]rune, 0, len(n))
+	for _, r := range n {
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		b = append(b, r)
+	}
+	return string(b)
+}
@@ -0,0 +1,75 @@
+package usernames
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSkeleton(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"paypal", "paypal"},
+		// Cyrillic р, а and у
+		{"раураl", "paypal"},
+		// Greek ο
+		{"gοοgle", "google"},
+		// Armenian օ
+		{"bօb", "bob"},
+		// Digits and Latin letters are not confusables
+		{"user1", "user1"},
+		{"bob0", "bob0"},
+		{"ılıa", "ılıa"},
+	}
+	for _, tt := range tests {
+		if got := Skeleton(tt.name); got != tt.want {
+			t.Errorf("Skeleton(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if Skeleton("user1") == Skeleton("userl") {
+		t.Error("user1 and userl have the same skeleton")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{name: "Alice", want: "alice"},
+		// Fullwidth and the ﬁ ligature are folded by NFKC
+		{name: "ＡＬＩＣＥ", want: "alice"},
+		{name: "ﬁona", want: "fiona"},
+		{name: "straße", want: "strasse"},
+		{name: "", err: ErrInvalid},
+		{name: "al ice", err: ErrInvalid},
+	}
+	for _, tt := range tests {
+		got, err := Normalize(tt.name)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("Normalize(%q) = %q, %v, want %q, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestMixedScripts(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"paypal", false},
+		{"раураl", true},
+		{"иван", false},
+		{"user_1", false},
+		{"tanaka田中", false},
+		{"kimハングル", false},
+		{"alphaβ", true},
+	}
+	for _, tt := range tests {
+		if got := MixedScripts(tt.name); got != tt.want {
+			t.Errorf("MixedScripts(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
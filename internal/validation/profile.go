@@ -0,0 +1,92 @@
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/database"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/jsonschema"
+	"golang.org/x/text/language"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxDisplayNameLength = 100
+	maxAttributesBytes   = 16 << 10
+)
+
+var e164 = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+
+type ProfileError struct {
+	Violations []string
+}
+
+func (e *ProfileError) Error() string {
+	return "invalid profile: " + strings.Join(e.Violations, "; ")
+}
+
+// Profile validates every profile field, attributes are validated against attributesSchema when it is not nil.
+func Profile(p database.Profile, attributesSchema *jsonschema.Schema) error {
+	var violations []string
+	check := func(ok bool, format string, a ...any) {
+		if !ok {
+			violations = append(violations, fmt.Sprintf(format, a...))
+		}
+	}
+
+	check(utf8.RuneCountInString(p.DisplayName) <= maxDisplayNameLength,
+		"displayName should be at most %d characters", maxDisplayNameLength)
+	if p.Email != "" {
+		a, err := mail.ParseAddress(p.Email)
+		check(err == nil && a.Address == p.Email, "email should be an email address, e.g. user@example.com")
+	}
+	if p.Phone != "" {
+		check(e164.MatchString(p.Phone), "phone should be in E.164 format, e.g. +14155550123")
+	}
+	if p.Locale != "" {
+		_, err := language.Parse(p.Locale)
+		check(err == nil, "locale should be a BCP 47 language tag, e.g. en-US")
+	}
+	if p.Timezone != "" {
+		_, err := time.LoadLocation(p.Timezone)
+		check(err == nil && p.Timezone != "Local", "timezone should be an IANA time zone, e.g. Asia/Jakarta")
+	}
+	if p.AvatarURL != "" {
+		u, err := url.Parse(p.AvatarURL)
+		check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "avatarUrl should be an http or https URL")
+	}
+
+	if p.Attributes != nil {
+		b, err := json.Marshal(p.Attributes)
+		check(err == nil && len(b) <= maxAttributesBytes, "attributes should be at most %d bytes of JSON", maxAttributesBytes)
+		if err == nil && attributesSchema != nil {
+			// Validated in the form decoded by encoding/json, as the schema validator expects
+			var attributes any
+			_ = json.Unmarshal(b, &attributes)
+			if err := attributesSchema.Validate(attributes); err != nil {
+				var ve *jsonschema.ValidationError
+				if errors.As(err, &ve) {
+					for _, v := range ve.Violations {
+						violations = append(violations, "attributes"+v)
+					}
+				}
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		return &ProfileError{Violations: violations}
+	}
+	return nil
+}
+
+// NormalizeProfile normalizes values which are compared, emails are matched case-insensitively.
+func NormalizeProfile(p database.Profile) database.Profile {
+	p.Email = database.NormalizeEmail(p.Email)
+	return p
+}
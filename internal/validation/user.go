@@ -0,0 +1,45 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dnflash/demo-p1-go-user-management-service/internal/passwordhash"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+var (
+	ErrEmptyUsername = errors.New("username must not be empty")
+	ErrEmptyPassword = errors.New("password must not be empty")
+	ErrInvalidRole   = errors.New("role should be user or admin")
+)
+
+// NewUser validates the fields of a User before it is created.
+func NewUser(username string, password string, role string) error {
+	if username == "" {
+		return ErrEmptyUsername
+	}
+	if password == "" {
+		return ErrEmptyPassword
+	}
+	return Role(role)
+}
+
+// PasswordHash checks a pre-hashed password, which is either created by this service or
+// imported in one of the tagged legacy formats, see passwordhash.
+func PasswordHash(hash string) error {
+	if err := passwordhash.Valid([]byte(hash)); err != nil {
+		return fmt.Errorf("passwordHash should be an argon2id, bcrypt, $pbkdf2-sha256$, $6$ (SHA-512-crypt) or {SSHA} hash: %w", err)
+	}
+	return nil
+}
+
+func Role(role string) error {
+	if role != RoleUser && role != RoleAdmin {
+		return ErrInvalidRole
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"testing"
+)
+
+// softAuthenticator is a software authenticator with an ECDSA P-256 credential, it builds
+// the responses of the ceremonies the way a platform authenticator does.
+type softAuthenticator struct {
+	t            *testing.T
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+	flags        byte
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatalf("error generating credential ID: %v", err)
+	}
+	return &softAuthenticator{t: t, key: key, credentialID: id, flags: flagUserPresent | flagUserVerified}
+}
+
+// coseKey is the COSE_Key of the credential public key.
+func (a *softAuthenticator) coseKey() []byte {
+	x, y := make([]byte, 32), make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	return encodeCBOR(map[int64]any{
+		coseKeyType: int64(coseKeyEC2),
+		coseKeyAlg:  int64(AlgES256),
+		coseCurve:   int64(coseP256),
+		coseX:       x,
+		coseY:       y,
+	})
+}
+
+// authenticatorData builds the authenticator data for rpID, with the attested credential data when attested.
+func (a *softAuthenticator) authenticatorData(rpID string, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags := a.flags
+	if attested {
+		flags |= flagAttested
+	}
+	b := append([]byte(nil), rpIDHash[:]...)
+	b = append(b, flags)
+	b = binary.BigEndian.AppendUint32(b, a.signCount)
+	if attested {
+		b = append(b, make([]byte, 16)...) // AAGUID
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.credentialID)))
+		b = append(b, a.credentialID...)
+		b = append(b, a.coseKey()...)
+	}
+	return b
+}
+
+func clientDataJSON(t *testing.T, ceremony string, challenge []byte, origin string) []byte {
+	t.Helper()
+	b, err := json.Marshal(map[string]any{"type": ceremony, "challenge": URLEncoded(challenge), "origin": origin})
+	if err != nil {
+		t.Fatalf("error encoding client data: %v", err)
+	}
+	return b
+}
+
+// create answers navigator.credentials.create for rpID on origin.
+func (a *softAuthenticator) create(rpID string, origin string, challenge []byte) RegistrationResponse {
+	var r RegistrationResponse
+	r.ID = string(URLEncoded(a.credentialID))
+	r.RawID = a.credentialID
+	r.Type = "public-key"
+	r.Response.ClientDataJSON = clientDataJSON(a.t, "webauthn.create", challenge, origin)
+	r.Response.AttestationObject = encodeCBOR(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authenticatorData(rpID, true),
+	})
+	r.Response.Transports = []string{"internal"}
+	return r
+}
+
+// get answers navigator.credentials.get for rpID on origin, counting the signature.
+func (a *softAuthenticator) get(rpID string, origin string, challenge []byte) AssertionResponse {
+	a.signCount++
+	var r AssertionResponse
+	r.ID = string(URLEncoded(a.credentialID))
+	r.RawID = a.credentialID
+	r.Type = "public-key"
+	r.Response.ClientDataJSON = clientDataJSON(a.t, "webauthn.get", challenge, origin)
+	r.Response.AuthenticatorData = a.authenticatorData(rpID, false)
+	clientDataHash := sha256.Sum256(r.Response.ClientDataJSON)
+	signed := append(append([]byte(nil), r.Response.AuthenticatorData...), clientDataHash[:]...)
+	h := sha256.Sum256(signed)
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, h[:])
+	if err != nil {
+		a.t.Fatalf("error signing assertion: %v", err)
+	}
+	r.Response.Signature = sig
+	r.Response.UserHandle = []byte("user-handle")
+	return r
+}
+
+// encodeCBOR encodes the subset of CBOR decodeCBOR supports, maps in the canonical key order.
+func encodeCBOR(v any) []byte {
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case map[int64]any:
+		keys := make([]int64, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return string(encodeCBOR(keys[i])) < string(encodeCBOR(keys[j])) })
+		b := cborHead(5, uint64(len(v)))
+		for _, k := range keys {
+			b = append(append(b, encodeCBOR(k)...), encodeCBOR(v[k])...)
+		}
+		return b
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b := cborHead(5, uint64(len(v)))
+		for _, k := range keys {
+			b = append(append(b, encodeCBOR(k)...), encodeCBOR(v[k])...)
+		}
+		return b
+	default:
+		panic("encodeCBOR: unsupported type")
+	}
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+	}
+}
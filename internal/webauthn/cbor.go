@@ -0,0 +1,134 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// The CBOR decoding is limited to what authenticators send: integers, byte and text strings,
+// arrays, maps and simple values, all of definite length. Floats and tags are rejected.
+
+const maxCBORDepth = 16
+
+var errCBORTruncated = errors.New("cbor: truncated data")
+
+// decodeCBOR decodes the first item of b and returns it with the bytes after it.
+// Integers decode to int64, maps to map[any]any with int64 or string keys.
+func decodeCBOR(b []byte) (any, []byte, error) {
+	return decodeCBORItem(b, 0)
+}
+
+func decodeCBORItem(b []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, errors.New("cbor: nesting too deep")
+	}
+	if len(b) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	n, rest, err := decodeCBORArgument(info, b[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflows int64")
+		}
+		return int64(n), rest, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflows int64")
+		}
+		return -1 - int64(n), rest, nil
+	case 2, 3:
+		if n > uint64(len(rest)) {
+			return nil, nil, errCBORTruncated
+		}
+		if major == 2 {
+			return append([]byte(nil), rest[:n]...), rest[n:], nil
+		}
+		return string(rest[:n]), rest[n:], nil
+	case 4:
+		// Every item takes at least a byte, which bounds the allocation
+		if n > uint64(len(rest)) {
+			return nil, nil, errCBORTruncated
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return items, rest, nil
+	case 5:
+		if n > uint64(len(rest))/2 {
+			return nil, nil, errCBORTruncated
+		}
+		m := make(map[any]any, n)
+		for i := uint64(0); i < n; i++ {
+			var k, v any
+			if k, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key type %T", k)
+			}
+			if _, ok := m[k]; ok {
+				return nil, nil, fmt.Errorf("cbor: duplicate map key %v", k)
+			}
+			if v, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, rest, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22, 23:
+			return nil, rest, nil
+		}
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value or float %d", info)
+	default:
+		return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+	}
+}
+
+// decodeCBORArgument decodes the argument following an initial byte with additional info.
+func decodeCBORArgument(info byte, b []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), b, nil
+	case info == 24:
+		if len(b) < 1 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(b[0]), b[1:], nil
+	case info == 25:
+		if len(b) < 2 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint16(b)), b[2:], nil
+	case info == 26:
+		if len(b) < 4 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint32(b)), b[4:], nil
+	case info == 27:
+		if len(b) < 8 {
+			return 0, nil, errCBORTruncated
+		}
+		return binary.BigEndian.Uint64(b), b[8:], nil
+	default:
+		return 0, nil, errors.New("cbor: indefinite lengths are not supported")
+	}
+}
@@ -0,0 +1,127 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithms, RFC 9053, offered in this order when registering.
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// COSE key parameters, RFC 9052, the negative ones depend on the key type.
+const (
+	coseKeyType = 1
+	coseKeyAlg  = 3
+	coseCurve   = -1
+	coseX       = -2
+	coseY       = -3
+	coseRSAN    = -1
+	coseRSAE    = -2
+)
+
+// COSE key types and curves.
+const (
+	coseKeyOKP  = 1
+	coseKeyEC2  = 2
+	coseKeyRSA  = 3
+	coseP256    = 1
+	coseEd25519 = 6
+)
+
+const (
+	minRSABits   = 2048
+	maxRSAPubExp = 1<<31 - 1
+)
+
+var errUnsupportedKey = errors.New("unsupported COSE key")
+
+// PublicKey is a credential public key decoded from its COSE form.
+type PublicKey struct {
+	Alg int64
+	key crypto.PublicKey
+}
+
+// ParsePublicKey decodes a COSE_Key with one of the supported algorithms.
+func ParsePublicKey(coseKey []byte) (PublicKey, error) {
+	v, rest, err := decodeCBOR(coseKey)
+	if err != nil {
+		return PublicKey{}, err
+	}
+	if len(rest) > 0 {
+		return PublicKey{}, errors.New("trailing data after COSE key")
+	}
+	m, ok := v.(map[any]any)
+	if !ok {
+		return PublicKey{}, errors.New("COSE key is not a map")
+	}
+	kty, _ := m[int64(coseKeyType)].(int64)
+	alg, _ := m[int64(coseKeyAlg)].(int64)
+
+	switch {
+	case kty == coseKeyEC2 && alg == AlgES256:
+		if crv, _ := m[int64(coseCurve)].(int64); crv != coseP256 {
+			return PublicKey{}, fmt.Errorf("%w: ES256 with curve %d", errUnsupportedKey, crv)
+		}
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return PublicKey{}, errors.New("invalid P-256 coordinates")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return PublicKey{}, errors.New("P-256 point is not on the curve")
+		}
+		return PublicKey{Alg: alg, key: pub}, nil
+	case kty == coseKeyOKP && alg == AlgEdDSA:
+		if crv, _ := m[int64(coseCurve)].(int64); crv != coseEd25519 {
+			return PublicKey{}, fmt.Errorf("%w: EdDSA with curve %d", errUnsupportedKey, crv)
+		}
+		x, _ := m[int64(coseX)].([]byte)
+		if len(x) != ed25519.PublicKeySize {
+			return PublicKey{}, errors.New("invalid Ed25519 public key")
+		}
+		return PublicKey{Alg: alg, key: ed25519.PublicKey(x)}, nil
+	case kty == coseKeyRSA && alg == AlgRS256:
+		n, _ := m[int64(coseRSAN)].([]byte)
+		e, _ := m[int64(coseRSAE)].([]byte)
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n)}
+		if pub.N.BitLen() < minRSABits {
+			return PublicKey{}, fmt.Errorf("RSA key shorter than %d bits", minRSABits)
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > maxRSAPubExp {
+			return PublicKey{}, errors.New("invalid RSA public exponent")
+		}
+		pub.E = int(exp.Int64())
+		return PublicKey{Alg: alg, key: pub}, nil
+	default:
+		return PublicKey{}, fmt.Errorf("%w: key type %d with algorithm %d", errUnsupportedKey, kty, alg)
+	}
+}
+
+// Verify checks sig over data.
+func (k PublicKey) Verify(data []byte, sig []byte) bool {
+	switch pub := k.key.(type) {
+	case *ecdsa.PublicKey:
+		h := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(pub, h[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, data, sig)
+	case *rsa.PublicKey:
+		h := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig) == nil
+	default:
+		return false
+	}
+}
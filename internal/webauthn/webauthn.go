@@ -0,0 +1,379 @@
+// Package webauthn implements the relying party side of the WebAuthn registration and
+// authentication ceremonies for passkeys. Attestation is not requested, so authenticators
+// are not verified to be of any particular make, only their keys are used.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	UserVerificationRequired  = "required"
+	UserVerificationPreferred = "preferred"
+)
+
+// Authenticator data flags.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+	flagExtensions   = 0x80
+)
+
+// ErrVerification is wrapped by the errors of responses which fail a check of the ceremony.
+var ErrVerification = errors.New("webauthn verification failed")
+
+type RelyingParty struct {
+	// ID is the domain the credentials are scoped to, such as example.com
+	ID   string
+	Name string
+	// Origins the ceremonies may run on, such as https://login.example.com
+	Origins []string
+	// UserVerification is UserVerificationRequired or UserVerificationPreferred
+	UserVerification string
+	// Timeout is given to the client and is how long challenges are valid
+	Timeout time.Duration
+}
+
+// URLEncoded is binary data encoded as unpadded base64url in JSON, padding is accepted when decoding.
+type URLEncoded []byte
+
+func (u URLEncoded) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(u))
+}
+
+func (u *URLEncoded) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*u = decoded
+	return nil
+}
+
+// NewChallenge returns a random challenge for a ceremony.
+func NewChallenge() ([]byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("error generating challenge: %w", err)
+	}
+	return b, nil
+}
+
+type User struct {
+	// ID is the user handle, it must not contain personal information
+	ID          URLEncoded `json:"id"`
+	Name        string     `json:"name"`
+	DisplayName string     `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type       string     `json:"type"`
+	ID         URLEncoded `json:"id"`
+	Transports []string   `json:"transports,omitempty"`
+}
+
+// CreationOptions are the publicKey options for navigator.credentials.create.
+type CreationOptions struct {
+	Challenge URLEncoded `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User                   User                   `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		RequireResident  bool   `json:"requireResidentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// RequestOptions are the publicKey options for navigator.credentials.get, without
+// allowCredentials so that the authenticator offers its discoverable credentials.
+type RequestOptions struct {
+	Challenge        URLEncoded `json:"challenge"`
+	RPID             string     `json:"rpId"`
+	Timeout          int64      `json:"timeout"`
+	UserVerification string     `json:"userVerification"`
+}
+
+func (rp RelyingParty) CreationOptions(challenge []byte, user User, exclude []CredentialDescriptor) CreationOptions {
+	o := CreationOptions{Challenge: challenge, User: user, Timeout: rp.Timeout.Milliseconds(), Attestation: "none"}
+	o.RP.ID, o.RP.Name = rp.ID, rp.Name
+	for _, alg := range []int{AlgES256, AlgEdDSA, AlgRS256} {
+		o.PubKeyCredParams = append(o.PubKeyCredParams, CredentialParameter{Type: "public-key", Alg: alg})
+	}
+	o.ExcludeCredentials = exclude
+	if o.ExcludeCredentials == nil {
+		o.ExcludeCredentials = []CredentialDescriptor{}
+	}
+	o.AuthenticatorSelection.ResidentKey = "required"
+	o.AuthenticatorSelection.RequireResident = true
+	o.AuthenticatorSelection.UserVerification = rp.UserVerification
+	return o
+}
+
+func (rp RelyingParty) RequestOptions(challenge []byte) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          rp.Timeout.Milliseconds(),
+		UserVerification: rp.UserVerification,
+	}
+}
+
+// RegistrationResponse is the JSON of the PublicKeyCredential from navigator.credentials.create.
+type RegistrationResponse struct {
+	ID       string     `json:"id"`
+	RawID    URLEncoded `json:"rawId"`
+	Type     string     `json:"type"`
+	Response struct {
+		ClientDataJSON    URLEncoded `json:"clientDataJSON"`
+		AttestationObject URLEncoded `json:"attestationObject"`
+		Transports        []string   `json:"transports"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the JSON of the PublicKeyCredential from navigator.credentials.get.
+type AssertionResponse struct {
+	ID       string     `json:"id"`
+	RawID    URLEncoded `json:"rawId"`
+	Type     string     `json:"type"`
+	Response struct {
+		ClientDataJSON    URLEncoded `json:"clientDataJSON"`
+		AuthenticatorData URLEncoded `json:"authenticatorData"`
+		Signature         URLEncoded `json:"signature"`
+		UserHandle        URLEncoded `json:"userHandle"`
+	} `json:"response"`
+}
+
+// Credential is a verified new credential, PublicKey is in its COSE form.
+type Credential struct {
+	ID         []byte
+	PublicKey  []byte
+	SignCount  uint32
+	AAGUID     []byte
+	Transports []string
+}
+
+// Assertion is a verified authentication with a credential.
+type Assertion struct {
+	SignCount    uint32
+	UserVerified bool
+}
+
+type clientData struct {
+	Type      string     `json:"type"`
+	Challenge URLEncoded `json:"challenge"`
+	Origin    string     `json:"origin"`
+}
+
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	// Set with flagAttested
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+// Challenge returns the challenge the response was created for, so that the pending challenge
+// can be looked up, the response is verified against it by VerifyRegistration.
+func (r RegistrationResponse) Challenge() ([]byte, error) {
+	cd, err := parseClientData(r.Response.ClientDataJSON)
+	return cd.Challenge, err
+}
+
+// Challenge is like RegistrationResponse.Challenge.
+func (r AssertionResponse) Challenge() ([]byte, error) {
+	cd, err := parseClientData(r.Response.ClientDataJSON)
+	return cd.Challenge, err
+}
+
+// VerifyRegistration verifies a response to CreationOptions with challenge, as in
+// section 7.1 of WebAuthn Level 2, and returns the new credential.
+func (rp RelyingParty) VerifyRegistration(r RegistrationResponse, challenge []byte) (Credential, error) {
+	if r.Type != "public-key" {
+		return Credential{}, fmt.Errorf("%w: credential type %q", ErrVerification, r.Type)
+	}
+	if err := rp.verifyClientData(r.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return Credential{}, err
+	}
+
+	v, rest, err := decodeCBOR(r.Response.AttestationObject)
+	if err != nil || len(rest) > 0 {
+		return Credential{}, fmt.Errorf("%w: invalid attestation object: %v", ErrVerification, err)
+	}
+	attestation, ok := v.(map[any]any)
+	if !ok {
+		return Credential{}, fmt.Errorf("%w: attestation object is not a map", ErrVerification)
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return Credential{}, fmt.Errorf("%w: attestation object has no authData", ErrVerification)
+	}
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return Credential{}, err
+	}
+	if err := rp.verifyAuthenticatorData(ad); err != nil {
+		return Credential{}, err
+	}
+	if ad.flags&flagAttested == 0 {
+		return Credential{}, fmt.Errorf("%w: no attested credential data", ErrVerification)
+	}
+	if len(r.RawID) > 0 && !bytes.Equal(r.RawID, ad.credentialID) {
+		return Credential{}, fmt.Errorf("%w: rawId does not match the attested credential", ErrVerification)
+	}
+	if _, err := ParsePublicKey(ad.publicKey); err != nil {
+		return Credential{}, fmt.Errorf("%w: %v", ErrVerification, err)
+	}
+
+	return Credential{
+		ID:         ad.credentialID,
+		PublicKey:  ad.publicKey,
+		SignCount:  ad.signCount,
+		AAGUID:     ad.aaguid,
+		Transports: r.Response.Transports,
+	}, nil
+}
+
+// VerifyAssertion verifies a response to RequestOptions with challenge, as in section 7.2
+// of WebAuthn Level 2, by the credential with publicKey and the last known signCount.
+func (rp RelyingParty) VerifyAssertion(r AssertionResponse, challenge []byte, publicKey []byte, signCount uint32) (Assertion, error) {
+	if r.Type != "public-key" {
+		return Assertion{}, fmt.Errorf("%w: credential type %q", ErrVerification, r.Type)
+	}
+	if err := rp.verifyClientData(r.Response.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return Assertion{}, err
+	}
+	ad, err := parseAuthenticatorData(r.Response.AuthenticatorData)
+	if err != nil {
+		return Assertion{}, err
+	}
+	if err := rp.verifyAuthenticatorData(ad); err != nil {
+		return Assertion{}, err
+	}
+
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return Assertion{}, err
+	}
+	clientDataHash := sha256.Sum256(r.Response.ClientDataJSON)
+	signed := append(append([]byte(nil), r.Response.AuthenticatorData...), clientDataHash[:]...)
+	if !key.Verify(signed, r.Response.Signature) {
+		return Assertion{}, fmt.Errorf("%w: invalid signature", ErrVerification)
+	}
+
+	// Authenticators which count report a higher count every time, a lower one means a cloned authenticator
+	if (ad.signCount != 0 || signCount != 0) && ad.signCount <= signCount {
+		return Assertion{}, fmt.Errorf("%w: signature counter %d is not above %d, the authenticator may be cloned",
+			ErrVerification, ad.signCount, signCount)
+	}
+	return Assertion{SignCount: ad.signCount, UserVerified: ad.flags&flagUserVerified != 0}, nil
+}
+
+func parseClientData(b []byte) (clientData, error) {
+	var cd clientData
+	if err := json.Unmarshal(b, &cd); err != nil {
+		return cd, fmt.Errorf("%w: invalid clientDataJSON: %v", ErrVerification, err)
+	}
+	return cd, nil
+}
+
+func (rp RelyingParty) verifyClientData(b []byte, ceremony string, challenge []byte) error {
+	cd, err := parseClientData(b)
+	if err != nil {
+		return err
+	}
+	if cd.Type != ceremony {
+		return fmt.Errorf("%w: client data type %q, expected %q", ErrVerification, cd.Type, ceremony)
+	}
+	if subtle.ConstantTimeCompare(cd.Challenge, challenge) != 1 {
+		return fmt.Errorf("%w: challenge does not match", ErrVerification)
+	}
+	for _, o := range rp.Origins {
+		if cd.Origin == o {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: origin %q is not allowed", ErrVerification, cd.Origin)
+}
+
+func (rp RelyingParty) verifyAuthenticatorData(ad authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return fmt.Errorf("%w: credential is for another relying party", ErrVerification)
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return fmt.Errorf("%w: user was not present", ErrVerification)
+	}
+	if rp.UserVerification == UserVerificationRequired && ad.flags&flagUserVerified == 0 {
+		return fmt.Errorf("%w: user was not verified", ErrVerification)
+	}
+	return nil
+}
+
+// parseAuthenticatorData parses the layout of section 6.1 of WebAuthn Level 2.
+func parseAuthenticatorData(b []byte) (authenticatorData, error) {
+	var ad authenticatorData
+	if len(b) < 37 {
+		return ad, fmt.Errorf("%w: authenticator data too short", ErrVerification)
+	}
+	ad.rpIDHash, ad.flags, ad.signCount = b[:32], b[32], binary.BigEndian.Uint32(b[33:37])
+	rest := b[37:]
+
+	if ad.flags&flagAttested != 0 {
+		if len(rest) < 18 {
+			return ad, fmt.Errorf("%w: attested credential data too short", ErrVerification)
+		}
+		ad.aaguid = rest[:16]
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if n == 0 || n > 1023 || len(rest) < n {
+			return ad, fmt.Errorf("%w: invalid credential ID length", ErrVerification)
+		}
+		ad.credentialID, rest = rest[:n], rest[n:]
+		// The key is followed by the extensions, if any, so its length is known by decoding it
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return ad, fmt.Errorf("%w: invalid credential public key: %v", ErrVerification, err)
+		}
+		ad.publicKey, rest = rest[:len(rest)-len(after)], after
+	}
+	if ad.flags&flagExtensions != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return ad, fmt.Errorf("%w: invalid extensions: %v", ErrVerification, err)
+		}
+		rest = after
+	}
+	if len(rest) > 0 {
+		return ad, fmt.Errorf("%w: trailing authenticator data", ErrVerification)
+	}
+	return ad, nil
+}
@@ -0,0 +1,167 @@
+package webauthn
+
+import (
+	"errors"
+	"testing"
+)
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://example.com"
+)
+
+var testRP = RelyingParty{
+	ID:               testRPID,
+	Name:             "Example",
+	Origins:          []string{testOrigin},
+	UserVerification: UserVerificationRequired,
+}
+
+func newTestChallenge(t *testing.T) []byte {
+	t.Helper()
+	c, err := NewChallenge()
+	if err != nil {
+		t.Fatalf("error generating challenge: %v", err)
+	}
+	return c
+}
+
+// register registers a with testRP and returns the credential.
+func register(t *testing.T, a *softAuthenticator) Credential {
+	t.Helper()
+	challenge := newTestChallenge(t)
+	c, err := testRP.VerifyRegistration(a.create(testRPID, testOrigin, challenge), challenge)
+	if err != nil {
+		t.Fatalf("error registering: %v", err)
+	}
+	return c
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	challenge := newTestChallenge(t)
+	r := a.create(testRPID, testOrigin, challenge)
+
+	got, err := r.Challenge()
+	if err != nil || string(got) != string(challenge) {
+		t.Fatalf("Challenge() = %x, %v, want %x", got, err, challenge)
+	}
+	c, err := testRP.VerifyRegistration(r, challenge)
+	if err != nil {
+		t.Fatalf("VerifyRegistration() error: %v", err)
+	}
+	if string(c.ID) != string(a.credentialID) {
+		t.Errorf("credential ID = %x, want %x", c.ID, a.credentialID)
+	}
+	if string(c.PublicKey) != string(a.coseKey()) {
+		t.Errorf("public key = %x, want %x", c.PublicKey, a.coseKey())
+	}
+	if c.SignCount != 0 {
+		t.Errorf("sign count = %d, want 0", c.SignCount)
+	}
+}
+
+func TestVerifyRegistrationFails(t *testing.T) {
+	tests := []struct {
+		name   string
+		rpID   string
+		origin string
+		// reuse verifies against a new challenge, as a replayed response is
+		reuse bool
+		flags byte
+	}{
+		{name: "wrong origin", rpID: testRPID, origin: "https://evil.example"},
+		{name: "wrong rpIdHash", rpID: "evil.example", origin: testOrigin},
+		{name: "reused challenge", rpID: testRPID, origin: testOrigin, reuse: true},
+		{name: "user not verified", rpID: testRPID, origin: testOrigin, flags: flagUserPresent},
+		{name: "user not present", rpID: testRPID, origin: testOrigin, flags: flagUserVerified},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newSoftAuthenticator(t)
+			if tt.flags != 0 {
+				a.flags = tt.flags
+			}
+			challenge := newTestChallenge(t)
+			r := a.create(tt.rpID, tt.origin, challenge)
+			if tt.reuse {
+				if _, err := testRP.VerifyRegistration(r, challenge); err != nil {
+					t.Fatalf("VerifyRegistration() error: %v", err)
+				}
+				challenge = newTestChallenge(t)
+			}
+			if _, err := testRP.VerifyRegistration(r, challenge); !errors.Is(err, ErrVerification) {
+				t.Errorf("VerifyRegistration() error = %v, want %v", err, ErrVerification)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	c := register(t, a)
+
+	signCount := c.SignCount
+	for i := 0; i < 3; i++ {
+		challenge := newTestChallenge(t)
+		got, err := testRP.VerifyAssertion(a.get(testRPID, testOrigin, challenge), challenge, c.PublicKey, signCount)
+		if err != nil {
+			t.Fatalf("VerifyAssertion() error: %v", err)
+		}
+		if got.SignCount != a.signCount || !got.UserVerified {
+			t.Errorf("VerifyAssertion() = %+v, want sign count %d and user verified", got, a.signCount)
+		}
+		signCount = got.SignCount
+	}
+}
+
+func TestVerifyAssertionFails(t *testing.T) {
+	tests := []struct {
+		name   string
+		rpID   string
+		origin string
+		reuse  bool
+		// signCount is the last known count, the authenticator counts from 0 to 1
+		signCount uint32
+		otherKey  bool
+	}{
+		{name: "wrong origin", rpID: testRPID, origin: "https://evil.example"},
+		{name: "wrong rpIdHash", rpID: "evil.example", origin: testOrigin},
+		{name: "reused challenge", rpID: testRPID, origin: testOrigin, reuse: true},
+		{name: "sign count not increased", rpID: testRPID, origin: testOrigin, signCount: 1},
+		{name: "sign count decreased", rpID: testRPID, origin: testOrigin, signCount: 5},
+		{name: "other credential", rpID: testRPID, origin: testOrigin, otherKey: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newSoftAuthenticator(t)
+			c := register(t, a)
+			publicKey := c.PublicKey
+			if tt.otherKey {
+				publicKey = register(t, newSoftAuthenticator(t)).PublicKey
+			}
+			challenge := newTestChallenge(t)
+			r := a.get(tt.rpID, tt.origin, challenge)
+			if tt.reuse {
+				if _, err := testRP.VerifyAssertion(r, challenge, publicKey, tt.signCount); err != nil {
+					t.Fatalf("VerifyAssertion() error: %v", err)
+				}
+				challenge = newTestChallenge(t)
+			}
+			if _, err := testRP.VerifyAssertion(r, challenge, publicKey, tt.signCount); !errors.Is(err, ErrVerification) {
+				t.Errorf("VerifyAssertion() error = %v, want %v", err, ErrVerification)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertionTamperedSignature(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	c := register(t, a)
+	challenge := newTestChallenge(t)
+	r := a.get(testRPID, testOrigin, challenge)
+	r.Response.AuthenticatorData[len(r.Response.AuthenticatorData)-1]++
+	if _, err := testRP.VerifyAssertion(r, challenge, c.PublicKey, 0); !errors.Is(err, ErrVerification) {
+		t.Errorf("VerifyAssertion() error = %v, want %v", err, ErrVerification)
+	}
+}
@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+type Group struct {
+	mu      sync.Mutex
+	workers []*worker
+}
+
+type worker struct {
+	name   string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Go starts fn in its own goroutine, fn should return once ctx is done.
+func (g *Group) Go(ctx context.Context, name string, fn func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &worker{name: name, cancel: cancel, done: make(chan struct{})}
+
+	g.mu.Lock()
+	g.workers = append(g.workers, w)
+	g.mu.Unlock()
+
+	go func() {
+		defer close(w.done)
+		fn(ctx)
+	}()
+}
+
+// Stop stops the workers one by one in reverse start order,
+// so a worker is never stopped before the workers started after it.
+func (g *Group) Stop(ctx context.Context) error {
+	g.mu.Lock()
+	ws := g.workers
+	g.workers = nil
+	g.mu.Unlock()
+
+	var failed []string
+	for i := len(ws) - 1; i >= 0; i-- {
+		w := ws[i]
+		w.cancel()
+		select {
+		case <-w.done:
+			log.Printf("Worker stopped: %s", w.name)
+		case <-ctx.Done():
+			log.Printf("Worker did not stop in time: %s", w.name)
+			failed = append(failed, w.name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("workers did not stop in time: %v", failed)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueFull    = errors.New("queue is full")
+	ErrQueueStopped = errors.New("queue is stopped")
+)
+
+// Queue runs submitted tasks on a fixed number of goroutines, a task is rejected
+// rather than waiting when the queue is already full.
+type Queue struct {
+	tasks   chan func(ctx context.Context)
+	workers int
+	timeout time.Duration
+
+	mu      sync.Mutex
+	stopped bool
+}
+
+// NewQueue returns a Queue of workers goroutines holding up to size waiting tasks,
+// each task is given timeout to finish.
+func NewQueue(workers int, size int, timeout time.Duration) *Queue {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Queue{tasks: make(chan func(ctx context.Context), size), workers: workers, timeout: timeout}
+}
+
+// Submit queues task without blocking, it fails when the queue is full or Run has returned.
+func (q *Queue) Submit(task func(ctx context.Context)) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return ErrQueueStopped
+	}
+	select {
+	case q.tasks <- task:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Run runs the queued tasks until ctx is done, then stops accepting tasks and
+// returns once the running and the still queued tasks have finished.
+// Tasks are not given ctx, so that stopping the queue does not cancel them halfway.
+func (q *Queue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case task := <-q.tasks:
+					q.run(task)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	<-ctx.Done()
+	wg.Wait()
+
+	q.mu.Lock()
+	q.stopped = true
+	q.mu.Unlock()
+	for {
+		select {
+		case task := <-q.tasks:
+			q.run(task)
+		default:
+			return
+		}
+	}
+}
+
+func (q *Queue) run(task func(ctx context.Context)) {
+	ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+	defer cancel()
+	task(ctx)
+}
@@ -0,0 +1,72 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueueRunsTasks(t *testing.T) {
+	q := NewQueue(2, 10, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Run(ctx)
+	}()
+
+	var ran atomic.Int32
+	finished := make(chan struct{}, 5)
+	for i := 0; i < 5; i++ {
+		if err := q.Submit(func(ctx context.Context) {
+			ran.Add(1)
+			finished <- struct{}{}
+		}); err != nil {
+			t.Fatalf("Submit() error: %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		<-finished
+	}
+	cancel()
+	<-done
+	if ran.Load() != 5 {
+		t.Errorf("ran %d tasks, want 5", ran.Load())
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	q := NewQueue(1, 1, time.Second)
+	if err := q.Submit(func(ctx context.Context) {}); err != nil {
+		t.Fatalf("Submit() error: %v", err)
+	}
+	if err := q.Submit(func(ctx context.Context) {}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Submit() error = %v, want %v", err, ErrQueueFull)
+	}
+}
+
+func TestQueueRunFinishesQueuedTasks(t *testing.T) {
+	q := NewQueue(1, 3, time.Second)
+	var ran atomic.Int32
+	for i := 0; i < 3; i++ {
+		if err := q.Submit(func(ctx context.Context) {
+			if ctx.Err() != nil {
+				t.Error("task context is done")
+			}
+			ran.Add(1)
+		}); err != nil {
+			t.Fatalf("Submit() error: %v", err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.Run(ctx)
+	if ran.Load() != 3 {
+		t.Errorf("ran %d tasks, want 3", ran.Load())
+	}
+	if err := q.Submit(func(ctx context.Context) {}); !errors.Is(err, ErrQueueStopped) {
+		t.Errorf("Submit() after Run error = %v, want %v", err, ErrQueueStopped)
+	}
+}